@@ -0,0 +1,77 @@
+package apikey
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"golang-demo/api/auth"
+	"golang-demo/api/user"
+	"net/http"
+	"time"
+)
+
+type apiKeyHandler struct {
+	apiKeyService Service
+}
+
+func NewAPIKeyHandler(apiKeyService Service) *apiKeyHandler {
+	return &apiKeyHandler{apiKeyService}
+}
+
+func (handler *apiKeyHandler) Store(w http.ResponseWriter, r *http.Request) {
+	var input InputAPIKey
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "name required;scopes must be any of users:read,users:write"})
+		return
+	}
+	if input.ExpiresAt != nil && input.ExpiresAt.Before(time.Now()) {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", ErrorText: "expires_at must be in future"})
+		return
+	}
+
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	key, rawKey, err := handler.apiKeyService.Create(input, principal.UserID)
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during create", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]any{"message": "successfully created", "created": key, "key": rawKey}})
+}
+
+func (handler *apiKeyHandler) Get(w http.ResponseWriter, r *http.Request) {
+	keys, err := handler.apiKeyService.Get()
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]any{"api_keys": keys}})
+}
+
+func (handler *apiKeyHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "keyId"))
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+	err = handler.apiKeyService.Revoke(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = render.Render(w, r, user.ErrNotFound)
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during revoke", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]string{"message": "successfully revoked"}})
+}
@@ -0,0 +1,123 @@
+package apikey
+
+import (
+	"database/sql"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"golang-demo/api/user"
+	"time"
+)
+
+type Repository interface {
+	Insert(key APIKey, keyHash string) (APIKey, error)
+	Select() ([]APIKey, error)
+	SelectByPrefix(prefix string) (APIKey, string, error)
+	Revoke(id uuid.UUID) error
+	UpdateLastUsed(id uuid.UUID) error
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *repository {
+	return &repository{db}
+}
+
+var psql sq.StatementBuilderType
+
+func init() {
+	psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+}
+
+var columns = []string{"id", "name", "prefix", "scopes", "created_by", "created_at", "expires_at", "last_used_at", "revoked_at"}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row scanner, extra ...interface{}) (APIKey, error) {
+	var k APIKey
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	dest := append([]interface{}{&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.CreatedBy, &k.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return k, err
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return k, nil
+}
+
+func (r *repository) Insert(key APIKey, keyHash string) (APIKey, error) {
+	query := psql.Insert("api_keys").SetMap(map[string]interface{}{
+		"name":       key.Name,
+		"prefix":     key.Prefix,
+		"key_hash":   keyHash,
+		"scopes":     pq.Array(key.Scopes),
+		"created_by": key.CreatedBy,
+		"expires_at": key.ExpiresAt,
+	}).Suffix("RETURNING id, created_at")
+	err := query.RunWith(r.db).QueryRow().Scan(&key.ID, &key.CreatedAt)
+	return key, err
+}
+
+func (r *repository) Select() ([]APIKey, error) {
+	keys := []APIKey{}
+	rows, err := psql.Select(columns...).From("api_keys").OrderBy("created_at DESC").RunWith(r.db).Query()
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		k, err := scanKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// SelectByPrefix finds key by its public prefix, second value is stored hash of secret part
+func (r *repository) SelectByPrefix(prefix string) (APIKey, string, error) {
+	var keyHash string
+	row := psql.Select(append(columns, "key_hash")...).From("api_keys").Where(sq.Eq{"prefix": prefix}).RunWith(r.db).QueryRow()
+	k, err := scanKey(row, &keyHash)
+	return k, keyHash, err
+}
+
+// Revoke revokes key, returns sql.ErrNoRows if key does not exist or is already revoked
+func (r *repository) Revoke(id uuid.UUID) error {
+	res, err := psql.Update("api_keys").Set("revoked_at", time.Now()).
+		Where(sq.Eq{"id": id, "revoked_at": nil}).RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeUser revokes api keys created by deleted user in transaction tx which deletes it
+func (r *repository) RevokeUser(tx user.Repository, userID uuid.UUID) (int64, error) {
+	res, err := psql.Update("api_keys").Set("revoked_at", time.Now()).
+		Where(sq.Eq{"created_by": userID, "revoked_at": nil}).RunWith(tx.Runner()).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *repository) UpdateLastUsed(id uuid.UUID) error {
+	_, err := psql.Update("api_keys").Set("last_used_at", time.Now()).Where(sq.Eq{"id": id}).RunWith(r.db).Exec()
+	return err
+}
@@ -0,0 +1,82 @@
+package apikey
+
+import (
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/user"
+	"testing"
+	"time"
+)
+
+func DbMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sqldb, mock
+}
+
+func TestAddAPIKey(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	expectedQuery := "INSERT INTO api_keys (.+) VALUES (.+) RETURNING id, created_at"
+	mock.ExpectQuery(expectedQuery).WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(uuid.New(), time.Now()))
+
+	key, err := repo.Insert(APIKey{Name: "billing", Prefix: "abc", Scopes: []string{ScopeUsersRead}}, "hash")
+	assert.Nil(t, err)
+	assert.NotEqual(t, uuid.Nil, key.ID)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFindAPIKeyByPrefix(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	rows := sqlmock.NewRows([]string{"id", "name", "prefix", "scopes", "created_by", "created_at", "expires_at", "last_used_at", "revoked_at", "key_hash"}).
+		AddRow(uuid.New(), "billing", "abc", "{users:read,users:write}", uuid.New(), time.Now(), nil, nil, nil, "hash")
+	mock.ExpectQuery("SELECT (.+) FROM api_keys WHERE prefix = (.+)").WillReturnRows(rows)
+
+	key, keyHash, err := repo.SelectByPrefix("abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "hash", keyHash)
+	assert.Equal(t, []string{ScopeUsersRead, ScopeUsersWrite}, key.Scopes)
+	assert.Nil(t, key.ExpiresAt)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeMissingAPIKey(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectExec("UPDATE api_keys SET revoked_at = (.+) WHERE (.+)").WillReturnResult(sqlmock.NewResult(0, 0))
+	err := repo.Revoke(uuid.New())
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeUserAPIKeysInTransaction(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+	userID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE api_keys SET revoked_at = (.+) WHERE created_by = (.+) AND revoked_at IS NULL").
+		WithArgs(sqlmock.AnyArg(), userID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	var n int64
+	err := user.NewRepository(db).Transaction(func(tx user.Repository) error {
+		var err error
+		n, err = repo.RevokeUser(tx, userID)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,125 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/auth"
+	"golang-demo/api/user"
+	"strings"
+	"time"
+)
+
+var ErrInvalidKey = errors.New("invalid, revoked or expired api key")
+
+type Service interface {
+	Create(input InputAPIKey, createdBy uuid.UUID) (APIKey, string, error)
+	Get() ([]APIKey, error)
+	Revoke(id uuid.UUID) error
+	Verify(rawKey string) (APIKey, error)
+	Authenticate(rawKey string) (auth.Principal, error)
+	AuthenticateCaller(rawKey string) (user.Actor, []string, error)
+}
+
+type service struct {
+	repository Repository
+}
+
+func NewService(repository Repository) *service {
+	return &service{repository}
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create generates new key in format <prefix>.<secret>, raw key is returned only once
+func (s *service) Create(input InputAPIKey, createdBy uuid.UUID) (APIKey, string, error) {
+	prefixBytes := make([]byte, 6)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return APIKey{}, "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return APIKey{}, "", err
+	}
+	prefix := hex.EncodeToString(prefixBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	key, err := s.repository.Insert(APIKey{
+		Name:      input.Name,
+		Prefix:    prefix,
+		Scopes:    input.Scopes,
+		CreatedBy: createdBy,
+		ExpiresAt: input.ExpiresAt,
+	}, hashSecret(secret))
+	if err != nil {
+		return key, "", err
+	}
+	log.Infoln("created api key", key.ID, "by", createdBy)
+	return key, prefix + "." + secret, nil
+}
+
+func (s *service) Get() ([]APIKey, error) {
+	return s.repository.Select()
+}
+
+func (s *service) Revoke(id uuid.UUID) error {
+	err := s.repository.Revoke(id)
+	if err != nil {
+		return err
+	}
+	log.Infoln("revoked api key", id)
+	return nil
+}
+
+// Verify checks raw key from Authorization header and returns stored key if it is active
+func (s *service) Verify(rawKey string) (APIKey, error) {
+	prefix, secret, found := strings.Cut(rawKey, ".")
+	if !found || prefix == "" || secret == "" {
+		return APIKey{}, ErrInvalidKey
+	}
+	key, keyHash, err := s.repository.SelectByPrefix(prefix)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrInvalidKey
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashSecret(secret))) != 1 {
+		return APIKey{}, ErrInvalidKey
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now())) {
+		return APIKey{}, ErrInvalidKey
+	}
+	if err = s.repository.UpdateLastUsed(key.ID); err != nil {
+		log.Warnln("failed to update api key last usage", key.ID, err)
+	}
+	return key, nil
+}
+
+// Authenticate implements auth.KeyAuthenticator, so api keys are accepted by auth middleware
+func (s *service) Authenticate(rawKey string) (auth.Principal, error) {
+	key, err := s.Verify(rawKey)
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	return auth.Principal{APIKeyID: key.ID, Scopes: key.Scopes}, nil
+}
+
+// AuthenticateCaller implements user.CallerAuthenticator, so api keys are accepted by user command consumer and RPC server
+func (s *service) AuthenticateCaller(rawKey string) (user.Actor, []string, error) {
+	key, err := s.Verify(rawKey)
+	if err != nil {
+		return user.Actor{}, nil, err
+	}
+	id := key.ID
+	return user.Actor{Type: user.ActorAPIKey, ID: &id}, key.Scopes, nil
+}
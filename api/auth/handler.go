@@ -0,0 +1,437 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"golang-demo/api/password"
+	"golang-demo/api/user"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyAuthenticator resolves principal from raw api key
+type KeyAuthenticator interface {
+	Authenticate(rawKey string) (Principal, error)
+}
+
+type authHandler struct {
+	authService Service
+	issuer      TokenIssuer
+	apiKeys     KeyAuthenticator
+}
+
+func NewAuthHandler(authService Service, issuer TokenIssuer, apiKeys KeyAuthenticator) *authHandler {
+	return &authHandler{authService, issuer, apiKeys}
+}
+
+func ErrUnauthorized(err error) render.Renderer {
+	return &user.ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 401,
+		StatusText:     "unauthorized",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrForbidden(err error) render.Renderer {
+	return &user.ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 403,
+		StatusText:     "forbidden",
+		ErrorText:      err.Error(),
+	}
+}
+
+// renderLocked responds with 429 and Retry-After header when err is LockedError
+func renderLocked(w http.ResponseWriter, r *http.Request, err error) bool {
+	var lockedErr *LockedError
+	if !errors.As(err, &lockedErr) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(lockedErr.Until).Seconds())+1))
+	_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 429, StatusText: "too many requests", Err: err, ErrorText: err.Error()})
+	return true
+}
+
+// remoteIP returns client ip extracted by LoggerWithLevel
+func remoteIP(r *http.Request) string {
+	if ip, ok := r.Context().Value("remote_ip").(string); ok {
+		return ip
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func (handler *authHandler) Login(w http.ResponseWriter, r *http.Request) {
+	var input LoginInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "login and password required"})
+		return
+	}
+
+	token, err := handler.authService.Login(input, ClientInfo{UserAgent: r.UserAgent(), IP: remoteIP(r)})
+	if renderLocked(w, r, err) {
+		return
+	}
+	if errors.Is(err, ErrInvalidCredentials) {
+		_ = render.Render(w, r, ErrUnauthorized(err))
+		return
+	}
+	if errors.Is(err, ErrUserDeactivated) {
+		_ = render.Render(w, r, ErrForbidden(err))
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 500, StatusText: "error during login", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: token})
+}
+
+func (handler *authHandler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var input TwoFactorLoginInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "mfa_token and code required"})
+		return
+	}
+
+	token, err := handler.authService.LoginTwoFactor(input, ClientInfo{UserAgent: r.UserAgent(), IP: remoteIP(r)})
+	if renderLocked(w, r, err) {
+		return
+	}
+	if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrInvalidCode) {
+		_ = render.Render(w, r, ErrUnauthorized(err))
+		return
+	}
+	if errors.Is(err, ErrUserDeactivated) {
+		_ = render.Render(w, r, ErrForbidden(err))
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 500, StatusText: "error during login", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: token})
+}
+
+func (handler *authHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var input RefreshInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "refresh_token required"})
+		return
+	}
+
+	token, err := handler.authService.Refresh(input.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		_ = render.Render(w, r, ErrUnauthorized(err))
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 500, StatusText: "error during refresh", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: token})
+}
+
+func (handler *authHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user").(user.User).ID
+	sessions, err := handler.authService.GetSessions(userID)
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]any{"sessions": sessions}})
+}
+
+func (handler *authHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user").(user.User).ID
+	sessionID, err := uuid.Parse(chi.URLParam(r, "sessionId"))
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+	err = handler.authService.RevokeSession(userID, sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = render.Render(w, r, user.ErrNotFound)
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during revoke", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]string{"message": "successfully revoked"}})
+}
+
+func (handler *authHandler) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user").(user.User).ID
+	n, err := handler.authService.RevokeSessions(userID)
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during revoke", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]any{"message": "successfully revoked", "revoked": n}})
+}
+
+func (handler *authHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var input PasswordResetInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "login required"})
+		return
+	}
+
+	if err = handler.authService.RequestPasswordReset(input.Login); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 500, StatusText: "error during password reset", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, user.Response{Data: map[string]string{"message": "if account exists, password reset link will be sent"}})
+}
+
+func (handler *authHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var input PasswordResetConfirmInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "token and password required"})
+		return
+	}
+
+	err = handler.authService.ResetPassword(input.Token, input.Password, user.RequestActor(r))
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		_ = render.Render(w, r, user.ErrValidation(user.PasswordViolationsToList(policyErr.Violations)))
+		return
+	}
+	if errors.Is(err, ErrResetTokenInvalid) {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "invalid request", Err: err, ErrorText: err.Error()})
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 500, StatusText: "error during password reset", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]string{"message": "password successfully changed"}})
+}
+
+// ChangePassword replaces password of user, sessions of user other than the current one are revoked
+func (handler *authHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user").(user.User).ID
+	var input PasswordChangeInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "current_password and password required"})
+		return
+	}
+
+	principal, _ := PrincipalFromContext(r.Context())
+	err = handler.authService.ChangePassword(userID, principal.SessionID, input, user.RequestActor(r))
+	if renderLocked(w, r, err) {
+		return
+	}
+	if errors.Is(err, ErrInvalidCredentials) {
+		_ = render.Render(w, r, ErrUnauthorized(err))
+		return
+	}
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		_ = render.Render(w, r, user.ErrValidation(user.PasswordViolationsToList(policyErr.Violations)))
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 500, StatusText: "error during password change", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]string{"message": "password successfully changed"}})
+}
+
+func (handler *authHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user").(user.User).ID
+	uri, err := handler.authService.EnrollTOTP(userID)
+	if errors.Is(err, ErrTwoFactorEnabled) {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 409, StatusText: "conflict", Err: err, ErrorText: err.Error()})
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during enrollment", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]string{"otpauth_uri": uri}})
+}
+
+func (handler *authHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user").(user.User).ID
+	var input TwoFactorCodeInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "code required"})
+		return
+	}
+
+	codes, err := handler.authService.ConfirmTOTP(userID, input.Code, user.RequestActor(r))
+	if errors.Is(err, ErrTwoFactorEnabled) {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 409, StatusText: "conflict", Err: err, ErrorText: err.Error()})
+		return
+	}
+	if errors.Is(err, ErrInvalidCode) || errors.Is(err, ErrTwoFactorNotEnabled) {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during enrollment", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]any{"message": "two-factor authentication enabled", "recovery_codes": codes}})
+}
+
+func (handler *authHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user").(user.User).ID
+	var input TwoFactorDisableInput
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "password and code required"})
+		return
+	}
+
+	err = handler.authService.DisableTOTP(userID, input, user.RequestActor(r))
+	if renderLocked(w, r, err) {
+		return
+	}
+	if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrInvalidCode) {
+		_ = render.Render(w, r, ErrUnauthorized(err))
+		return
+	}
+	if errors.Is(err, ErrTwoFactorNotEnabled) {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during disable", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]string{"message": "two-factor authentication disabled"}})
+}
+
+func (handler *authHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user").(user.User).ID
+	handler.unlock(w, r, AccountKey(userID))
+}
+
+func (handler *authHandler) UnlockIP(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(chi.URLParam(r, "ip"))
+	if ip == nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(errors.New("invalid ip address")))
+		return
+	}
+	handler.unlock(w, r, IPKey(ip.String()))
+}
+
+func (handler *authHandler) unlock(w http.ResponseWriter, r *http.Request, key string) {
+	locked, err := handler.authService.Unlock(key)
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during unlock", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]any{"message": "successfully unlocked", "was_locked": locked}})
+}
+
+// Authenticate validates bearer access token or api key and stores principal in request context,
+// access token is rejected once its session is revoked and carries current role of user
+func (handler *authHandler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || token == "" {
+			_ = render.Render(w, r, ErrUnauthorized(errors.New("missing bearer token or api key")))
+			return
+		}
+		var principal Principal
+		var err error
+		switch {
+		case strings.EqualFold(scheme, "Bearer"):
+			principal, err = handler.issuer.Parse(token)
+			if err != nil {
+				err = errors.New("invalid access token")
+				break
+			}
+			// role claim may be stale after role change, current role of user is used instead
+			principal.Role, err = handler.authService.CheckSession(principal.SessionID)
+			if err != nil && !errors.Is(err, ErrSessionRevoked) {
+				_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 500, StatusText: "error during authentication", Err: err, ErrorText: err.Error()})
+				return
+			}
+		case strings.EqualFold(scheme, "ApiKey"):
+			principal, err = handler.apiKeys.Authenticate(token)
+		default:
+			err = errors.New("unsupported authorization scheme")
+		}
+		if err != nil {
+			_ = render.Render(w, r, ErrUnauthorized(err))
+			return
+		}
+		ctx := context.WithValue(r.Context(), "principal", principal)
+		ctx = user.ContextWithActor(ctx, principal.Actor())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/user"
+	"golang-demo/config"
+	"strings"
+	"time"
+)
+
+// LockedError is returned when account or remote ip must wait before next password or code check
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed attempts, try again after %s", e.Until.Format(time.RFC3339))
+}
+
+// number of failures which do not slow down next attempt
+const freeFailures = 2
+
+func AccountKey(userID uuid.UUID) string {
+	return "account:" + userID.String()
+}
+
+// LoginKey counts failures of login which matches no account, so unknown login is throttled and locked
+// the same way as existing account and responses do not tell whether account exists. Login is hashed
+// since mistyped logins may hold passwords
+func LoginKey(login string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(login))))
+	return "login:" + hex.EncodeToString(sum[:])
+}
+
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+type LockoutGuard interface {
+	Check(keys ...string) error
+	Fail(keys ...string) error
+	Succeed(key string) error
+	Unlock(key string) (bool, error)
+}
+
+type lockoutGuard struct {
+	repository         LockoutRepository
+	amqp               user.MQ
+	maxAccountFailures int
+	maxIPFailures      int
+	window             time.Duration
+	duration           time.Duration
+	baseDelay          time.Duration
+}
+
+func NewLockoutGuard(repository LockoutRepository, amqp user.MQ, cfg config.Config) *lockoutGuard {
+	g := &lockoutGuard{
+		repository:         repository,
+		amqp:               amqp,
+		maxAccountFailures: cfg.LockoutMaxAccountFailures,
+		maxIPFailures:      cfg.LockoutMaxIPFailures,
+		window:             cfg.LockoutFailureWindow,
+		duration:           cfg.LockoutDuration,
+		baseDelay:          cfg.LockoutBaseDelay,
+	}
+	if g.maxAccountFailures <= 0 {
+		g.maxAccountFailures = 5
+	}
+	if g.maxIPFailures <= 0 {
+		g.maxIPFailures = 20
+	}
+	if g.window <= 0 {
+		g.window = 15 * time.Minute
+	}
+	if g.duration <= 0 {
+		g.duration = 15 * time.Minute
+	}
+	if g.baseDelay <= 0 {
+		g.baseDelay = time.Second
+	}
+	return g
+}
+
+// Check returns LockedError if any of keys is locked or throttled
+func (g *lockoutGuard) Check(keys ...string) error {
+	lockouts, err := g.repository.Select(keys)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var until time.Time
+	for _, l := range lockouts {
+		if l.LockedUntil != nil && l.LockedUntil.After(until) {
+			until = *l.LockedUntil
+		}
+		if l.ThrottledUntil != nil && l.ThrottledUntil.After(until) {
+			until = *l.ThrottledUntil
+		}
+	}
+	if until.After(now) {
+		return &LockedError{Until: until}
+	}
+	return nil
+}
+
+// Fail records failed check for every key, delays next attempt exponentially
+// and locks key after max failures within window
+func (g *lockoutGuard) Fail(keys ...string) error {
+	for _, key := range keys {
+		failures, err := g.repository.RecordFailure(key, g.window)
+		if err != nil {
+			return err
+		}
+		maxFailures := g.maxAccountFailures
+		if strings.HasPrefix(key, "ip:") {
+			maxFailures = g.maxIPFailures
+		}
+		switch {
+		case failures >= maxFailures:
+			until := time.Now().Add(g.duration)
+			if err = g.repository.Lock(key, until); err != nil {
+				return err
+			}
+			log.Warnln("locked", key, "after", failures, "failed attempts until", until)
+			g.publish("user.locked", key, map[string]any{"failures": failures, "locked_until": until})
+		case failures > freeFailures:
+			delay := g.baseDelay << (failures - freeFailures - 1)
+			if delay > g.duration || delay <= 0 {
+				delay = g.duration
+			}
+			if err = g.repository.Throttle(key, time.Now().Add(delay)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Succeed resets failures of key after successful check
+func (g *lockoutGuard) Succeed(key string) error {
+	_, err := g.repository.Delete(key)
+	return err
+}
+
+// Unlock resets failures and lock of key, returns whether key was locked
+func (g *lockoutGuard) Unlock(key string) (bool, error) {
+	locked, err := g.repository.Delete(key)
+	if err != nil {
+		return false, err
+	}
+	if locked {
+		log.Infoln("unlocked", key)
+		g.publish("user.unlocked", key, map[string]any{})
+	}
+	return locked, nil
+}
+
+// publish sends lockout event for security team, body contains either user_id or ip of locked key.
+// Locks of unknown logins are not published, there is no account to act on
+func (g *lockoutGuard) publish(queueName string, key string, fields map[string]any) {
+	kind, value, _ := strings.Cut(key, ":")
+	fields["type"] = kind
+	switch kind {
+	case "account":
+		fields["user_id"] = value
+	case "ip":
+		fields["ip"] = value
+	default:
+		return
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		log.Errorln("failed to marshal lockout event", err)
+		return
+	}
+	if err = g.amqp.PublishMessage(queueName, string(body)); err != nil {
+		log.Errorln("failed to publish lockout event", err)
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/config"
+	"testing"
+	"time"
+)
+
+type lockoutRepositoryMock struct {
+	lockouts map[string]*Lockout
+}
+
+func (m *lockoutRepositoryMock) Select(keys []string) ([]Lockout, error) {
+	var lockouts []Lockout
+	for _, key := range keys {
+		if l, ok := m.lockouts[key]; ok {
+			lockouts = append(lockouts, *l)
+		}
+	}
+	return lockouts, nil
+}
+
+func (m *lockoutRepositoryMock) RecordFailure(key string, _ time.Duration) (int, error) {
+	l, ok := m.lockouts[key]
+	if !ok {
+		l = &Lockout{Key: key}
+		m.lockouts[key] = l
+	}
+	l.Failures++
+	return l.Failures, nil
+}
+
+func (m *lockoutRepositoryMock) Throttle(key string, until time.Time) error {
+	m.lockouts[key].ThrottledUntil = &until
+	return nil
+}
+
+func (m *lockoutRepositoryMock) Lock(key string, until time.Time) error {
+	m.lockouts[key].LockedUntil = &until
+	return nil
+}
+
+func (m *lockoutRepositoryMock) Delete(key string) (bool, error) {
+	l, ok := m.lockouts[key]
+	delete(m.lockouts, key)
+	return ok && l.LockedUntil != nil, nil
+}
+
+type mqMock struct {
+	queues  []string
+	private []string
+}
+
+func (m *mqMock) PublishMessage(queue string, _ string) error {
+	m.queues = append(m.queues, queue)
+	return nil
+}
+
+func (m *mqMock) PublishPrivateMessage(queue string, _ string) error {
+	m.private = append(m.private, queue)
+	return nil
+}
+
+func (m *mqMock) PublishEvent(queue string, _ string) error {
+	m.queues = append(m.queues, queue)
+	return nil
+}
+
+func TestLockoutAfterMaxFailures(t *testing.T) {
+	repository := &lockoutRepositoryMock{lockouts: map[string]*Lockout{}}
+	mq := &mqMock{}
+	guard := NewLockoutGuard(repository, mq, config.Config{LockoutMaxAccountFailures: 3, LockoutBaseDelay: time.Millisecond})
+	key := AccountKey(uuid.New())
+
+	assert.Nil(t, guard.Fail(key))
+	assert.Nil(t, guard.Check(key))
+	assert.Nil(t, guard.Fail(key))
+	assert.Nil(t, guard.Fail(key))
+
+	var lockedErr *LockedError
+	assert.ErrorAs(t, guard.Check(key), &lockedErr)
+	assert.Equal(t, []string{"user.locked"}, mq.queues)
+
+	locked, err := guard.Unlock(key)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+	assert.Nil(t, guard.Check(key))
+	assert.Equal(t, []string{"user.locked", "user.unlocked"}, mq.queues)
+}
+
+func TestProgressiveDelay(t *testing.T) {
+	repository := &lockoutRepositoryMock{lockouts: map[string]*Lockout{}}
+	guard := NewLockoutGuard(repository, &mqMock{}, config.Config{LockoutBaseDelay: time.Minute})
+	key := IPKey("127.0.0.1")
+
+	for i := 0; i < freeFailures; i++ {
+		assert.Nil(t, guard.Fail(key))
+		assert.Nil(t, guard.Check(key))
+	}
+	assert.Nil(t, guard.Fail(key))
+	assert.NotNil(t, guard.Check(key))
+	assert.Nil(t, repository.lockouts[key].LockedUntil)
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"golang-demo/api/user"
+	"time"
+)
+
+// Principal is the authenticated caller attached to request context by Authenticate middleware,
+// it is either user authenticated by access token or service authenticated by api key
+type Principal struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Nickname  string    `json:"nickname"`
+	Role      string    `json:"role"`
+	SessionID uuid.UUID `json:"session_id"`
+	APIKeyID  uuid.UUID `json:"api_key_id"`
+	Scopes    []string  `json:"scopes"`
+}
+
+// Actor converts principal to actor recorded in user audit log
+func (p Principal) Actor() user.Actor {
+	if p.APIKeyID != uuid.Nil {
+		id := p.APIKeyID
+		return user.Actor{Type: user.ActorAPIKey, ID: &id}
+	}
+	id := p.UserID
+	return user.Actor{Type: user.ActorUser, ID: &id}
+}
+
+// HasScope reports whether api key principal was granted scope
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// LoginInput represents json body for login api, login is either nickname or email
+type LoginInput struct {
+	Login    string `json:"login" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// RefreshInput represents json body for token refresh api
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// PasswordResetInput represents json body for password reset request api, login is either nickname or email
+type PasswordResetInput struct {
+	Login string `json:"login" validate:"required"`
+}
+
+// PasswordResetConfirmInput represents json body for password reset confirmation api
+type PasswordResetConfirmInput struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// PasswordChangeInput represents json body for password change api, requires current password
+type PasswordChangeInput struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	Password        string `json:"password" validate:"required"`
+}
+
+// Token is returned to client after successful login or refresh.
+// For users with two-factor authentication login returns only MFAToken which must be exchanged at second step
+type Token struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	MFARequired  bool   `json:"mfa_required,omitempty"`
+	MFAToken     string `json:"mfa_token,omitempty"`
+}
+
+// TwoFactorLoginInput represents json body for second login step, code is either TOTP code or recovery code
+type TwoFactorLoginInput struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+// TwoFactorCodeInput represents json body for two-factor enrollment confirmation
+type TwoFactorCodeInput struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// TwoFactorDisableInput represents json body for disabling two-factor authentication, requires re-authentication
+type TwoFactorDisableInput struct {
+	Password string `json:"password" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+// Lockout holds failed password or code checks counted per account or per remote ip
+type Lockout struct {
+	Key            string     `json:"key"`
+	Failures       int        `json:"failures"`
+	LastFailureAt  time.Time  `json:"last_failure_at"`
+	ThrottledUntil *time.Time `json:"throttled_until"`
+	LockedUntil    *time.Time `json:"locked_until"`
+}
+
+// TwoFactor holds two-factor authentication state of user, secret is AES-GCM encrypted
+type TwoFactor struct {
+	UserID             uuid.UUID
+	EncryptedSecret    string
+	EnabledAt          *time.Time
+	RecoveryCodeHashes []string
+	LastStep           int64
+}
+
+// Session holds login session of user, refresh tokens issued for session are rotated on every refresh
+type Session struct {
+	ID              uuid.UUID  `json:"id"`
+	UserID          uuid.UUID  `json:"user_id"`
+	UserAgent       string     `json:"user_agent"`
+	IP              string     `json:"ip"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastRefreshedAt time.Time  `json:"last_refreshed_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	RevokedAt       *time.Time `json:"-"`
+}
+
+// ClientInfo describes client which is logging in
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// PrincipalFromContext returns principal stored by Authenticate middleware
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value("principal").(Principal)
+	return principal, ok
+}
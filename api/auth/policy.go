@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"github.com/google/uuid"
+	"golang-demo/api/user"
+)
+
+// Action is operation guarded by Policy
+type Action string
+
+const (
+	ActionUserList         Action = "users:list"
+	ActionUserRead         Action = "users:read"
+	ActionUserUpdate       Action = "users:update"
+	ActionUserDelete       Action = "users:delete"
+	ActionUserSetRole      Action = "users:set_role"
+	ActionSessionRead      Action = "sessions:read"
+	ActionSessionRevoke    Action = "sessions:revoke"
+	ActionAPIKeyManage     Action = "api_keys:manage"
+	ActionTwoFactor        Action = "two_factor:manage"
+	ActionLockoutManage    Action = "lockouts:manage"
+	ActionDeadLetterManage Action = "dead_letters:manage"
+	ActionResyncManage     Action = "resync:manage"
+	ActionUserAudit        Action = "users:audit"
+	ActionUserRestore      Action = "users:restore"
+	ActionPasswordChange   Action = "users:change_password"
+)
+
+// api key scopes required for actions, actions missing here are not available for api keys
+var keyScopes = map[Action]string{
+	ActionUserList:      "users:read",
+	ActionUserRead:      "users:read",
+	ActionSessionRead:   "users:read",
+	ActionUserUpdate:    "users:write",
+	ActionUserDelete:    "users:write",
+	ActionSessionRevoke: "users:write",
+}
+
+// scope defines on which users role may perform action
+type scope int
+
+const (
+	scopeSelf scope = iota + 1
+	scopeAny
+)
+
+type Policy interface {
+	Allowed(principal Principal, action Action, target uuid.UUID) bool
+}
+
+type rolePolicy struct {
+	rules map[string]map[Action]scope
+}
+
+// NewRolePolicy creates policy with default rules: admins may do anything to anyone,
+// support may view anyone and manage sessions of anyone, members may act only on themselves.
+// Two-factor authentication and password may be managed only by user themselves
+func NewRolePolicy() *rolePolicy {
+	return &rolePolicy{rules: map[string]map[Action]scope{
+		user.RoleAdmin: {
+			ActionUserList:         scopeAny,
+			ActionUserRead:         scopeAny,
+			ActionUserUpdate:       scopeAny,
+			ActionUserDelete:       scopeAny,
+			ActionUserSetRole:      scopeAny,
+			ActionSessionRead:      scopeAny,
+			ActionSessionRevoke:    scopeAny,
+			ActionAPIKeyManage:     scopeAny,
+			ActionLockoutManage:    scopeAny,
+			ActionDeadLetterManage: scopeAny,
+			ActionResyncManage:     scopeAny,
+			ActionUserAudit:        scopeAny,
+			ActionUserRestore:      scopeAny,
+			ActionTwoFactor:        scopeSelf,
+			ActionPasswordChange:   scopeSelf,
+		},
+		user.RoleSupport: {
+			ActionUserList:       scopeAny,
+			ActionUserRead:       scopeAny,
+			ActionUserAudit:      scopeAny,
+			ActionUserRestore:    scopeAny,
+			ActionUserUpdate:     scopeSelf,
+			ActionUserDelete:     scopeSelf,
+			ActionSessionRead:    scopeAny,
+			ActionSessionRevoke:  scopeAny,
+			ActionTwoFactor:      scopeSelf,
+			ActionPasswordChange: scopeSelf,
+		},
+		user.RoleMember: {
+			ActionUserRead:       scopeSelf,
+			ActionUserUpdate:     scopeSelf,
+			ActionUserDelete:     scopeSelf,
+			ActionSessionRead:    scopeSelf,
+			ActionSessionRevoke:  scopeSelf,
+			ActionTwoFactor:      scopeSelf,
+			ActionPasswordChange: scopeSelf,
+		},
+	}}
+}
+
+// Allowed reports whether principal may perform action on target user, target is uuid.Nil for collection actions.
+// Api key principals are checked by granted scopes instead of role
+func (p *rolePolicy) Allowed(principal Principal, action Action, target uuid.UUID) bool {
+	if principal.APIKeyID != uuid.Nil {
+		scope, ok := keyScopes[action]
+		return ok && principal.HasScope(scope)
+	}
+	switch p.rules[principal.Role][action] {
+	case scopeAny:
+		return true
+	case scopeSelf:
+		return target != uuid.Nil && target == principal.UserID
+	default:
+		return false
+	}
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/user"
+	"testing"
+)
+
+func TestMemberMayUpdateOnlyThemselves(t *testing.T) {
+	policy := NewRolePolicy()
+	member := Principal{UserID: uuid.New(), Role: user.RoleMember}
+
+	assert.True(t, policy.Allowed(member, ActionUserUpdate, member.UserID))
+	assert.False(t, policy.Allowed(member, ActionUserUpdate, uuid.New()))
+	assert.False(t, policy.Allowed(member, ActionUserList, uuid.Nil))
+	assert.False(t, policy.Allowed(member, ActionUserSetRole, member.UserID))
+}
+
+func TestAdminMayUpdateAnyone(t *testing.T) {
+	policy := NewRolePolicy()
+	admin := Principal{UserID: uuid.New(), Role: user.RoleAdmin}
+
+	assert.True(t, policy.Allowed(admin, ActionUserUpdate, uuid.New()))
+	assert.True(t, policy.Allowed(admin, ActionUserSetRole, uuid.New()))
+}
+
+func TestPasswordMayBeChangedOnlyByUserThemselves(t *testing.T) {
+	policy := NewRolePolicy()
+	admin := Principal{UserID: uuid.New(), Role: user.RoleAdmin}
+	key := Principal{APIKeyID: uuid.New(), Scopes: []string{"users:write"}}
+
+	assert.True(t, policy.Allowed(admin, ActionPasswordChange, admin.UserID))
+	assert.False(t, policy.Allowed(admin, ActionPasswordChange, uuid.New()))
+	assert.False(t, policy.Allowed(key, ActionPasswordChange, uuid.New()))
+}
+
+func TestUnknownRoleIsDenied(t *testing.T) {
+	policy := NewRolePolicy()
+	p := Principal{UserID: uuid.New(), Role: "guest"}
+
+	assert.False(t, policy.Allowed(p, ActionUserRead, p.UserID))
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	policy := NewRolePolicy()
+	key := Principal{APIKeyID: uuid.New(), Scopes: []string{"users:read"}}
+
+	assert.True(t, policy.Allowed(key, ActionUserRead, uuid.New()))
+	assert.False(t, policy.Allowed(key, ActionUserUpdate, uuid.New()))
+	assert.False(t, policy.Allowed(key, ActionAPIKeyManage, uuid.Nil))
+}
@@ -0,0 +1,424 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"golang-demo/api/user"
+	"time"
+)
+
+var ErrRefreshTokenReused = errors.New("refresh token reused, session revoked")
+var ErrResetTokenInvalid = errors.New("invalid, used or expired password reset token")
+var ErrInvalidCode = errors.New("invalid or already used verification code")
+
+type SessionRepository interface {
+	Insert(session Session, tokenHash string) (uuid.UUID, error)
+	SelectByTokenHash(tokenHash string) (Session, *time.Time, error)
+	SelectByID(sessionID uuid.UUID) (Session, error)
+	Rotate(sessionID uuid.UUID, oldTokenHash string, newTokenHash string, expiresAt time.Time) error
+	SelectActive(userID uuid.UUID) ([]Session, error)
+	Revoke(userID uuid.UUID, sessionID uuid.UUID) error
+	RevokeAll(userID uuid.UUID) (int64, error)
+	RevokeUser(tx user.Repository, userID uuid.UUID) (int64, error)
+	RevokeOthers(tx user.Repository, userID uuid.UUID, keepSessionID uuid.UUID) (int64, error)
+}
+
+type sessionRepository struct {
+	db *sql.DB
+}
+
+func NewSessionRepository(db *sql.DB) *sessionRepository {
+	return &sessionRepository{db}
+}
+
+var psql sq.StatementBuilderType
+
+func init() {
+	psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+}
+
+// Insert creates new session together with its first refresh token
+func (r *sessionRepository) Insert(session Session, tokenHash string) (uuid.UUID, error) {
+	var id uuid.UUID
+	tx, err := r.db.Begin()
+	if err != nil {
+		return id, err
+	}
+	defer tx.Rollback()
+
+	err = psql.Insert("sessions").SetMap(map[string]interface{}{
+		"user_id":    session.UserID,
+		"user_agent": session.UserAgent,
+		"ip":         session.IP,
+		"expires_at": session.ExpiresAt,
+	}).Suffix("RETURNING id").RunWith(tx).QueryRow().Scan(&id)
+	if err != nil {
+		return id, err
+	}
+	_, err = psql.Insert("refresh_tokens").SetMap(map[string]interface{}{
+		"token_hash": tokenHash,
+		"session_id": id,
+	}).RunWith(tx).Exec()
+	if err != nil {
+		return id, err
+	}
+	return id, tx.Commit()
+}
+
+// SelectByTokenHash finds session owning refresh token, second value is token rotation time if it was already used
+func (r *sessionRepository) SelectByTokenHash(tokenHash string) (Session, *time.Time, error) {
+	var s Session
+	var rotatedAt sql.NullTime
+	var revokedAt sql.NullTime
+	query :=
+		psql.Select("s.id", "s.user_id", "s.user_agent", "s.ip", "s.created_at", "s.last_refreshed_at", "s.expires_at", "s.revoked_at", "t.rotated_at").
+			From("refresh_tokens t").Join("sessions s ON s.id = t.session_id").Where(sq.Eq{"t.token_hash": tokenHash})
+	err := query.RunWith(r.db).QueryRow().
+		Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastRefreshedAt, &s.ExpiresAt, &revokedAt, &rotatedAt)
+	if err != nil {
+		return s, nil, err
+	}
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	if rotatedAt.Valid {
+		return s, &rotatedAt.Time, nil
+	}
+	return s, nil, nil
+}
+
+// SelectByID returns session including revoked and expired ones
+func (r *sessionRepository) SelectByID(sessionID uuid.UUID) (Session, error) {
+	var s Session
+	var revokedAt sql.NullTime
+	err := psql.Select("id", "user_id", "user_agent", "ip", "created_at", "last_refreshed_at", "expires_at", "revoked_at").
+		From("sessions").Where(sq.Eq{"id": sessionID}).RunWith(r.db).QueryRow().
+		Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastRefreshedAt, &s.ExpiresAt, &revokedAt)
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	return s, err
+}
+
+// Rotate marks old refresh token as used and stores its replacement,
+// returns ErrRefreshTokenReused when old token was rotated concurrently
+func (r *sessionRepository) Rotate(sessionID uuid.UUID, oldTokenHash string, newTokenHash string, expiresAt time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := psql.Update("refresh_tokens").Set("rotated_at", time.Now()).
+		Where(sq.Eq{"token_hash": oldTokenHash, "rotated_at": nil}).RunWith(tx).Exec()
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrRefreshTokenReused
+	}
+	_, err = psql.Insert("refresh_tokens").SetMap(map[string]interface{}{
+		"token_hash": newTokenHash,
+		"session_id": sessionID,
+	}).RunWith(tx).Exec()
+	if err != nil {
+		return err
+	}
+	_, err = psql.Update("sessions").SetMap(map[string]interface{}{
+		"last_refreshed_at": time.Now(),
+		"expires_at":        expiresAt,
+	}).Where(sq.Eq{"id": sessionID}).RunWith(tx).Exec()
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SelectActive returns not revoked and not expired sessions of user
+func (r *sessionRepository) SelectActive(userID uuid.UUID) ([]Session, error) {
+	sessions := []Session{}
+	rows, err := psql.Select("id", "user_id", "user_agent", "ip", "created_at", "last_refreshed_at", "expires_at").
+		From("sessions").Where(sq.Eq{"user_id": userID, "revoked_at": nil}).Where("expires_at > now()").
+		OrderBy("last_refreshed_at DESC").RunWith(r.db).Query()
+	if err != nil {
+		return sessions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastRefreshedAt, &s.ExpiresAt)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Revoke revokes single session of user, returns sql.ErrNoRows if there is no such active session
+func (r *sessionRepository) Revoke(userID uuid.UUID, sessionID uuid.UUID) error {
+	res, err := psql.Update("sessions").Set("revoked_at", time.Now()).
+		Where(sq.Eq{"id": sessionID, "user_id": userID, "revoked_at": nil}).RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeAll revokes every active session of user and returns number of revoked sessions
+func (r *sessionRepository) RevokeAll(userID uuid.UUID) (int64, error) {
+	res, err := psql.Update("sessions").Set("revoked_at", time.Now()).
+		Where(sq.Eq{"user_id": userID, "revoked_at": nil}).RunWith(r.db).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RevokeUser revokes every active session of user in transaction tx, e.g. one which deletes user or resets its password
+func (r *sessionRepository) RevokeUser(tx user.Repository, userID uuid.UUID) (int64, error) {
+	res, err := psql.Update("sessions").Set("revoked_at", time.Now()).
+		Where(sq.Eq{"user_id": userID, "revoked_at": nil}).RunWith(tx.Runner()).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RevokeOthers revokes all sessions of user except keepSessionID in transaction tx, e.g. one which changes its password
+func (r *sessionRepository) RevokeOthers(tx user.Repository, userID uuid.UUID, keepSessionID uuid.UUID) (int64, error) {
+	res, err := psql.Update("sessions").Set("revoked_at", time.Now()).
+		Where(sq.Eq{"user_id": userID, "revoked_at": nil}).Where(sq.NotEq{"id": keepSessionID}).RunWith(tx.Runner()).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type PasswordResetRepository interface {
+	Insert(userID uuid.UUID, tokenHash string, expiresAt time.Time) error
+	SelectUserID(tokenHash string) (uuid.UUID, error)
+	Consume(tokenHash string) (uuid.UUID, error)
+	WithTx(tx user.Repository) PasswordResetRepository
+}
+
+type passwordResetRepository struct {
+	db sq.BaseRunner
+}
+
+func NewPasswordResetRepository(db *sql.DB) *passwordResetRepository {
+	return &passwordResetRepository{db}
+}
+
+// WithTx returns repository running in transaction of tx, so token is consumed only with password change
+func (r *passwordResetRepository) WithTx(tx user.Repository) PasswordResetRepository {
+	return &passwordResetRepository{tx.Runner()}
+}
+
+func (r *passwordResetRepository) Insert(userID uuid.UUID, tokenHash string, expiresAt time.Time) error {
+	_, err := psql.Insert("password_reset_tokens").SetMap(map[string]interface{}{
+		"token_hash": tokenHash,
+		"user_id":    userID,
+		"expires_at": expiresAt,
+	}).RunWith(r.db).Exec()
+	return err
+}
+
+// SelectUserID returns user of token if token is not used and not expired
+func (r *passwordResetRepository) SelectUserID(tokenHash string) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := psql.Select("user_id").From("password_reset_tokens").
+		Where(sq.Eq{"token_hash": tokenHash, "used_at": nil}).Where("expires_at > now()").
+		RunWith(r.db).QueryRow().Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return userID, ErrResetTokenInvalid
+	}
+	return userID, err
+}
+
+// Consume marks token as used and returns its user, token can be consumed only once before expiration
+func (r *passwordResetRepository) Consume(tokenHash string) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := psql.Update("password_reset_tokens").Set("used_at", time.Now()).
+		Where(sq.Eq{"token_hash": tokenHash, "used_at": nil}).Where("expires_at > now()").
+		Suffix("RETURNING user_id").RunWith(r.db).QueryRow().Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return userID, ErrResetTokenInvalid
+	}
+	return userID, err
+}
+
+type TwoFactorRepository interface {
+	Select(userID uuid.UUID) (TwoFactor, error)
+	SavePending(userID uuid.UUID, encryptedSecret string) error
+	Enable(userID uuid.UUID, recoveryCodeHashes []string, step int64) error
+	UseStep(userID uuid.UUID, step int64) error
+	UseRecoveryCode(userID uuid.UUID, codeHash string) error
+	Disable(userID uuid.UUID) error
+	WithTx(tx user.Repository) TwoFactorRepository
+}
+
+type twoFactorRepository struct {
+	db sq.BaseRunner
+}
+
+func NewTwoFactorRepository(db *sql.DB) *twoFactorRepository {
+	return &twoFactorRepository{db}
+}
+
+// WithTx returns repository running in transaction of tx, so two-factor change is audited atomically
+func (r *twoFactorRepository) WithTx(tx user.Repository) TwoFactorRepository {
+	return &twoFactorRepository{tx.Runner()}
+}
+
+func (r *twoFactorRepository) Select(userID uuid.UUID) (TwoFactor, error) {
+	tf := TwoFactor{UserID: userID}
+	var secret sql.NullString
+	var enabledAt sql.NullTime
+	var lastStep sql.NullInt64
+	err := psql.Select("totp_secret", "totp_enabled_at", "totp_recovery_codes", "totp_last_step").
+		From("users").Where(sq.Eq{"id": userID}).RunWith(r.db).QueryRow().
+		Scan(&secret, &enabledAt, pq.Array(&tf.RecoveryCodeHashes), &lastStep)
+	if err != nil {
+		return tf, err
+	}
+	tf.EncryptedSecret = secret.String
+	tf.LastStep = lastStep.Int64
+	if enabledAt.Valid {
+		tf.EnabledAt = &enabledAt.Time
+	}
+	return tf, nil
+}
+
+// SavePending stores new secret which is not enforced until enrollment is confirmed
+func (r *twoFactorRepository) SavePending(userID uuid.UUID, encryptedSecret string) error {
+	_, err := psql.Update("users").SetMap(map[string]interface{}{
+		"totp_secret":         encryptedSecret,
+		"totp_enabled_at":     nil,
+		"totp_recovery_codes": nil,
+		"totp_last_step":      nil,
+	}).Where(sq.Eq{"id": userID}).RunWith(r.db).Exec()
+	return err
+}
+
+func (r *twoFactorRepository) Enable(userID uuid.UUID, recoveryCodeHashes []string, step int64) error {
+	_, err := psql.Update("users").SetMap(map[string]interface{}{
+		"totp_enabled_at":     time.Now(),
+		"totp_recovery_codes": pq.Array(recoveryCodeHashes),
+		"totp_last_step":      step,
+	}).Where(sq.Eq{"id": userID}).RunWith(r.db).Exec()
+	return err
+}
+
+// UseStep remembers last accepted time step, so the same code can not be replayed
+func (r *twoFactorRepository) UseStep(userID uuid.UUID, step int64) error {
+	res, err := psql.Update("users").Set("totp_last_step", step).
+		Where(sq.Eq{"id": userID}).Where("(totp_last_step IS NULL OR totp_last_step < ?)", step).RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// UseRecoveryCode removes recovery code from user, returns ErrInvalidCode if there is no such code
+func (r *twoFactorRepository) UseRecoveryCode(userID uuid.UUID, codeHash string) error {
+	res, err := psql.Update("users").Set("totp_recovery_codes", sq.Expr("array_remove(totp_recovery_codes, ?)", codeHash)).
+		Where(sq.Eq{"id": userID}).Where("? = ANY(totp_recovery_codes)", codeHash).RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (r *twoFactorRepository) Disable(userID uuid.UUID) error {
+	_, err := psql.Update("users").SetMap(map[string]interface{}{
+		"totp_secret":         nil,
+		"totp_enabled_at":     nil,
+		"totp_recovery_codes": nil,
+		"totp_last_step":      nil,
+	}).Where(sq.Eq{"id": userID}).RunWith(r.db).Exec()
+	return err
+}
+
+type LockoutRepository interface {
+	Select(keys []string) ([]Lockout, error)
+	RecordFailure(key string, window time.Duration) (int, error)
+	Throttle(key string, until time.Time) error
+	Lock(key string, until time.Time) error
+	Delete(key string) (bool, error)
+}
+
+type lockoutRepository struct {
+	db *sql.DB
+}
+
+func NewLockoutRepository(db *sql.DB) *lockoutRepository {
+	return &lockoutRepository{db}
+}
+
+func (r *lockoutRepository) Select(keys []string) ([]Lockout, error) {
+	lockouts := []Lockout{}
+	rows, err := psql.Select("key", "failures", "last_failure_at", "throttled_until", "locked_until").
+		From("auth_failures").Where(sq.Eq{"key": keys}).RunWith(r.db).Query()
+	if err != nil {
+		return lockouts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l Lockout
+		if err := rows.Scan(&l.Key, &l.Failures, &l.LastFailureAt, &l.ThrottledUntil, &l.LockedUntil); err != nil {
+			return lockouts, err
+		}
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+// RecordFailure increments failures counter of key and returns new value,
+// counter starts over when previous failure is older than window
+func (r *lockoutRepository) RecordFailure(key string, window time.Duration) (int, error) {
+	var failures int
+	err := psql.Insert("auth_failures").Columns("key", "failures", "last_failure_at").Values(key, 1, time.Now()).
+		Suffix(`ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN auth_failures.last_failure_at < ? THEN 1 ELSE auth_failures.failures + 1 END,
+			last_failure_at = excluded.last_failure_at
+			RETURNING failures`, time.Now().Add(-window)).
+		RunWith(r.db).QueryRow().Scan(&failures)
+	return failures, err
+}
+
+func (r *lockoutRepository) Throttle(key string, until time.Time) error {
+	_, err := psql.Update("auth_failures").Set("throttled_until", until).Where(sq.Eq{"key": key}).RunWith(r.db).Exec()
+	return err
+}
+
+func (r *lockoutRepository) Lock(key string, until time.Time) error {
+	_, err := psql.Update("auth_failures").Set("locked_until", until).Where(sq.Eq{"key": key}).RunWith(r.db).Exec()
+	return err
+}
+
+// Delete resets failures of key, returns whether key was temporarily locked
+func (r *lockoutRepository) Delete(key string) (bool, error) {
+	var lockedUntil sql.NullTime
+	query, args, err := psql.Delete("auth_failures").Where(sq.Eq{"key": key}).Suffix("RETURNING locked_until").ToSql()
+	if err != nil {
+		return false, err
+	}
+	err = r.db.QueryRow(query, args...).Scan(&lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return lockedUntil.Valid && lockedUntil.Time.After(time.Now()), err
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/user"
+	"testing"
+	"time"
+)
+
+func DbMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sqldb, mock
+}
+
+func TestInsertSession(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewSessionRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO sessions (.+) VALUES (.+) RETURNING id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+	mock.ExpectExec("INSERT INTO refresh_tokens (.+) VALUES (.+)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, err := repo.Insert(Session{UserID: uuid.New(), ExpiresAt: time.Now()}, "hash")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRotateReusedToken(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewSessionRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE refresh_tokens SET rotated_at = (.+) WHERE (.+)").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := repo.Rotate(uuid.New(), "old", "new", time.Now())
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewSessionRepository(db)
+
+	mock.ExpectExec("UPDATE sessions SET revoked_at = (.+) WHERE (.+)").WillReturnResult(sqlmock.NewResult(0, 2))
+	n, err := repo.RevokeAll(uuid.New())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewSessionRepository(db)
+	userID, sessionID := uuid.New(), uuid.New()
+
+	mock.ExpectExec("UPDATE sessions SET revoked_at = (.+) WHERE revoked_at IS NULL AND user_id = (.+) AND id <> (.+)").
+		WithArgs(sqlmock.AnyArg(), userID, sessionID).WillReturnResult(sqlmock.NewResult(0, 1))
+	n, err := repo.RevokeOthers(user.NewRepository(db), userID, sessionID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestConsumeResetToken(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewPasswordResetRepository(db)
+
+	userID := uuid.New()
+	mock.ExpectQuery("UPDATE password_reset_tokens SET used_at = (.+) WHERE (.+) RETURNING user_id").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(userID))
+	id, err := repo.Consume("hash")
+	assert.Nil(t, err)
+	assert.Equal(t, userID, id)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestConsumeUsedResetToken(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewPasswordResetRepository(db)
+
+	mock.ExpectQuery("UPDATE password_reset_tokens SET used_at = (.+) WHERE (.+) RETURNING user_id").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	_, err := repo.Consume("hash")
+	assert.ErrorIs(t, err, ErrResetTokenInvalid)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUseReplayedTOTPStep(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewTwoFactorRepository(db)
+
+	mock.ExpectExec("UPDATE users SET totp_last_step = (.+) WHERE id = (.+) AND \\(totp_last_step IS NULL OR totp_last_step < (.+)\\)").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	err := repo.UseStep(uuid.New(), 100)
+	assert.ErrorIs(t, err, ErrInvalidCode)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewTwoFactorRepository(db)
+
+	mock.ExpectExec("UPDATE users SET totp_recovery_codes = array_remove\\(totp_recovery_codes, (.+)\\) WHERE id = (.+) AND (.+) = ANY\\(totp_recovery_codes\\)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	err := repo.UseRecoveryCode(uuid.New(), "hash")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeUserSessionsInTransaction(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewSessionRepository(db)
+	userID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sessions SET revoked_at = (.+) WHERE revoked_at IS NULL AND user_id = (.+)").
+		WithArgs(sqlmock.AnyArg(), userID).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	var n int64
+	err := user.NewRepository(db).Transaction(func(tx user.Repository) error {
+		var err error
+		n, err = repo.RevokeUser(tx, userID)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSelectRevokedSessionByID(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewSessionRepository(db)
+	id := uuid.New()
+
+	rows := sqlmock.NewRows([]string{"id", "user_id", "user_agent", "ip", "created_at", "last_refreshed_at", "expires_at", "revoked_at"}).
+		AddRow(id, uuid.New(), "curl", "127.0.0.1", time.Now(), time.Now(), time.Now().Add(time.Hour), time.Now())
+	mock.ExpectQuery("SELECT (.+) FROM sessions WHERE id = (.+)").WithArgs(id).WillReturnRows(rows)
+	session, err := repo.SelectByID(id)
+	assert.Nil(t, err)
+	assert.NotNil(t, session.RevokedAt)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
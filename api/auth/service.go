@@ -0,0 +1,684 @@
+package auth
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/password"
+	"golang-demo/api/user"
+	"golang-demo/config"
+	"time"
+)
+
+var ErrInvalidCredentials = errors.New("invalid login or password")
+var ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+var ErrSessionRevoked = errors.New("session is revoked or expired")
+var ErrUserDeactivated = errors.New("user is deactivated")
+var ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+var ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+
+type Service interface {
+	Login(input LoginInput, client ClientInfo) (Token, error)
+	Refresh(refreshToken string) (Token, error)
+	GetSessions(userID uuid.UUID) ([]Session, error)
+	RevokeSession(userID uuid.UUID, sessionID uuid.UUID) error
+	RevokeSessions(userID uuid.UUID) (int64, error)
+	CheckSession(sessionID uuid.UUID) (string, error)
+	RequestPasswordReset(login string) error
+	ResetPassword(token string, newPassword string, actor user.Actor) error
+	ChangePassword(userID uuid.UUID, sessionID uuid.UUID, input PasswordChangeInput, actor user.Actor) error
+	LoginTwoFactor(input TwoFactorLoginInput, client ClientInfo) (Token, error)
+	EnrollTOTP(userID uuid.UUID) (string, error)
+	ConfirmTOTP(userID uuid.UUID, code string, actor user.Actor) ([]string, error)
+	DisableTOTP(userID uuid.UUID, input TwoFactorDisableInput, actor user.Actor) error
+	Unlock(key string) (bool, error)
+}
+
+type service struct {
+	userRepository      user.Repository
+	sessionRepository   SessionRepository
+	resetRepository     PasswordResetRepository
+	twoFactorRepository TwoFactorRepository
+	lockout             LockoutGuard
+	passwordPolicy      password.Policy
+	hasher              password.Hasher
+	dummyHash           string
+	issuer              TokenIssuer
+	amqp                user.MQ
+	secretCipher        cipher.AEAD
+	totpIssuer          string
+	refreshTTL          time.Duration
+	resetTTL            time.Duration
+	sessions            *sessionCache
+}
+
+func NewService(userRepository user.Repository, sessionRepository SessionRepository, resetRepository PasswordResetRepository,
+	twoFactorRepository TwoFactorRepository, lockout LockoutGuard, passwordPolicy password.Policy, hasher password.Hasher, issuer TokenIssuer, amqp user.MQ,
+	cfg config.Config) (*service, error) {
+	secretCipher, err := newSecretCipher(cfg.TotpEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	// used to keep response time the same whether login exists or not
+	dummyHash, err := hasher.Hash("dummy-password")
+	if err != nil {
+		return nil, err
+	}
+	s := &service{
+		userRepository:      userRepository,
+		sessionRepository:   sessionRepository,
+		resetRepository:     resetRepository,
+		twoFactorRepository: twoFactorRepository,
+		lockout:             lockout,
+		passwordPolicy:      passwordPolicy,
+		hasher:              hasher,
+		dummyHash:           dummyHash,
+		issuer:              issuer,
+		amqp:                amqp,
+		secretCipher:        secretCipher,
+		totpIssuer:          cfg.TotpIssuer,
+		refreshTTL:          cfg.JwtRefreshTTL,
+		resetTTL:            cfg.PasswordResetTTL,
+	}
+	if s.totpIssuer == "" {
+		s.totpIssuer = "golang-demo"
+	}
+	if s.refreshTTL <= 0 {
+		s.refreshTTL = 30 * 24 * time.Hour
+	}
+	if s.resetTTL <= 0 {
+		s.resetTTL = time.Hour
+	}
+	sessionCheckInterval := cfg.SessionCheckInterval
+	if sessionCheckInterval <= 0 {
+		sessionCheckInterval = 10 * time.Second
+	}
+	s.sessions = newSessionCache(sessionCheckInterval)
+	return s, nil
+}
+
+// generates random opaque token, only its sha256 hash is stored in db
+func newOpaqueToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Login checks password against stored hash, starts new session and issues access and refresh tokens.
+// Hash made with outdated algorithm or parameters is replaced after successful check.
+// Users with two-factor authentication get only mfa token which must be exchanged by LoginTwoFactor.
+// Failed attempts are counted per account and per remote ip by lockout guard
+func (s *service) Login(input LoginInput, client ClientInfo) (Token, error) {
+	ipKey := IPKey(client.IP)
+	if err := s.lockout.Check(ipKey); err != nil {
+		return Token{}, err
+	}
+	u, err := s.userRepository.SelectByLogin(input.Login)
+	if err != nil {
+		// unknown login goes through the same lockout check, password check and failure count as account
+		loginKey := LoginKey(input.Login)
+		if err = s.lockout.Check(loginKey); err != nil {
+			return Token{}, err
+		}
+		_, _, _ = s.hasher.Verify(input.Password, s.dummyHash)
+		s.fail(loginKey, ipKey)
+		return Token{}, ErrInvalidCredentials
+	}
+	accountKey := AccountKey(u.ID)
+	if err = s.lockout.Check(accountKey); err != nil {
+		return Token{}, err
+	}
+	ok, rehash := s.verifyPassword(u, input.Password)
+	if !ok {
+		s.fail(accountKey, ipKey)
+		return Token{}, ErrInvalidCredentials
+	}
+	if err = s.lockout.Succeed(accountKey); err != nil {
+		return Token{}, err
+	}
+	if rehash {
+		s.rehash(u, input.Password, clientActor(u.ID, client))
+	}
+	if u.DeactivatedAt != nil {
+		return Token{}, ErrUserDeactivated
+	}
+
+	tf, err := s.twoFactorRepository.Select(u.ID)
+	if err != nil {
+		return Token{}, err
+	}
+	if tf.EnabledAt != nil {
+		mfaToken, err := s.issuer.IssueMFA(u.ID)
+		if err != nil {
+			return Token{}, err
+		}
+		log.Infoln("user passed password check, second factor required", u.ID)
+		return Token{MFARequired: true, MFAToken: mfaToken}, nil
+	}
+	return s.startSession(u, client)
+}
+
+// LoginTwoFactor completes login of user with two-factor authentication
+func (s *service) LoginTwoFactor(input TwoFactorLoginInput, client ClientInfo) (Token, error) {
+	userID, err := s.issuer.ParseMFA(input.MFAToken)
+	if err != nil {
+		return Token{}, ErrInvalidCredentials
+	}
+	accountKey, ipKey := AccountKey(userID), IPKey(client.IP)
+	if err = s.lockout.Check(accountKey, ipKey); err != nil {
+		return Token{}, err
+	}
+	tf, err := s.twoFactorRepository.Select(userID)
+	if err != nil {
+		return Token{}, err
+	}
+	if tf.EnabledAt == nil {
+		return Token{}, ErrInvalidCredentials
+	}
+	if err = s.verifySecondFactor(tf, input.Code, clientActor(userID, client)); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			s.fail(accountKey, ipKey)
+		}
+		return Token{}, err
+	}
+	if err = s.lockout.Succeed(accountKey); err != nil {
+		return Token{}, err
+	}
+	u, err := s.userRepository.SelectById(userID)
+	if err != nil {
+		return Token{}, err
+	}
+	if u.DeactivatedAt != nil {
+		return Token{}, ErrUserDeactivated
+	}
+	return s.startSession(u, client)
+}
+
+func (s *service) startSession(u user.User, client ClientInfo) (Token, error) {
+	refreshToken, refreshHash, err := newOpaqueToken()
+	if err != nil {
+		return Token{}, err
+	}
+	sessionID, err := s.sessionRepository.Insert(Session{
+		UserID:    u.ID,
+		UserAgent: client.UserAgent,
+		IP:        client.IP,
+		ExpiresAt: time.Now().Add(s.refreshTTL),
+	}, refreshHash)
+	if err != nil {
+		return Token{}, err
+	}
+
+	token, err := s.issue(Principal{UserID: u.ID, Nickname: u.Nickname, Role: u.Role, SessionID: sessionID}, refreshToken)
+	if err != nil {
+		return Token{}, err
+	}
+	log.Infoln("user logged in", u.ID, "session", sessionID)
+	return token, nil
+}
+
+// Refresh exchanges refresh token for new token pair, used refresh token becomes invalid.
+// Presenting already rotated token revokes whole session, as it means token was leaked
+func (s *service) Refresh(refreshToken string) (Token, error) {
+	tokenHash := hashToken(refreshToken)
+	session, rotatedAt, err := s.sessionRepository.SelectByTokenHash(tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	if session.RevokedAt != nil || session.ExpiresAt.Before(time.Now()) {
+		return Token{}, ErrInvalidRefreshToken
+	}
+	if rotatedAt != nil {
+		return Token{}, s.revokeReused(session)
+	}
+
+	u, err := s.userRepository.SelectById(session.UserID)
+	if err != nil || u.DeactivatedAt != nil {
+		return Token{}, ErrInvalidRefreshToken
+	}
+
+	newToken, newHash, err := newOpaqueToken()
+	if err != nil {
+		return Token{}, err
+	}
+	err = s.sessionRepository.Rotate(session.ID, tokenHash, newHash, time.Now().Add(s.refreshTTL))
+	if errors.Is(err, ErrRefreshTokenReused) {
+		return Token{}, s.revokeReused(session)
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	return s.issue(Principal{UserID: u.ID, Nickname: u.Nickname, Role: u.Role, SessionID: session.ID}, newToken)
+}
+
+func (s *service) revokeReused(session Session) error {
+	log.Warnln("refresh token reuse detected, revoking session", session.ID, "of user", session.UserID)
+	if err := s.sessionRepository.Revoke(session.UserID, session.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	s.sessions.forget(session.ID)
+	return ErrRefreshTokenReused
+}
+
+func (s *service) issue(principal Principal, refreshToken string) (Token, error) {
+	accessToken, expiresAt, err := s.issuer.Issue(principal)
+	if err != nil {
+		return Token{}, err
+	}
+	return Token{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(expiresAt).Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s *service) GetSessions(userID uuid.UUID) ([]Session, error) {
+	return s.sessionRepository.SelectActive(userID)
+}
+
+func (s *service) RevokeSession(userID uuid.UUID, sessionID uuid.UUID) error {
+	err := s.sessionRepository.Revoke(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	s.sessions.forget(sessionID)
+	log.Infoln("revoked session", sessionID, "of user", userID)
+	return nil
+}
+
+// CheckSession returns current role of user of access token session, ErrSessionRevoked is returned when session
+// is revoked or expired or its user is deleted or deactivated. Session and role are checked again after SESSION_CHECK_INTERVAL
+func (s *service) CheckSession(sessionID uuid.UUID) (string, error) {
+	if role, ok := s.sessions.active(sessionID); ok {
+		return role, nil
+	}
+	session, err := s.sessionRepository.SelectByID(sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrSessionRevoked
+	}
+	if err != nil {
+		return "", err
+	}
+	if session.RevokedAt != nil || !session.ExpiresAt.After(time.Now()) {
+		return "", ErrSessionRevoked
+	}
+	u, err := s.userRepository.SelectById(session.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrSessionRevoked
+	}
+	if err != nil {
+		return "", err
+	}
+	if u.DeactivatedAt != nil {
+		return "", ErrSessionRevoked
+	}
+	s.sessions.store(sessionID, u.Role)
+	return u.Role, nil
+}
+
+func (s *service) RevokeSessions(userID uuid.UUID) (int64, error) {
+	n, err := s.sessionRepository.RevokeAll(userID)
+	if err != nil {
+		return n, err
+	}
+	s.sessions.clear()
+	log.Infoln("revoked", n, "sessions of user", userID)
+	return n, nil
+}
+
+// RequestPasswordReset issues single-use reset token and asks mailer service to deliver it, message carries
+// the token and is always encrypted. Unknown login is silently ignored so existence of accounts is not revealed
+func (s *service) RequestPasswordReset(login string) error {
+	u, err := s.userRepository.SelectByLogin(login)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Infoln("password reset requested for unknown login")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(s.resetTTL)
+	if err = s.resetRepository.Insert(u.ID, tokenHash, expiresAt); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"user_id":    u.ID,
+		"email":      u.Email,
+		"nickname":   u.Nickname,
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	if err = s.amqp.PublishPrivateMessage("user_password_reset_requested", string(body)); err != nil {
+		return err
+	}
+	log.Infoln("password reset requested for user", u.ID)
+	return nil
+}
+
+// ResetPassword checks new password against policy, then in one transaction consumes reset token,
+// stores new password with audit entry and revokes all sessions of user
+func (s *service) ResetPassword(token string, newPassword string, actor user.Actor) error {
+	tokenHash := hashToken(token)
+	userID, err := s.resetRepository.SelectUserID(tokenHash)
+	if err != nil {
+		return err
+	}
+	u, err := s.userRepository.SelectById(userID)
+	if err != nil {
+		return err
+	}
+	if violations := s.passwordPolicy.Check(newPassword, u.Nickname, u.Email); len(violations) > 0 {
+		return &password.PolicyError{Violations: violations}
+	}
+	hash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	// password is reset by token holder, i.e. by user themselves
+	actor.Type = user.ActorUser
+	actor.ID = &userID
+	// token is consumed, password changed and sessions revoked together, so failure leaves token usable
+	err = s.userRepository.Transaction(func(tx user.Repository) error {
+		if _, err := s.resetRepository.WithTx(tx).Consume(tokenHash); err != nil {
+			return err
+		}
+		if err := tx.UpdatePassword(userID, hash); err != nil {
+			return err
+		}
+		updated, err := tx.SelectById(userID)
+		if err != nil {
+			return err
+		}
+		if err := user.Audit(tx, user.AuditPasswordReset, actor, u, updated); err != nil {
+			return err
+		}
+		_, err = s.sessionRepository.RevokeUser(tx, userID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.sessions.clear()
+	log.Infoln("password reset for user", userID)
+	return nil
+}
+
+// ChangePassword replaces password of user who knows the current one, new password is checked against policy.
+// Password is stored with audit entry and user.password_changed event and all sessions of user except sessionID
+// are revoked in one transaction. Event is written to outbox in CDC mode too as it can't be told from row change
+func (s *service) ChangePassword(userID uuid.UUID, sessionID uuid.UUID, input PasswordChangeInput, actor user.Actor) error {
+	u, err := s.userRepository.SelectById(userID)
+	if err != nil {
+		return err
+	}
+	accountKey := AccountKey(userID)
+	if err = s.lockout.Check(accountKey); err != nil {
+		return err
+	}
+	if ok, _ := s.verifyPassword(u, input.CurrentPassword); !ok {
+		s.fail(accountKey)
+		return ErrInvalidCredentials
+	}
+	if err = s.lockout.Succeed(accountKey); err != nil {
+		return err
+	}
+	if violations := s.passwordPolicy.Check(input.Password, u.Nickname, u.Email); len(violations) > 0 {
+		return &password.PolicyError{Violations: violations}
+	}
+	hash, err := s.hasher.Hash(input.Password)
+	if err != nil {
+		return err
+	}
+	var n int64
+	err = s.userRepository.Transaction(func(tx user.Repository) error {
+		if err := tx.UpdatePassword(userID, hash); err != nil {
+			return err
+		}
+		updated, err := tx.SelectById(userID)
+		if err != nil {
+			return err
+		}
+		if err := user.Audit(tx, user.AuditPasswordChange, actor, u, updated); err != nil {
+			return err
+		}
+		body, err := user.NewEvent(user.EventPasswordChanged, updated, nil)
+		if err != nil {
+			return err
+		}
+		if err := tx.Enqueue(user.EventPasswordChanged, body); err != nil {
+			return err
+		}
+		n, err = s.sessionRepository.RevokeOthers(tx, userID, sessionID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.sessions.clear()
+	log.Infoln("password changed for user", userID, "revoked", n, "other sessions")
+	return nil
+}
+
+// verifySecondFactor accepts either current TOTP code or one of unused recovery codes.
+// Used recovery code is audited, accepted TOTP step is not as it only guards against replay
+func (s *service) verifySecondFactor(tf TwoFactor, code string, actor user.Actor) error {
+	secret, err := decryptSecret(s.secretCipher, tf.EncryptedSecret, tf.UserID[:])
+	if err != nil {
+		return err
+	}
+	if step, ok := validateTOTP(secret, code, time.Now()); ok {
+		return s.twoFactorRepository.UseStep(tf.UserID, step)
+	}
+	err = s.userRepository.Transaction(func(tx user.Repository) error {
+		if err := s.twoFactorRepository.WithTx(tx).UseRecoveryCode(tf.UserID, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return err
+		}
+		return auditTwoFactor(tx, user.AuditRecoveryCode, tf.UserID, actor)
+	})
+	if err == nil {
+		log.Warnln("recovery code used by user", tf.UserID)
+	}
+	return err
+}
+
+// auditTwoFactor writes audit entry of two-factor change, its state is not part of user, so entry has empty diff
+func auditTwoFactor(tx user.Repository, action string, userID uuid.UUID, actor user.Actor) error {
+	u, err := tx.SelectById(userID)
+	if err != nil {
+		return err
+	}
+	return user.Audit(tx, action, actor, u, u)
+}
+
+// clientActor is actor of login step, where user is identified by credentials rather than access token
+func clientActor(userID uuid.UUID, client ClientInfo) user.Actor {
+	return user.Actor{Type: user.ActorUser, ID: &userID, IP: client.IP}
+}
+
+// EnrollTOTP generates new TOTP secret and returns otpauth uri for authenticator app,
+// secret is not enforced on login until ConfirmTOTP
+func (s *service) EnrollTOTP(userID uuid.UUID) (string, error) {
+	u, err := s.userRepository.SelectById(userID)
+	if err != nil {
+		return "", err
+	}
+	tf, err := s.twoFactorRepository.Select(userID)
+	if err != nil {
+		return "", err
+	}
+	if tf.EnabledAt != nil {
+		return "", ErrTwoFactorEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := encryptSecret(s.secretCipher, secret, userID[:])
+	if err != nil {
+		return "", err
+	}
+	if err = s.twoFactorRepository.SavePending(userID, encrypted); err != nil {
+		return "", err
+	}
+	log.Infoln("two-factor enrollment started for user", userID)
+	return otpauthURI(s.totpIssuer, u.Nickname, secret), nil
+}
+
+// ConfirmTOTP enables two-factor authentication after first valid code and returns recovery codes, they are shown only once
+func (s *service) ConfirmTOTP(userID uuid.UUID, code string, actor user.Actor) ([]string, error) {
+	tf, err := s.twoFactorRepository.Select(userID)
+	if err != nil {
+		return nil, err
+	}
+	if tf.EnabledAt != nil {
+		return nil, ErrTwoFactorEnabled
+	}
+	if tf.EncryptedSecret == "" {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	secret, err := decryptSecret(s.secretCipher, tf.EncryptedSecret, userID[:])
+	if err != nil {
+		return nil, err
+	}
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, err := generateRecoveryCodes(10)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = hashToken(c)
+	}
+	err = s.userRepository.Transaction(func(tx user.Repository) error {
+		if err := s.twoFactorRepository.WithTx(tx).Enable(userID, hashes, step); err != nil {
+			return err
+		}
+		return auditTwoFactor(tx, user.AuditTOTPEnable, userID, actor)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infoln("two-factor authentication enabled for user", userID)
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication, user must provide password and current code
+func (s *service) DisableTOTP(userID uuid.UUID, input TwoFactorDisableInput, actor user.Actor) error {
+	u, err := s.userRepository.SelectById(userID)
+	if err != nil {
+		return err
+	}
+	accountKey := AccountKey(userID)
+	if err = s.lockout.Check(accountKey); err != nil {
+		return err
+	}
+	if ok, _ := s.verifyPassword(u, input.Password); !ok {
+		s.fail(accountKey)
+		return ErrInvalidCredentials
+	}
+	tf, err := s.twoFactorRepository.Select(userID)
+	if err != nil {
+		return err
+	}
+	if tf.EnabledAt == nil {
+		return ErrTwoFactorNotEnabled
+	}
+	if err = s.verifySecondFactor(tf, input.Code, actor); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			s.fail(accountKey)
+		}
+		return err
+	}
+	if err = s.lockout.Succeed(accountKey); err != nil {
+		return err
+	}
+	err = s.userRepository.Transaction(func(tx user.Repository) error {
+		if err := s.twoFactorRepository.WithTx(tx).Disable(userID); err != nil {
+			return err
+		}
+		return auditTwoFactor(tx, user.AuditTOTPDisable, userID, actor)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infoln("two-factor authentication disabled for user", userID)
+	return nil
+}
+
+// fail records failed attempt, errors are only logged as caller already responds with check failure
+func (s *service) fail(keys ...string) {
+	if err := s.lockout.Fail(keys...); err != nil {
+		log.Errorln("failed to record failed attempt", err)
+	}
+}
+
+func (s *service) Unlock(key string) (bool, error) {
+	return s.lockout.Unlock(key)
+}
+
+// verifyPassword checks password of user, second value reports whether stored hash should be upgraded.
+// Stored hash which can't be parsed is logged and treated as mismatch, so caller responds and counts failure as usual
+func (s *service) verifyPassword(u user.User, plainPassword string) (bool, bool) {
+	ok, rehash, err := s.hasher.Verify(plainPassword, u.Password)
+	if err != nil {
+		log.Errorln("failed to verify password of user", u.ID, err)
+		return false, false
+	}
+	return ok, rehash
+}
+
+// rehash upgrades stored password hash to current algorithm and parameters with audit entry,
+// failure does not break login
+func (s *service) rehash(u user.User, plainPassword string, actor user.Actor) {
+	hash, err := s.hasher.Hash(plainPassword)
+	if err == nil {
+		err = s.userRepository.Transaction(func(tx user.Repository) error {
+			if err := tx.UpdatePassword(u.ID, hash); err != nil {
+				return err
+			}
+			updated, err := tx.SelectById(u.ID)
+			if err != nil {
+				return err
+			}
+			return user.Audit(tx, user.AuditPasswordRehash, actor, u, updated)
+		})
+	}
+	if err != nil {
+		log.Errorln("failed to upgrade password hash of user", u.ID, err)
+		return
+	}
+	log.Infoln("upgraded password hash of user", u.ID)
+}
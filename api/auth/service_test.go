@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/password"
+	"golang-demo/api/user"
+	"golang-demo/config"
+	"testing"
+	"time"
+)
+
+type userRepositoryMock struct {
+	user.Repository
+	users  map[uuid.UUID]*user.User
+	audit  []user.AuditEntry
+	events []string
+	inTx   bool
+}
+
+func (m *userRepositoryMock) Transaction(fn func(tx user.Repository) error) error {
+	m.inTx = true
+	defer func() { m.inTx = false }()
+	return fn(m)
+}
+
+func (m *userRepositoryMock) Enqueue(topic string, _ string) error {
+	m.events = append(m.events, topic)
+	return nil
+}
+
+func (m *userRepositoryMock) InsertAudit(entry user.AuditEntry) error {
+	m.audit = append(m.audit, entry)
+	return nil
+}
+
+func (m *userRepositoryMock) SelectById(id uuid.UUID) (user.User, error) {
+	if u, ok := m.users[id]; ok {
+		return *u, nil
+	}
+	return user.User{}, sql.ErrNoRows
+}
+
+func (m *userRepositoryMock) SelectByLogin(login string) (user.User, error) {
+	for _, u := range m.users {
+		if u.Nickname == login || u.Email == login {
+			return *u, nil
+		}
+	}
+	return user.User{}, sql.ErrNoRows
+}
+
+func (m *userRepositoryMock) UpdatePassword(id uuid.UUID, passwordHash string) error {
+	m.users[id].Password = passwordHash
+	return nil
+}
+
+type sessionRepositoryMock struct {
+	SessionRepository
+	sessions map[uuid.UUID]Session
+	selected int
+}
+
+func (m *sessionRepositoryMock) SelectByID(sessionID uuid.UUID) (Session, error) {
+	m.selected++
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return session, sql.ErrNoRows
+	}
+	return session, nil
+}
+
+func (m *sessionRepositoryMock) Revoke(_ uuid.UUID, sessionID uuid.UUID) error {
+	now := time.Now()
+	session := m.sessions[sessionID]
+	session.RevokedAt = &now
+	m.sessions[sessionID] = session
+	return nil
+}
+
+func (m *sessionRepositoryMock) Insert(Session, string) (uuid.UUID, error) {
+	return uuid.New(), nil
+}
+
+func (m *sessionRepositoryMock) RevokeOthers(tx user.Repository, userID uuid.UUID, keepSessionID uuid.UUID) (int64, error) {
+	if !tx.(*userRepositoryMock).inTx {
+		return 0, errors.New("sessions revoked outside of transaction")
+	}
+	var n int64
+	now := time.Now()
+	for id, session := range m.sessions {
+		if session.UserID == userID && session.RevokedAt == nil && id != keepSessionID {
+			session.RevokedAt = &now
+			m.sessions[id] = session
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *sessionRepositoryMock) RevokeUser(_ user.Repository, userID uuid.UUID) (int64, error) {
+	var n int64
+	now := time.Now()
+	for id, session := range m.sessions {
+		if session.UserID == userID && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			m.sessions[id] = session
+			n++
+		}
+	}
+	return n, nil
+}
+
+type resetRepositoryMock struct {
+	PasswordResetRepository
+	tokens map[string]uuid.UUID
+	inTx   bool
+}
+
+func (m *resetRepositoryMock) Insert(userID uuid.UUID, tokenHash string, _ time.Time) error {
+	m.tokens[tokenHash] = userID
+	return nil
+}
+
+func (m *resetRepositoryMock) SelectUserID(tokenHash string) (uuid.UUID, error) {
+	if userID, ok := m.tokens[tokenHash]; ok {
+		return userID, nil
+	}
+	return uuid.Nil, ErrResetTokenInvalid
+}
+
+func (m *resetRepositoryMock) Consume(tokenHash string) (uuid.UUID, error) {
+	userID, err := m.SelectUserID(tokenHash)
+	delete(m.tokens, tokenHash)
+	return userID, err
+}
+
+func (m *resetRepositoryMock) WithTx(user.Repository) PasswordResetRepository {
+	m.inTx = true
+	return m
+}
+
+type twoFactorRepositoryMock struct {
+	TwoFactorRepository
+}
+
+func (m *twoFactorRepositoryMock) Select(userID uuid.UUID) (TwoFactor, error) {
+	return TwoFactor{UserID: userID}, nil
+}
+
+func newTestService(t *testing.T, users ...user.User) (*service, *userRepositoryMock, *lockoutRepositoryMock) {
+	cfg := config.Config{
+		JwtSecret:            "secret",
+		JwtIssuer:            "test",
+		JwtAccessTTL:         time.Minute,
+		PasswordArgon2Memory: 1024,
+		TotpEncryptionKey:    "8RtR3AFqGPCg18b76y6IFrGA7HuzCDcArOINu+PWN3Q=",
+		LockoutBaseDelay:     time.Minute,
+	}
+	userRepository := &userRepositoryMock{users: map[uuid.UUID]*user.User{}}
+	for i := range users {
+		userRepository.users[users[i].ID] = &users[i]
+	}
+	lockoutRepository := &lockoutRepositoryMock{lockouts: map[string]*Lockout{}}
+	hasher, err := password.NewHasher(cfg)
+	assert.Nil(t, err)
+	policy, err := password.NewPolicy(cfg)
+	assert.Nil(t, err)
+	issuer, err := NewJWTIssuer(cfg)
+	assert.Nil(t, err)
+	s, err := NewService(userRepository, &sessionRepositoryMock{}, nil, &twoFactorRepositoryMock{},
+		NewLockoutGuard(lockoutRepository, &mqMock{}, cfg), policy, hasher, issuer, &mqMock{}, cfg)
+	assert.Nil(t, err)
+	return s, userRepository, lockoutRepository
+}
+
+func TestLoginUpgradesPlaintextPassword(t *testing.T) {
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Password: "supersecurepassword", Role: user.RoleMember}
+	s, users, _ := newTestService(t, u)
+
+	token, err := s.Login(LoginInput{Login: "nickname", Password: "supersecurepassword"}, ClientInfo{IP: "127.0.0.1"})
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token.AccessToken)
+	assert.Contains(t, users.users[u.ID].Password, "$argon2id$")
+	assert.Len(t, users.audit, 1)
+	assert.Equal(t, user.AuditPasswordRehash, users.audit[0].Action)
+	assert.Equal(t, &u.ID, users.audit[0].ActorID)
+	assert.NotContains(t, string(users.audit[0].Diff), "supersecurepassword")
+}
+
+func TestLoginWithWrongPasswordAgainstPlaintextRow(t *testing.T) {
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Password: "supersecurepassword"}
+	s, _, lockouts := newTestService(t, u)
+
+	_, err := s.Login(LoginInput{Login: "nickname", Password: "wrongpassword"}, ClientInfo{IP: "127.0.0.1"})
+
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	assert.Equal(t, 1, lockouts.lockouts[AccountKey(u.ID)].Failures)
+}
+
+func TestLoginAgainstMalformedHash(t *testing.T) {
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Password: "$argon2id$broken"}
+	s, _, lockouts := newTestService(t, u)
+
+	_, err := s.Login(LoginInput{Login: "nickname", Password: "supersecurepassword"}, ClientInfo{IP: "127.0.0.1"})
+
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	assert.Equal(t, 1, lockouts.lockouts[AccountKey(u.ID)].Failures)
+}
+
+func TestLoginLocksUnknownLoginLikeAccount(t *testing.T) {
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Password: "supersecurepassword"}
+	s, _, _ := newTestService(t, u)
+
+	for _, login := range []string{"nickname", "unknown"} {
+		for i := 0; i < 3; i++ {
+			_, err := s.Login(LoginInput{Login: login, Password: "wrongpassword"}, ClientInfo{IP: fmt.Sprintf("10.0.0.%d", i)})
+			assert.ErrorIs(t, err, ErrInvalidCredentials)
+		}
+		_, err := s.Login(LoginInput{Login: login, Password: "wrongpassword"}, ClientInfo{IP: "10.0.1.1"})
+		var locked *LockedError
+		assert.ErrorAs(t, err, &locked, login)
+	}
+}
+
+func TestDeactivatedUserCantLogInOrUseSession(t *testing.T) {
+	deactivatedAt := time.Now()
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Password: "supersecurepassword", DeactivatedAt: &deactivatedAt}
+	s, _, _ := newTestService(t, u)
+	session := Session{ID: uuid.New(), UserID: u.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	s.sessionRepository = &sessionRepositoryMock{sessions: map[uuid.UUID]Session{session.ID: session}}
+
+	_, err := s.Login(LoginInput{Login: "nickname", Password: "supersecurepassword"}, ClientInfo{IP: "127.0.0.1"})
+	assert.ErrorIs(t, err, ErrUserDeactivated)
+	_, err = s.CheckSession(session.ID)
+	assert.ErrorIs(t, err, ErrSessionRevoked)
+}
+
+func TestCheckSession(t *testing.T) {
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Role: user.RoleAdmin}
+	s, users, _ := newTestService(t, u)
+	sessions := &sessionRepositoryMock{sessions: map[uuid.UUID]Session{}}
+	s.sessionRepository = sessions
+	active := Session{ID: uuid.New(), UserID: u.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	expired := Session{ID: uuid.New(), UserID: u.ID, ExpiresAt: time.Now().Add(-time.Second)}
+	sessions.sessions[active.ID] = active
+	sessions.sessions[expired.ID] = expired
+
+	role, err := s.CheckSession(active.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.RoleAdmin, role)
+	users.users[u.ID].Role = user.RoleMember
+	role, err = s.CheckSession(active.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.RoleAdmin, role, "role is cached within check interval")
+	assert.Equal(t, 1, sessions.selected)
+	_, err = s.CheckSession(expired.ID)
+	assert.ErrorIs(t, err, ErrSessionRevoked)
+	_, err = s.CheckSession(uuid.New())
+	assert.ErrorIs(t, err, ErrSessionRevoked)
+
+	assert.Nil(t, s.RevokeSession(u.ID, active.ID))
+	_, err = s.CheckSession(active.ID)
+	assert.ErrorIs(t, err, ErrSessionRevoked)
+}
+
+func TestCheckSessionReturnsCurrentRole(t *testing.T) {
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Role: user.RoleAdmin}
+	s, users, _ := newTestService(t, u)
+	session := Session{ID: uuid.New(), UserID: u.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	s.sessionRepository = &sessionRepositoryMock{sessions: map[uuid.UUID]Session{session.ID: session}}
+	s.sessions = newSessionCache(time.Nanosecond)
+
+	users.users[u.ID].Role = user.RoleMember
+	role, err := s.CheckSession(session.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.RoleMember, role)
+
+	delete(users.users, u.ID)
+	_, err = s.CheckSession(session.ID)
+	assert.ErrorIs(t, err, ErrSessionRevoked)
+}
+
+func TestRequestPasswordResetSendsPrivateMessage(t *testing.T) {
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Email: "john@example.com"}
+	s, _, _ := newTestService(t, u)
+	resets := &resetRepositoryMock{tokens: map[string]uuid.UUID{}}
+	mq := &mqMock{}
+	s.resetRepository, s.amqp = resets, mq
+
+	assert.Nil(t, s.RequestPasswordReset("john@example.com"))
+	assert.Len(t, resets.tokens, 1)
+	assert.Equal(t, []string{"user_password_reset_requested"}, mq.private)
+	assert.Empty(t, mq.queues)
+}
+
+func TestResetPassword(t *testing.T) {
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Email: "john@example.com", Password: "old"}
+	s, users, _ := newTestService(t, u)
+	session := Session{ID: uuid.New(), UserID: u.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	sessions := &sessionRepositoryMock{sessions: map[uuid.UUID]Session{session.ID: session}}
+	resets := &resetRepositoryMock{tokens: map[string]uuid.UUID{hashToken("token"): u.ID}}
+	s.sessionRepository, s.resetRepository = sessions, resets
+
+	err := s.ResetPassword("token", "Correct-Horse-7", user.Actor{Type: user.ActorAnonymous})
+
+	assert.Nil(t, err)
+	assert.True(t, resets.inTx, "token is consumed in transaction of password change")
+	assert.Empty(t, resets.tokens)
+	assert.Contains(t, users.users[u.ID].Password, "$argon2id$")
+	assert.Len(t, users.audit, 1)
+	assert.Equal(t, user.AuditPasswordReset, users.audit[0].Action)
+	assert.NotNil(t, sessions.sessions[session.ID].RevokedAt)
+	assert.ErrorIs(t, s.ResetPassword("token", "Correct-Horse-7", user.Actor{}), ErrResetTokenInvalid)
+}
+
+func TestChangePasswordRevokesOtherSessionsInTransaction(t *testing.T) {
+	u := user.User{ID: uuid.New(), Nickname: "nickname", Email: "john@example.com", Password: "supersecurepassword"}
+	s, users, _ := newTestService(t, u)
+	current := Session{ID: uuid.New(), UserID: u.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	other := Session{ID: uuid.New(), UserID: u.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	sessions := &sessionRepositoryMock{sessions: map[uuid.UUID]Session{current.ID: current, other.ID: other}}
+	s.sessionRepository = sessions
+
+	input := PasswordChangeInput{CurrentPassword: "supersecurepassword", Password: "Correct-Horse-7"}
+	err := s.ChangePassword(u.ID, current.ID, input, user.Actor{Type: user.ActorUser, ID: &u.ID})
+
+	assert.Nil(t, err)
+	assert.Contains(t, users.users[u.ID].Password, "$argon2id$")
+	assert.Equal(t, []string{user.EventPasswordChanged}, users.events)
+	assert.Nil(t, sessions.sessions[current.ID].RevokedAt)
+	assert.NotNil(t, sessions.sessions[other.ID].RevokedAt)
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// sessionCache remembers sessions found active with current role of their users, so access token is checked
+// against db at most once per ttl and token of revoked session or changed role is honored not later than ttl after change
+type sessionCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	checked   map[uuid.UUID]checkedSession
+	lastSweep time.Time
+}
+
+type checkedSession struct {
+	role  string
+	until time.Time
+}
+
+func newSessionCache(ttl time.Duration) *sessionCache {
+	return &sessionCache{ttl: ttl, checked: map[uuid.UUID]checkedSession{}}
+}
+
+// active returns current role of user if session was found active within ttl
+func (c *sessionCache) active(sessionID uuid.UUID) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	checked, ok := c.checked[sessionID]
+	if !ok || !time.Now().Before(checked.until) {
+		return "", false
+	}
+	return checked.role, true
+}
+
+// store remembers active session for ttl, expired entries are dropped once per ttl
+func (c *sessionCache) store(sessionID uuid.UUID, role string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > c.ttl {
+		for id, checked := range c.checked {
+			if !now.Before(checked.until) {
+				delete(c.checked, id)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.checked[sessionID] = checkedSession{role: role, until: now.Add(c.ttl)}
+}
+
+// forget drops session revoked by this instance, so its tokens are rejected at once
+func (c *sessionCache) forget(sessionID uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.checked, sessionID)
+}
+
+// clear drops all sessions after bulk revocation, they are checked against db again
+func (c *sessionCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = map[uuid.UUID]checkedSession{}
+}
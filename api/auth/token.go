@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang-demo/config"
+	"os"
+	"time"
+)
+
+type TokenIssuer interface {
+	Issue(principal Principal) (string, time.Time, error)
+	Parse(token string) (Principal, error)
+	IssueMFA(userID uuid.UUID) (string, error)
+	ParseMFA(token string) (uuid.UUID, error)
+}
+
+const (
+	tokenTypeAccess = "access"
+	tokenTypeMFA    = "mfa"
+	mfaTokenTTL     = 5 * time.Minute
+)
+
+type claims struct {
+	Type      string `json:"typ"`
+	Nickname  string `json:"nickname"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+type jwtIssuer struct {
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	issuer    string
+	ttl       time.Duration
+}
+
+// NewJWTIssuer creates access token issuer, signing keys are loaded according to JWT_ALGORITHM:
+// HS256 uses JWT_SECRET, RS256 uses PEM files from JWT_PRIVATE_KEY_PATH and JWT_PUBLIC_KEY_PATH
+func NewJWTIssuer(cfg config.Config) (*jwtIssuer, error) {
+	issuer := &jwtIssuer{issuer: cfg.JwtIssuer, ttl: cfg.JwtAccessTTL}
+	if issuer.ttl <= 0 {
+		issuer.ttl = 15 * time.Minute
+	}
+
+	switch cfg.JwtAlgorithm {
+	case "", "HS256":
+		if cfg.JwtSecret == "" {
+			return nil, errors.New("JWT_SECRET is required for HS256")
+		}
+		issuer.method = jwt.SigningMethodHS256
+		issuer.signKey = []byte(cfg.JwtSecret)
+		issuer.verifyKey = []byte(cfg.JwtSecret)
+	case "RS256":
+		privatePem, err := os.ReadFile(cfg.JwtPrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read jwt private key: %w", err)
+		}
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse jwt private key: %w", err)
+		}
+		publicPem, err := os.ReadFile(cfg.JwtPublicKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read jwt public key: %w", err)
+		}
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicPem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse jwt public key: %w", err)
+		}
+		issuer.method = jwt.SigningMethodRS256
+		issuer.signKey = privateKey
+		issuer.verifyKey = publicKey
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALGORITHM %q", cfg.JwtAlgorithm)
+	}
+	return issuer, nil
+}
+
+// Issue signs access token for principal, returns token and its expiration time
+func (i *jwtIssuer) Issue(principal Principal) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(i.ttl)
+	token := jwt.NewWithClaims(i.method, claims{
+		Type:      tokenTypeAccess,
+		Nickname:  principal.Nickname,
+		Role:      principal.Role,
+		SessionID: principal.SessionID.String(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    i.issuer,
+			Subject:   principal.UserID.String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	signed, err := token.SignedString(i.signKey)
+	return signed, expiresAt, err
+}
+
+// Parse verifies access token signature, algorithm, issuer and expiration and returns principal from claims
+func (i *jwtIssuer) Parse(token string) (Principal, error) {
+	c, err := i.parse(token, tokenTypeAccess)
+	if err != nil {
+		return Principal{}, err
+	}
+	userID, err := uuid.Parse(c.Subject)
+	if err != nil {
+		return Principal{}, err
+	}
+	sessionID, err := uuid.Parse(c.SessionID)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{UserID: userID, Nickname: c.Nickname, Role: c.Role, SessionID: sessionID}, nil
+}
+
+// IssueMFA signs short-lived token proving that user passed password check, it is accepted only by second login step
+func (i *jwtIssuer) IssueMFA(userID uuid.UUID) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(i.method, claims{
+		Type: tokenTypeMFA,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    i.issuer,
+			Subject:   userID.String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+		},
+	})
+	return token.SignedString(i.signKey)
+}
+
+func (i *jwtIssuer) ParseMFA(token string) (uuid.UUID, error) {
+	c, err := i.parse(token, tokenTypeMFA)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.Parse(c.Subject)
+}
+
+func (i *jwtIssuer) parse(token string, tokenType string) (claims, error) {
+	var c claims
+	_, err := jwt.ParseWithClaims(token, &c, func(t *jwt.Token) (interface{}, error) {
+		return i.verifyKey, nil
+	}, jwt.WithValidMethods([]string{i.method.Alg()}), jwt.WithIssuer(i.issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return c, err
+	}
+	if c.Type != tokenType {
+		return c, fmt.Errorf("unexpected token type %q", c.Type)
+	}
+	return c, nil
+}
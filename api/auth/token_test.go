@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/user"
+	"golang-demo/config"
+	"testing"
+	"time"
+)
+
+func TestIssueAndParseToken(t *testing.T) {
+	issuer, err := NewJWTIssuer(config.Config{JwtAlgorithm: "HS256", JwtSecret: "secret", JwtIssuer: "test", JwtAccessTTL: time.Minute})
+	assert.Nil(t, err)
+
+	principal := Principal{UserID: uuid.New(), Nickname: "nickname", Role: user.RoleMember, SessionID: uuid.New()}
+	token, expiresAt, err := issuer.Issue(principal)
+	assert.Nil(t, err)
+	assert.True(t, expiresAt.After(time.Now()))
+
+	parsed, err := issuer.Parse(token)
+	assert.Nil(t, err)
+	assert.Equal(t, principal, parsed)
+}
+
+func TestParseTokenWithWrongSecret(t *testing.T) {
+	issuer, _ := NewJWTIssuer(config.Config{JwtSecret: "secret", JwtIssuer: "test"})
+	other, _ := NewJWTIssuer(config.Config{JwtSecret: "other", JwtIssuer: "test"})
+
+	token, _, err := other.Issue(Principal{UserID: uuid.New()})
+	assert.Nil(t, err)
+
+	_, err = issuer.Parse(token)
+	assert.NotNil(t, err)
+}
+
+func TestMFATokenIsNotAccessToken(t *testing.T) {
+	issuer, _ := NewJWTIssuer(config.Config{JwtSecret: "secret", JwtIssuer: "test"})
+
+	userID := uuid.New()
+	mfaToken, err := issuer.IssueMFA(userID)
+	assert.Nil(t, err)
+
+	_, err = issuer.Parse(mfaToken)
+	assert.NotNil(t, err)
+
+	parsed, err := issuer.ParseMFA(mfaToken)
+	assert.Nil(t, err)
+	assert.Equal(t, userID, parsed)
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	assert.Equal(t, "287082", totpCode(secret, 59/totpPeriod))
+	assert.Equal(t, "081804", totpCode(secret, 1111111109/totpPeriod))
+	assert.Equal(t, "050471", totpCode(secret, 1111111111/totpPeriod))
+}
+
+func TestValidateTOTPAcceptsNeighbourStep(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+
+	step, ok := validateTOTP(secret, totpCode(secret, now.Unix()/totpPeriod-1), now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Unix()/totpPeriod-1, step)
+
+	_, ok = validateTOTP(secret, totpCode(secret, now.Unix()/totpPeriod-3), now)
+	assert.False(t, ok)
+}
+
+func TestEncryptSecret(t *testing.T) {
+	aead, err := newSecretCipher(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	assert.Nil(t, err)
+
+	encrypted, err := encryptSecret(aead, []byte("secret"), []byte("user"))
+	assert.Nil(t, err)
+
+	decrypted, err := decryptSecret(aead, encrypted, []byte("user"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret"), decrypted)
+
+	_, err = decryptSecret(aead, encrypted, []byte("other user"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/config"
+	"sync"
+	"time"
+)
+
+var ErrDisconnected = errors.New("rabbitmq connection is not available")
+
+// Connection keeps single long-lived RabbitMQ connection, it is re-dialled with exponential backoff
+// when broker closes it. onConnect functions are called after every successful dial, e.g. to declare topology
+type Connection struct {
+	dsn        string
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	onConnect  []func(conn *amqp.Connection) error
+
+	mu     sync.RWMutex
+	conn   *amqp.Connection
+	closed chan *amqp.Error
+	// ready is closed while connection is open
+	ready chan struct{}
+}
+
+// Dial opens connection, initial dial is not retried so misconfiguration is reported at startup
+func Dial(dsn string, cfg config.Config, onConnect ...func(conn *amqp.Connection) error) (*Connection, error) {
+	c := &Connection{
+		dsn:        dsn,
+		minBackoff: cfg.MqReconnectMinDelay,
+		maxBackoff: cfg.MqReconnectMaxDelay,
+		onConnect:  onConnect,
+		ready:      make(chan struct{}),
+	}
+	if c.minBackoff <= 0 {
+		c.minBackoff = 500 * time.Millisecond
+	}
+	if c.maxBackoff < c.minBackoff {
+		c.maxBackoff = 30 * time.Second
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Connection) connect() error {
+	conn, err := amqp.Dial(c.dsn)
+	if err != nil {
+		return err
+	}
+	for _, fn := range c.onConnect {
+		if err := fn(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	c.closed = closed
+	close(c.ready)
+	return nil
+}
+
+// delay returns wait before reconnect attempt, it doubles with every attempt up to max backoff
+func (c *Connection) delay(attempt int) time.Duration {
+	delay := c.minBackoff
+	for i := 0; i < attempt && delay < c.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.maxBackoff {
+		return c.maxBackoff
+	}
+	return delay
+}
+
+// Run watches connection and reconnects when it is closed by broker or network failure,
+// connection is closed when ctx is cancelled, also when it is cancelled during reconnect
+func (c *Connection) Run(ctx context.Context) {
+	for {
+		c.mu.RLock()
+		closed := c.closed
+		c.mu.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			c.Close()
+			return
+		case err := <-closed:
+			log.Warnln("rabbitmq connection closed", err)
+		}
+
+		// closed connection is dropped first, so it is never handed out while not ready
+		c.mu.Lock()
+		c.conn = nil
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.delay(attempt)):
+			}
+			if err := c.connect(); err != nil {
+				log.Errorln("failed to reconnect to rabbitmq", err)
+				continue
+			}
+			if ctx.Err() != nil {
+				c.Close()
+				return
+			}
+			log.Infoln("reconnected to rabbitmq")
+			break
+		}
+	}
+}
+
+// Get returns open connection, while disconnected it waits up to timeout for reconnection
+// and fails with ErrDisconnected
+func (c *Connection) Get(timeout time.Duration) (*amqp.Connection, error) {
+	c.mu.RLock()
+	ready := c.ready
+	c.mu.RUnlock()
+
+	select {
+	case <-ready:
+	default:
+		if timeout <= 0 {
+			return nil, ErrDisconnected
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-ready:
+		case <-timer.C:
+			return nil, ErrDisconnected
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn, nil
+}
+
+func (c *Connection) Close() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,53 @@
+package broker
+
+import (
+	"context"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	c := &Connection{minBackoff: time.Second, maxBackoff: 10 * time.Second}
+
+	assert.Equal(t, time.Second, c.delay(0))
+	assert.Equal(t, 4*time.Second, c.delay(2))
+	assert.Equal(t, 10*time.Second, c.delay(10))
+}
+
+func TestGetWhileDisconnected(t *testing.T) {
+	c := &Connection{ready: make(chan struct{})}
+
+	_, err := c.Get(0)
+	assert.Equal(t, ErrDisconnected, err)
+
+	_, err = c.Get(10 * time.Millisecond)
+	assert.Equal(t, ErrDisconnected, err)
+}
+
+func TestRunDropsClosedConnection(t *testing.T) {
+	ready := make(chan struct{})
+	close(ready)
+	closed := make(chan *amqp.Error, 1)
+	c := &Connection{dsn: "amqp://127.0.0.1:1/", minBackoff: time.Millisecond, maxBackoff: time.Millisecond,
+		conn: &amqp.Connection{}, closed: closed, ready: ready}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	closed <- amqp.ErrClosed
+	assert.Eventually(t, func() bool {
+		_, err := c.Get(0)
+		return err == ErrDisconnected
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	assert.Nil(t, c.conn)
+}
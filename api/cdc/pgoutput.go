@@ -0,0 +1,214 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errShortMessage = errors.New("pgoutput message is too short")
+
+// LSN is position in Postgres write-ahead log
+type LSN uint64
+
+// ParseLSN parses textual pg_lsn representation, e.g. 16/B374D848
+func ParseLSN(s string) (LSN, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid lsn %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %q", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %q", s)
+	}
+	return LSN(h<<32 | l), nil
+}
+
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
+}
+
+const (
+	ChangeInsert = 'I'
+	ChangeUpdate = 'U'
+	ChangeDelete = 'D'
+)
+
+// Relation describes table columns, pgoutput sends it before first change of table in every decoding session
+type Relation struct {
+	ID        uint32
+	Namespace string
+	Name      string
+	Columns   []string
+}
+
+// Tuple holds text values of row columns by name, nil is SQL NULL,
+// unchanged TOAST values are missing
+type Tuple map[string]*string
+
+// Change is single row change, old tuple is present for updates and deletes
+// when table has REPLICA IDENTITY FULL
+type Change struct {
+	Kind     byte
+	Relation Relation
+	Old      Tuple
+	New      Tuple
+}
+
+// Commit closes transaction, EndLSN is position to confirm after transaction is handled
+type Commit struct {
+	LSN    LSN
+	EndLSN LSN
+}
+
+// decoder parses pgoutput protocol version 1 messages, it keeps relations seen in session
+type decoder struct {
+	relations map[uint32]Relation
+}
+
+func newDecoder() *decoder {
+	return &decoder{relations: map[uint32]Relation{}}
+}
+
+// Decode returns *Change, *Commit or nil for messages which are not needed, e.g. begin, type or origin
+func (d *decoder) Decode(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, errShortMessage
+	}
+	r := &reader{data: data[1:]}
+	switch data[0] {
+	case 'R':
+		rel := Relation{ID: r.uint32(), Namespace: r.string(), Name: r.string()}
+		r.byte() // replica identity
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			r.byte() // flags
+			rel.Columns = append(rel.Columns, r.string())
+			r.uint32() // type oid
+			r.uint32() // type modifier
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		d.relations[rel.ID] = rel
+		return nil, nil
+	case 'C':
+		r.byte() // flags
+		commit := &Commit{LSN: LSN(r.uint64()), EndLSN: LSN(r.uint64())}
+		return commit, r.err
+	case 'I', 'U', 'D':
+		return d.decodeChange(data[0], r)
+	default:
+		return nil, nil
+	}
+}
+
+func (d *decoder) decodeChange(kind byte, r *reader) (*Change, error) {
+	id := r.uint32()
+	rel, ok := d.relations[id]
+	if r.err == nil && !ok {
+		return nil, fmt.Errorf("unknown relation %d", id)
+	}
+	change := &Change{Kind: kind, Relation: rel}
+	for r.err == nil && len(r.data) > 0 {
+		switch r.byte() {
+		case 'K', 'O':
+			change.Old = r.tuple(rel)
+		case 'N':
+			change.New = r.tuple(rel)
+		default:
+			return nil, fmt.Errorf("unexpected tuple type in %c message", kind)
+		}
+	}
+	return change, r.err
+}
+
+// reader reads big-endian values, the first error is kept and following reads return zero values
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errShortMessage
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	i := strings.IndexByte(string(r.data), 0)
+	if i < 0 {
+		r.err = errShortMessage
+		return ""
+	}
+	s := string(r.data[:i])
+	r.data = r.data[i+1:]
+	return s
+}
+
+func (r *reader) tuple(rel Relation) Tuple {
+	n := int(r.uint16())
+	t := Tuple{}
+	for i := 0; i < n && r.err == nil; i++ {
+		name := strconv.Itoa(i)
+		if i < len(rel.Columns) {
+			name = rel.Columns[i]
+		}
+		switch r.byte() {
+		case 'n':
+			t[name] = nil
+		case 'u':
+			// unchanged TOAST value is not sent
+		case 't':
+			value := string(r.next(int(r.uint32())))
+			t[name] = &value
+		default:
+			r.err = errors.New("unexpected tuple column type")
+		}
+	}
+	return t
+}
@@ -0,0 +1,151 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type message []byte
+
+func (m message) byte(b byte) message {
+	return append(m, b)
+}
+
+func (m message) uint16(v uint16) message {
+	return binary.BigEndian.AppendUint16(m, v)
+}
+
+func (m message) uint32(v uint32) message {
+	return binary.BigEndian.AppendUint32(m, v)
+}
+
+func (m message) uint64(v uint64) message {
+	return binary.BigEndian.AppendUint64(m, v)
+}
+
+func (m message) string(s string) message {
+	return append(append(m, s...), 0)
+}
+
+func (m message) text(s string) message {
+	return append(m.byte('t').uint32(uint32(len(s))), s...)
+}
+
+func relationMessage() message {
+	m := message{'R'}.uint32(1).string("public").string("users").byte('f').uint16(3)
+	for _, column := range []string{"id", "nickname", "email_verified_at"} {
+		m = m.byte(0).string(column).uint32(25).uint32(0)
+	}
+	return m
+}
+
+func TestDecodeUpdate(t *testing.T) {
+	d := newDecoder()
+	msg, err := d.Decode(relationMessage())
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+
+	update := message{'U'}.uint32(1).
+		byte('O').uint16(3).text("id").text("old").byte('n').
+		byte('N').uint16(3).text("id").text("new").byte('u')
+	msg, err = d.Decode(update)
+
+	assert.Nil(t, err)
+	change := msg.(*Change)
+	assert.Equal(t, byte(ChangeUpdate), change.Kind)
+	assert.Equal(t, "users", change.Relation.Name)
+	assert.Equal(t, "old", *change.Old["nickname"])
+	assert.Nil(t, change.Old["email_verified_at"])
+	assert.Equal(t, "new", *change.New["nickname"])
+	_, ok := change.New["email_verified_at"]
+	assert.False(t, ok)
+}
+
+func TestDecodeCommit(t *testing.T) {
+	msg, err := newDecoder().Decode(message{'C'}.byte(0).uint64(10).uint64(20).uint64(0))
+
+	assert.Nil(t, err)
+	assert.Equal(t, &Commit{LSN: 10, EndLSN: 20}, msg)
+}
+
+func TestDecodeUnknownRelation(t *testing.T) {
+	_, err := newDecoder().Decode(message{'I'}.uint32(7).byte('N').uint16(0))
+	assert.NotNil(t, err)
+}
+
+func TestDecodeTruncatedMessage(t *testing.T) {
+	_, err := newDecoder().Decode(relationMessage()[:12])
+	assert.NotNil(t, err)
+}
+
+func TestLSN(t *testing.T) {
+	lsn, err := ParseLSN("16/B374D848")
+
+	assert.Nil(t, err)
+	assert.Equal(t, LSN(0x16B374D848), lsn)
+	assert.Equal(t, "16/B374D848", lsn.String())
+
+	_, err = ParseLSN("B374D848")
+	assert.NotNil(t, err)
+}
+
+func TestToUser(t *testing.T) {
+	id, at := "cd6a8f04-3f1e-4f8b-9a65-6e2d43e1e4a5", "2023-11-13 11:49:14.025679+00"
+	u, err := toUser(Tuple{"id": &id, "created_at": &at, "updated_at": &at, "email_verified_at": nil})
+
+	assert.Nil(t, err)
+	assert.Equal(t, id, u.ID.String())
+	assert.Equal(t, 2023, u.CreatedAt.Year())
+	assert.Nil(t, u.EmailVerifiedAt)
+}
+
+type mqMock struct {
+	routingKeys []string
+}
+
+func (m *mqMock) PublishMessage(routingKey string, _ string) error {
+	m.routingKeys = append(m.routingKeys, routingKey)
+	return nil
+}
+
+func (m *mqMock) PublishPrivateMessage(routingKey string, _ string) error {
+	m.routingKeys = append(m.routingKeys, routingKey)
+	return nil
+}
+
+func (m *mqMock) PublishEvent(routingKey string, _ string) error {
+	m.routingKeys = append(m.routingKeys, routingKey)
+	return nil
+}
+
+func TestPublishSoftDelete(t *testing.T) {
+	id, at := "cd6a8f04-3f1e-4f8b-9a65-6e2d43e1e4a5", "2023-11-13 11:49:14.025679+00"
+	deleted := func(deletedAt *string) Tuple {
+		return Tuple{"id": &id, "created_at": &at, "updated_at": &at, "deleted_at": deletedAt}
+	}
+	publisher := &mqMock{}
+	s := &streamer{publisher: publisher, legacy: true}
+
+	assert.Nil(t, s.publish(&Change{Kind: ChangeUpdate, Old: deleted(nil), New: deleted(&at)}))
+	assert.Nil(t, s.publish(&Change{Kind: ChangeUpdate, Old: deleted(&at), New: deleted(nil)}))
+	assert.Nil(t, s.publish(&Change{Kind: ChangeDelete, Old: deleted(&at)}))
+	assert.Equal(t, []string{
+		"user.deleted", "user.deleted.plain",
+		"user.restored", "user.restored.plain",
+		"user.purged", "user.purged.plain",
+	}, publisher.routingKeys)
+}
+
+func TestPublishSkipsUpdateWithoutChanges(t *testing.T) {
+	id, at, later := "cd6a8f04-3f1e-4f8b-9a65-6e2d43e1e4a5", "2023-11-13 11:49:14.025679+00", "2023-11-13 12:00:00+00"
+	row := func(country string, updatedAt string, version string) Tuple {
+		return Tuple{"id": &id, "country": &country, "created_at": &at, "updated_at": &updatedAt, "version": &version}
+	}
+	publisher := &mqMock{}
+	s := &streamer{publisher: publisher}
+
+	assert.Nil(t, s.publish(&Change{Kind: ChangeUpdate, Old: row("KZ", at, "1"), New: row("KZ", later, "2")}))
+	assert.Nil(t, s.publish(&Change{Kind: ChangeUpdate, Old: row("KZ", later, "2"), New: row("DE", later, "3")}))
+	assert.Equal(t, []string{"user.updated"}, publisher.routingKeys)
+}
@@ -0,0 +1,328 @@
+package cdc
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/event"
+	"golang-demo/api/user"
+	"golang-demo/config"
+	"strconv"
+	"time"
+)
+
+// streamer publishes changes of users table decoded from pgoutput logical replication slot.
+// Slot is read with pg_logical_slot_peek_binary_changes and advanced only after all changes of
+// transaction are published, so after restart streaming resumes from the last confirmed LSN
+type streamer struct {
+	db          *sql.DB
+	publisher   user.MQ
+	slot        string
+	publication string
+	interval    time.Duration
+	batchSize   int
+	legacy      bool
+}
+
+func NewStreamer(db *sql.DB, publisher user.MQ, cfg config.Config) *streamer {
+	s := &streamer{
+		db:          db,
+		publisher:   publisher,
+		slot:        cfg.CdcSlot,
+		publication: cfg.CdcPublication,
+		interval:    cfg.CdcPollInterval,
+		batchSize:   cfg.CdcBatchSize,
+		legacy:      cfg.EventLegacyPlain,
+	}
+	if s.slot == "" {
+		s.slot = "users_cdc"
+	}
+	if s.publication == "" {
+		s.publication = "users_cdc"
+	}
+	if s.interval <= 0 {
+		s.interval = time.Second
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = 500
+	}
+	return s
+}
+
+// Setup creates publication of users table and replication slot if they are missing.
+// Replica identity of users is set to full by migration, so updates and deletes carry previous row
+func (s *streamer) Setup() error {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", s.publication).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err = s.db.Exec("CREATE PUBLICATION " + pq.QuoteIdentifier(s.publication) + " FOR TABLE users"); err != nil {
+			return err
+		}
+		log.Infoln("created publication", s.publication)
+	}
+	err = s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)", s.slot).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err = s.db.Exec("SELECT pg_create_logical_replication_slot($1, 'pgoutput')", s.slot); err != nil {
+			return err
+		}
+		log.Infoln("created replication slot", s.slot)
+	}
+	return nil
+}
+
+// Run streams changes until ctx is cancelled, slot is read again while it returns full transactions
+func (s *streamer) Run(ctx context.Context) {
+	log.Infoln("cdc streaming started from slot", s.slot)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			n, err := s.poll()
+			if err != nil {
+				log.Errorln("failed to stream changes", err)
+			}
+			if err != nil || n == 0 {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			log.Infoln("cdc streaming stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type walMessage struct {
+	lsn  string
+	data []byte
+}
+
+// poll publishes decoded transactions and confirms end LSN of the last published one,
+// it returns number of confirmed transactions
+func (s *streamer) poll() (int, error) {
+	rows, err := s.db.Query("SELECT lsn::text, data FROM pg_logical_slot_peek_binary_changes($1, NULL, $2, "+
+		"'proto_version', '1', 'publication_names', $3)", s.slot, s.batchSize, s.publication)
+	if err != nil {
+		return 0, err
+	}
+	var messages []walMessage
+	for rows.Next() {
+		var m walMessage
+		if err := rows.Scan(&m.lsn, &m.data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	dec := newDecoder()
+	var changes []*Change
+	var confirmed LSN
+	transactions := 0
+	for _, m := range messages {
+		msg, err := dec.Decode(m.data)
+		if err == nil {
+			switch v := msg.(type) {
+			case *Change:
+				if v.Relation.Name == "users" {
+					changes = append(changes, v)
+				}
+			case *Commit:
+				for _, change := range changes {
+					if err = s.publish(change); err != nil {
+						break
+					}
+				}
+				changes = nil
+				if err == nil {
+					confirmed = v.EndLSN
+					transactions++
+				}
+			}
+		}
+		if err != nil {
+			if confirmed > 0 {
+				if advanceErr := s.advance(confirmed); advanceErr != nil {
+					log.Errorln("failed to confirm lsn", confirmed, advanceErr)
+				}
+			}
+			return transactions, fmt.Errorf("at lsn %s: %w", m.lsn, err)
+		}
+	}
+	if confirmed > 0 {
+		if err = s.advance(confirmed); err != nil {
+			return 0, err
+		}
+	}
+	return transactions, nil
+}
+
+// advance confirms that changes up to lsn are published, they are not returned by slot anymore
+func (s *streamer) advance(lsn LSN) error {
+	_, err := s.db.Exec("SELECT pg_replication_slot_advance($1, $2::pg_lsn)", s.slot, lsn.String())
+	if err == nil {
+		log.Debugln("confirmed lsn", lsn)
+	}
+	return err
+}
+
+// publish sends user event built from row change. Setting and clearing deleted_at is soft delete and restore,
+// snapshot of deleted user is taken from old row. Removal of row is purge of deleted user. Update which changes
+// no published field, e.g. password or version only, is skipped
+func (s *streamer) publish(change *Change) error {
+	var eventType string
+	var u user.User
+	var before *user.User
+	var err error
+	switch change.Kind {
+	case ChangeInsert:
+		eventType = user.EventCreated
+		u, err = toUser(change.New)
+	case ChangeUpdate:
+		eventType = user.EventUpdated
+		// unchanged TOAST values are sent only in old row
+		for k, v := range change.Old {
+			if _, ok := change.New[k]; !ok {
+				change.New[k] = v
+			}
+		}
+		u, err = toUser(change.New)
+		if err == nil && len(change.Old) > 0 {
+			var old user.User
+			if old, err = toUser(change.Old); err != nil {
+				return err
+			}
+			switch {
+			case old.DeletedAt == nil && u.DeletedAt != nil:
+				eventType = user.EventDeleted
+				u = old
+			case old.DeletedAt != nil && u.DeletedAt == nil:
+				eventType = user.EventRestored
+			default:
+				changes, err := event.Diff(old, u, "updated_at", "version")
+				if err != nil {
+					return err
+				}
+				if len(changes) == 0 {
+					log.Debugln("skipped update without changes of user", u.ID)
+					return nil
+				}
+				before = &old
+			}
+		}
+	case ChangeDelete:
+		u, err = toUser(change.Old)
+		if err != nil {
+			return err
+		}
+		var deletedAt time.Time
+		if u.DeletedAt != nil {
+			deletedAt = *u.DeletedAt
+		}
+		body, err := user.NewPurgeEvent(u.ID, deletedAt)
+		if err != nil {
+			return err
+		}
+		return s.send(user.EventPurged, u.ID.String(), body)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	body, err := user.NewEvent(eventType, u, before)
+	if err != nil {
+		return err
+	}
+	return s.send(eventType, u.ID.String(), body)
+}
+
+// send publishes event, with legacy format enabled bare user id is also sent
+func (s *streamer) send(eventType string, id string, body string) error {
+	if err := s.publisher.PublishEvent(eventType, body); err != nil {
+		return err
+	}
+	if s.legacy {
+		return s.publisher.PublishMessage(eventType+".plain", id)
+	}
+	return nil
+}
+
+// toUser converts text values of users row to user, password is not copied
+func toUser(t Tuple) (user.User, error) {
+	var u user.User
+	var err error
+	if u.ID, err = uuid.Parse(text(t, "id")); err != nil {
+		return u, err
+	}
+	u.FirstName = text(t, "first_name")
+	u.LastName = text(t, "last_name")
+	u.Nickname = text(t, "nickname")
+	u.Email = text(t, "email")
+	u.Country = text(t, "country")
+	u.Role = text(t, "role")
+	if u.EmailVerifiedAt, err = timestamp(t, "email_verified_at"); err != nil {
+		return u, err
+	}
+	if u.DeactivatedAt, err = timestamp(t, "deactivated_at"); err != nil {
+		return u, err
+	}
+	if u.DeletedAt, err = timestamp(t, "deleted_at"); err != nil {
+		return u, err
+	}
+	if version := text(t, "version"); version != "" {
+		if u.Version, err = strconv.ParseInt(version, 10, 64); err != nil {
+			return u, err
+		}
+	}
+	for name, dest := range map[string]*time.Time{"created_at": &u.CreatedAt, "updated_at": &u.UpdatedAt} {
+		at, err := timestamp(t, name)
+		if err != nil {
+			return u, err
+		}
+		if at != nil {
+			*dest = *at
+		}
+	}
+	return u, nil
+}
+
+func text(t Tuple, column string) string {
+	if v := t[column]; v != nil {
+		return *v
+	}
+	return ""
+}
+
+var timestampLayouts = []string{"2006-01-02 15:04:05.999999999-07", "2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05.999999999"}
+
+// timestamp parses text representation of timestamp with time zone, nil is returned for NULL
+func timestamp(t Tuple, column string) (*time.Time, error) {
+	v := t[column]
+	if v == nil {
+		return nil, nil
+	}
+	var err error
+	for _, layout := range timestampLayouts {
+		var at time.Time
+		if at, err = time.Parse(layout, *v); err == nil {
+			return &at, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,210 @@
+package deadletter
+
+import (
+	"context"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/broker"
+	"golang-demo/api/user"
+	"golang-demo/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Publisher interface {
+	Replay(d DeadLetter) error
+}
+
+type publisher struct {
+	conn *broker.Connection
+}
+
+func NewPublisher(conn *broker.Connection) *publisher {
+	return &publisher{conn}
+}
+
+// Replay publishes dead letter to exchange and routing key it was originally published with
+// and waits for broker confirmation. Dead-lettering headers are dropped
+func (p *publisher) Replay(d DeadLetter) error {
+	conn, err := p.conn.Get(0)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err = ch.Confirm(false); err != nil {
+		return err
+	}
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		if k == "x-death" || strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") {
+			continue
+		}
+		headers[k] = toAMQP(v)
+	}
+	headers["x-replayed-from"] = d.ID.String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, d.Exchange, d.RoutingKey, false, false, amqp.Publishing{
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    d.MessageID,
+		Type:         d.Type,
+		Headers:      headers,
+		Body:         []byte(d.Body),
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return user.ErrPublishNacked
+	}
+	return nil
+}
+
+// toAMQP converts header value decoded from JSON to type accepted by amqp table
+func toAMQP(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		table := amqp.Table{}
+		for k, item := range value {
+			table[k] = toAMQP(item)
+		}
+		return table
+	case []any:
+		items := make([]any, len(value))
+		for i, item := range value {
+			items[i] = toAMQP(item)
+		}
+		return items
+	default:
+		return value
+	}
+}
+
+// collector moves messages from dead-letter queues to dead_letters table, so they can be inspected
+// and replayed one by one. Message is acked only after it is stored
+type collector struct {
+	conn       *broker.Connection
+	repository Repository
+	queues     []string
+}
+
+func NewCollector(conn *broker.Connection, repository Repository, cfg config.Config) *collector {
+	return &collector{conn, repository, user.DeadLetterQueues(cfg)}
+}
+
+// Run collects every dead-letter queue until ctx is cancelled, collecting is restarted after reconnect
+func (c *collector) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, queue := range c.queues {
+		wg.Add(1)
+		go func(queue string) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := c.collect(ctx, queue); err != nil {
+					log.Errorln("failed to collect dead letters from", queue, err)
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}(queue)
+	}
+	wg.Wait()
+	log.Infoln("dead letter collector stopped")
+}
+
+func (c *collector) collect(ctx context.Context, queue string) error {
+	conn, err := c.conn.Get(time.Second)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return broker.ErrDisconnected
+			}
+			if err := c.repository.Insert(fromDelivery(queue, d)); err != nil {
+				log.Errorln("failed to store dead letter", d.MessageId, err)
+				_ = d.Nack(false, true)
+				return err
+			}
+			_ = d.Ack(false)
+			log.Warnln("collected dead letter from", queue, d.Type, d.MessageId)
+		}
+	}
+}
+
+// fromDelivery reads queue which rejected message, original exchange, routing key and reason
+// from the latest x-death entry
+func fromDelivery(queue string, d amqp.Delivery) DeadLetter {
+	deadLetter := DeadLetter{
+		Queue:       queue,
+		Exchange:    d.Exchange,
+		RoutingKey:  d.RoutingKey,
+		Type:        d.Type,
+		MessageID:   d.MessageId,
+		ContentType: d.ContentType,
+		Headers:     map[string]any(d.Headers),
+		Body:        string(d.Body),
+		Reason:      "unknown",
+		DeathCount:  1,
+	}
+	if deadLetter.Headers == nil {
+		deadLetter.Headers = map[string]any{}
+	}
+	deaths, _ := d.Headers["x-death"].([]any)
+	if len(deaths) == 0 {
+		return deadLetter
+	}
+	death, ok := deaths[0].(amqp.Table)
+	if !ok {
+		return deadLetter
+	}
+	if q, ok := death["queue"].(string); ok {
+		deadLetter.Queue = q
+	}
+	if reason, ok := death["reason"].(string); ok {
+		deadLetter.Reason = reason
+	}
+	if exchange, ok := death["exchange"].(string); ok {
+		deadLetter.Exchange = exchange
+	}
+	if keys, ok := death["routing-keys"].([]any); ok && len(keys) > 0 {
+		if key, ok := keys[0].(string); ok {
+			deadLetter.RoutingKey = key
+		}
+	}
+	if count, ok := death["count"].(int64); ok {
+		deadLetter.DeathCount = int(count)
+	}
+	if at, ok := death["time"].(time.Time); ok {
+		deadLetter.DeadLetteredAt = &at
+	}
+	return deadLetter
+}
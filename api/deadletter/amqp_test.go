@@ -0,0 +1,40 @@
+package deadletter
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFromDeliveryReadsDeath(t *testing.T) {
+	at := time.Now()
+	d := amqp.Delivery{
+		Exchange:   "users.dlx",
+		RoutingKey: "user_commands.dead",
+		Type:       "user.delete",
+		Headers: amqp.Table{"x-death": []any{amqp.Table{
+			"queue":        "user_commands",
+			"reason":       "rejected",
+			"exchange":     "",
+			"routing-keys": []any{"user_commands"},
+			"count":        int64(2),
+			"time":         at,
+		}}},
+	}
+
+	deadLetter := fromDelivery("user_commands.dead", d)
+
+	assert.Equal(t, "user_commands", deadLetter.Queue)
+	assert.Equal(t, "", deadLetter.Exchange)
+	assert.Equal(t, "user_commands", deadLetter.RoutingKey)
+	assert.Equal(t, "rejected", deadLetter.Reason)
+	assert.Equal(t, 2, deadLetter.DeathCount)
+	assert.Equal(t, &at, deadLetter.DeadLetteredAt)
+}
+
+func TestToAMQPConvertsNestedHeaders(t *testing.T) {
+	v := toAMQP(map[string]any{"trace": []any{map[string]any{"id": "1"}}})
+
+	assert.Equal(t, amqp.Table{"trace": []any{amqp.Table{"id": "1"}}}, v)
+}
@@ -0,0 +1,87 @@
+package deadletter
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"golang-demo/api/auth"
+	"golang-demo/api/user"
+	"net/http"
+	"strconv"
+)
+
+type deadLetterHandler struct {
+	deadLetterService Service
+}
+
+func NewDeadLetterHandler(deadLetterService Service) *deadLetterHandler {
+	return &deadLetterHandler{deadLetterService}
+}
+
+// Get paginated dead letters, optionally filtered by queue and status
+func (handler *deadLetterHandler) Get(w http.ResponseWriter, r *http.Request) {
+	pageSize := 10
+	page := 1
+	if pageStr := r.URL.Query().Get("page"); pageStr != "" {
+		page, _ = strconv.Atoi(pageStr)
+	}
+	if pageSizeStr := r.URL.Query().Get("page_size"); pageSizeStr != "" {
+		pageSize, _ = strconv.Atoi(pageSizeStr)
+	}
+	queue := r.URL.Query().Get("queue")
+	status := r.URL.Query().Get("status")
+	deadLetters, totalCount, err := handler.deadLetterService.Get(queue, status, page, pageSize)
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]any{"dead_letters": deadLetters, "total_count": totalCount}})
+}
+
+func (handler *deadLetterHandler) GetByID(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "deadLetterId"))
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+	deadLetter, audit, err := handler.deadLetterService.GetById(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = render.Render(w, r, user.ErrNotFound)
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]any{"dead_letter": deadLetter, "audit": audit}})
+}
+
+func (handler *deadLetterHandler) Replay(w http.ResponseWriter, r *http.Request) {
+	handler.resolve(w, r, handler.deadLetterService.Replay, "replay")
+}
+
+func (handler *deadLetterHandler) Discard(w http.ResponseWriter, r *http.Request) {
+	handler.resolve(w, r, handler.deadLetterService.Discard, "discard")
+}
+
+func (handler *deadLetterHandler) resolve(w http.ResponseWriter, r *http.Request, fn func(id uuid.UUID, actorID uuid.UUID) error, action string) {
+	id, err := uuid.Parse(chi.URLParam(r, "deadLetterId"))
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	err = fn(id, principal.UserID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_ = render.Render(w, r, user.ErrNotFound)
+	case errors.Is(err, ErrAlreadyResolved):
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 409, StatusText: "conflict", Err: err, ErrorText: err.Error()})
+	case err != nil:
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during " + action, Err: err, ErrorText: err.Error()})
+	default:
+		render.JSON(w, r, user.Response{Data: map[string]string{"message": "successfully " + action + "ed"}})
+	}
+}
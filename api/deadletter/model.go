@@ -0,0 +1,47 @@
+package deadletter
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusReplaying = "replaying"
+	StatusReplayed  = "replayed"
+	StatusDiscarded = "discarded"
+
+	ActionReplay  = "replay"
+	ActionDiscard = "discard"
+)
+
+// DeadLetter holds message rejected by consumer and collected from dead-letter queue,
+// exchange and routing key are taken from x-death header and point to where message was originally published
+type DeadLetter struct {
+	ID             uuid.UUID      `json:"id"`
+	Queue          string         `json:"queue"`
+	Exchange       string         `json:"exchange"`
+	RoutingKey     string         `json:"routing_key"`
+	Type           string         `json:"type"`
+	MessageID      string         `json:"message_id"`
+	ContentType    string         `json:"content_type"`
+	Headers        map[string]any `json:"headers"`
+	Body           string         `json:"body"`
+	Reason         string         `json:"reason"`
+	DeathCount     int            `json:"death_count"`
+	DeadLetteredAt *time.Time     `json:"dead_lettered_at"`
+	ReceivedAt     time.Time      `json:"received_at"`
+	Status         string         `json:"status"`
+	ResolvedAt     *time.Time     `json:"resolved_at"`
+	ClaimedUntil   *time.Time     `json:"claimed_until"`
+}
+
+// AuditEntry records replay or discard of dead letter, error is set for failed replay
+type AuditEntry struct {
+	ID           uuid.UUID `json:"id"`
+	DeadLetterID uuid.UUID `json:"dead_letter_id"`
+	Action       string    `json:"action"`
+	ActorID      uuid.UUID `json:"actor_id"`
+	Error        *string   `json:"error"`
+	CreatedAt    time.Time `json:"created_at"`
+}
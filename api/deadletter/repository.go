@@ -0,0 +1,251 @@
+package deadletter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+var ErrAlreadyResolved = errors.New("dead letter is already replayed or discarded")
+
+type Repository interface {
+	Insert(d DeadLetter) error
+	Select(queue string, status string, offset int, limit int) ([]DeadLetter, int64, error)
+	SelectById(id uuid.UUID) (DeadLetter, error)
+	Claim(id uuid.UUID, until time.Time) (DeadLetter, error)
+	Release(id uuid.UUID, action string, actorID uuid.UUID, auditErr error) error
+	Resolve(id uuid.UUID, status string, action string, actorID uuid.UUID) error
+	Audit(id uuid.UUID, action string, actorID uuid.UUID, auditErr error) error
+	SelectAudit(id uuid.UUID) ([]AuditEntry, error)
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *repository {
+	return &repository{db}
+}
+
+var psql sq.StatementBuilderType
+
+func init() {
+	psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+}
+
+var columns = []string{"id", "queue", "exchange", "routing_key", "message_type", "message_id", "content_type", "headers", "body",
+	"reason", "death_count", "dead_lettered_at", "received_at", "status", "resolved_at", "claimed_until"}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDeadLetter(row scanner) (DeadLetter, error) {
+	var d DeadLetter
+	var headers, body []byte
+	var deadLetteredAt, resolvedAt, claimedUntil sql.NullTime
+	err := row.Scan(&d.ID, &d.Queue, &d.Exchange, &d.RoutingKey, &d.Type, &d.MessageID, &d.ContentType, &headers, &body,
+		&d.Reason, &d.DeathCount, &deadLetteredAt, &d.ReceivedAt, &d.Status, &resolvedAt, &claimedUntil)
+	if err != nil {
+		return d, err
+	}
+	if err = json.Unmarshal(headers, &d.Headers); err != nil {
+		return d, err
+	}
+	d.Body = string(body)
+	if deadLetteredAt.Valid {
+		d.DeadLetteredAt = &deadLetteredAt.Time
+	}
+	if resolvedAt.Valid {
+		d.ResolvedAt = &resolvedAt.Time
+	}
+	if claimedUntil.Valid {
+		d.ClaimedUntil = &claimedUntil.Time
+	}
+	return d, nil
+}
+
+func (r *repository) Insert(d DeadLetter) error {
+	headers, err := json.Marshal(d.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = psql.Insert("dead_letters").SetMap(map[string]interface{}{
+		"queue":            d.Queue,
+		"exchange":         d.Exchange,
+		"routing_key":      d.RoutingKey,
+		"message_type":     d.Type,
+		"message_id":       d.MessageID,
+		"content_type":     d.ContentType,
+		"headers":          headers,
+		"body":             []byte(d.Body),
+		"reason":           d.Reason,
+		"death_count":      d.DeathCount,
+		"dead_lettered_at": d.DeadLetteredAt,
+	}).RunWith(r.db).Exec()
+	return err
+}
+
+func (r *repository) Select(queue string, status string, offset int, limit int) ([]DeadLetter, int64, error) {
+	deadLetters := []DeadLetter{}
+	var totalCount int64
+
+	builder := func(sel sq.SelectBuilder) sq.SelectBuilder {
+		query := sel.From("dead_letters")
+		if queue != "" {
+			query = query.Where(sq.Eq{"queue": queue})
+		}
+		if status != "" {
+			query = query.Where(sq.Eq{"status": status})
+		}
+		return query
+	}
+
+	err := builder(psql.Select("count(1) AS total")).RunWith(r.db).QueryRow().Scan(&totalCount)
+	if err != nil {
+		return deadLetters, totalCount, err
+	}
+	rows, err := builder(psql.Select(columns...)).OrderBy("received_at DESC").
+		Offset(uint64(offset)).Limit(uint64(limit)).RunWith(r.db).Query()
+	if err != nil {
+		return deadLetters, totalCount, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return deadLetters, totalCount, err
+		}
+		deadLetters = append(deadLetters, d)
+	}
+	return deadLetters, totalCount, rows.Err()
+}
+
+func (r *repository) SelectById(id uuid.UUID) (DeadLetter, error) {
+	row := psql.Select(columns...).From("dead_letters").Where(sq.Eq{"id": id}).RunWith(r.db).QueryRow()
+	return scanDeadLetter(row)
+}
+
+// claimable matches pending dead letter and dead letter which was claimed for replay but not resolved
+// within lease, e.g. because instance replaying it stopped
+func claimable(now time.Time) sq.Or {
+	return sq.Or{sq.Eq{"status": StatusPending}, sq.And{sq.Eq{"status": StatusReplaying}, sq.Lt{"claimed_until": now}}}
+}
+
+// Claim marks claimable dead letter as replaying until given time and returns it, so it can not be replayed
+// or discarded concurrently. ErrAlreadyResolved is returned when dead letter is resolved or claimed by other replay
+func (r *repository) Claim(id uuid.UUID, until time.Time) (DeadLetter, error) {
+	row := psql.Update("dead_letters").SetMap(map[string]interface{}{
+		"status":        StatusReplaying,
+		"claimed_until": until,
+	}).Where(sq.Eq{"id": id}).Where(claimable(time.Now())).
+		Suffix("RETURNING " + strings.Join(columns, ", ")).RunWith(r.db).QueryRow()
+	d, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err = r.SelectById(id); err != nil {
+			return d, err
+		}
+		return d, ErrAlreadyResolved
+	}
+	return d, err
+}
+
+// Release returns claimed dead letter to pending after failed replay and records failure in audit trail
+func (r *repository) Release(id uuid.UUID, action string, actorID uuid.UUID, auditErr error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = psql.Update("dead_letters").SetMap(map[string]interface{}{
+		"status":        StatusPending,
+		"claimed_until": nil,
+	}).Where(sq.Eq{"id": id, "status": StatusReplaying}).RunWith(tx).Exec()
+	if err != nil {
+		return err
+	}
+	if err = insertAudit(tx, id, action, actorID, auditErr); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Resolve changes status of dead letter and records audit entry in the same transaction,
+// dead letter is replayed only after it was claimed, other resolutions apply to claimable one
+func (r *repository) Resolve(id uuid.UUID, status string, action string, actorID uuid.UUID) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from sq.Sqlizer = claimable(time.Now())
+	if status == StatusReplayed {
+		from = sq.Eq{"status": StatusReplaying}
+	}
+	res, err := psql.Update("dead_letters").SetMap(map[string]interface{}{
+		"status":      status,
+		"resolved_at": time.Now(),
+	}).Where(sq.Eq{"id": id}).Where(from).RunWith(tx).Exec()
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAlreadyResolved
+	}
+	if err = insertAudit(tx, id, action, actorID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Audit records audit entry without changing dead letter
+func (r *repository) Audit(id uuid.UUID, action string, actorID uuid.UUID, auditErr error) error {
+	return insertAudit(r.db, id, action, actorID, auditErr)
+}
+
+func insertAudit(runner sq.BaseRunner, id uuid.UUID, action string, actorID uuid.UUID, auditErr error) error {
+	var errText *string
+	if auditErr != nil {
+		text := auditErr.Error()
+		errText = &text
+	}
+	_, err := psql.Insert("dead_letter_audit").SetMap(map[string]interface{}{
+		"dead_letter_id": id,
+		"action":         action,
+		"actor_id":       actorID,
+		"error":          errText,
+	}).RunWith(runner).Exec()
+	return err
+}
+
+func (r *repository) SelectAudit(id uuid.UUID) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	rows, err := psql.Select("id", "dead_letter_id", "action", "actor_id", "error", "created_at").From("dead_letter_audit").
+		Where(sq.Eq{"dead_letter_id": id}).OrderBy("created_at").RunWith(r.db).Query()
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e AuditEntry
+		var errText sql.NullString
+		if err := rows.Scan(&e.ID, &e.DeadLetterID, &e.Action, &e.ActorID, &errText, &e.CreatedAt); err != nil {
+			return entries, err
+		}
+		if errText.Valid {
+			e.Error = &errText.String
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
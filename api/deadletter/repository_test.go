@@ -0,0 +1,142 @@
+package deadletter
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func DbMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sqldb, mock
+}
+
+func TestSelectDeadLetter(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	id := uuid.New()
+	rows := sqlmock.NewRows(columns).AddRow(id, "user_commands", "", "user_commands", "user.delete", "1", "application/json",
+		[]byte(`{"x-death": []}`), []byte(`{"user_id": "x"}`), "rejected", 1, time.Now(), time.Now(), StatusPending, nil, nil)
+	mock.ExpectQuery("SELECT (.+) FROM dead_letters WHERE id = (.+)").WillReturnRows(rows)
+
+	d, err := repo.SelectById(id)
+
+	assert.Nil(t, err)
+	assert.Equal(t, `{"user_id": "x"}`, d.Body)
+	assert.Contains(t, d.Headers, "x-death")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestResolveWritesAudit(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE dead_letters SET resolved_at = (.+), status = (.+) WHERE id = (.+) AND status = (.+)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO dead_letter_audit (.+) VALUES (.+)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := repo.Resolve(uuid.New(), StatusReplayed, ActionReplay, uuid.New())
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestResolveAlreadyResolved(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE dead_letters SET (.+) WHERE (.+)").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := repo.Resolve(uuid.New(), StatusDiscarded, ActionDiscard, uuid.New())
+
+	assert.Equal(t, ErrAlreadyResolved, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDiscardAcceptsExpiredClaim(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE dead_letters SET resolved_at = (.+), status = (.+) WHERE id = (.+) " +
+		"AND \\(status = (.+) OR \\(status = (.+) AND claimed_until < (.+)\\)\\)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO dead_letter_audit (.+) VALUES (.+)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := repo.Resolve(uuid.New(), StatusDiscarded, ActionDiscard, uuid.New())
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestClaimDeadLetter(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	id := uuid.New()
+	rows := sqlmock.NewRows(columns).AddRow(id, "user_commands", "", "user_commands", "user.delete", "1", "application/json",
+		[]byte(`{}`), []byte(`{"user_id": "x"}`), "rejected", 1, time.Now(), time.Now(), StatusReplaying, nil, nil)
+	until := time.Now().Add(time.Minute)
+	mock.ExpectQuery("UPDATE dead_letters SET claimed_until = (.+), status = (.+) WHERE id = (.+) "+
+		"AND \\(status = (.+) OR \\(status = (.+) AND claimed_until < (.+)\\)\\) RETURNING (.+)").
+		WithArgs(until, StatusReplaying, id, StatusPending, StatusReplaying, sqlmock.AnyArg()).WillReturnRows(rows)
+
+	d, err := repo.Claim(id, until)
+
+	assert.Nil(t, err)
+	assert.Equal(t, StatusReplaying, d.Status)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestClaimAlreadyClaimed(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	id := uuid.New()
+	mock.ExpectQuery("UPDATE dead_letters SET (.+) RETURNING (.+)").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery("SELECT (.+) FROM dead_letters WHERE id = (.+)").WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(id, "user_commands", "", "user_commands", "user.delete", "1", "application/json",
+			[]byte(`{}`), []byte(`{}`), "rejected", 1, time.Now(), time.Now(), StatusReplaying, nil, nil))
+
+	_, err := repo.Claim(id, time.Now().Add(time.Minute))
+
+	assert.Equal(t, ErrAlreadyResolved, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestReleaseWritesAudit(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	id := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE dead_letters SET claimed_until = (.+), status = (.+) WHERE id = (.+) AND status = (.+)").
+		WithArgs(nil, StatusPending, id, StatusReplaying).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO dead_letter_audit (.+) VALUES (.+)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := repo.Release(id, ActionReplay, uuid.New(), errors.New("broker unavailable"))
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,75 @@
+package deadletter
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// claimLease is time replay has to publish and resolve claimed dead letter, after it dead letter
+// may be replayed or discarded again
+const claimLease = time.Minute
+
+type Service interface {
+	Get(queue string, status string, page int, pageSize int) ([]DeadLetter, int64, error)
+	GetById(id uuid.UUID) (DeadLetter, []AuditEntry, error)
+	Replay(id uuid.UUID, actorID uuid.UUID) error
+	Discard(id uuid.UUID, actorID uuid.UUID) error
+}
+
+type service struct {
+	repository Repository
+	publisher  Publisher
+}
+
+func NewService(repository Repository, publisher Publisher) *service {
+	return &service{repository, publisher}
+}
+
+func (s *service) Get(queue string, status string, page int, pageSize int) ([]DeadLetter, int64, error) {
+	return s.repository.Select(queue, status, (page-1)*pageSize, pageSize)
+}
+
+func (s *service) GetById(id uuid.UUID) (DeadLetter, []AuditEntry, error) {
+	d, err := s.repository.SelectById(id)
+	if err != nil {
+		return d, nil, err
+	}
+	entries, err := s.repository.SelectAudit(id)
+	return d, entries, err
+}
+
+// Replay claims pending dead letter, publishes it again and marks it as replayed, so concurrent replays
+// do not publish message twice. Failed attempt returns dead letter to pending and is audited as well.
+// When dead letter can't be marked as replayed after it was published, failure is audited and dead letter
+// stays replaying until its claim expires
+func (s *service) Replay(id uuid.UUID, actorID uuid.UUID) error {
+	d, err := s.repository.Claim(id, time.Now().Add(claimLease))
+	if err != nil {
+		return err
+	}
+	if err = s.publisher.Replay(d); err != nil {
+		if releaseErr := s.repository.Release(id, ActionReplay, actorID, err); releaseErr != nil {
+			log.Errorln("failed to release dead letter after failed replay", id, releaseErr)
+		}
+		return err
+	}
+	if err = s.repository.Resolve(id, StatusReplayed, ActionReplay, actorID); err != nil {
+		auditErr := fmt.Errorf("message is replayed, but dead letter is not resolved: %w", err)
+		if err := s.repository.Audit(id, ActionReplay, actorID, auditErr); err != nil {
+			log.Errorln("failed to audit replay of dead letter", id, err)
+		}
+		return err
+	}
+	log.Infoln("replayed dead letter", id, "to", d.Exchange, d.RoutingKey, "by", actorID)
+	return nil
+}
+
+func (s *service) Discard(id uuid.UUID, actorID uuid.UUID) error {
+	if err := s.repository.Resolve(id, StatusDiscarded, ActionDiscard, actorID); err != nil {
+		return err
+	}
+	log.Infoln("discarded dead letter", id, "by", actorID)
+	return nil
+}
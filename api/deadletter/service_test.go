@@ -0,0 +1,48 @@
+package deadletter
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type repositoryMock struct {
+	Repository
+	audit []error
+}
+
+func (m *repositoryMock) Claim(id uuid.UUID, until time.Time) (DeadLetter, error) {
+	return DeadLetter{ID: id, Status: StatusReplaying, ClaimedUntil: &until}, nil
+}
+
+func (m *repositoryMock) Resolve(uuid.UUID, string, string, uuid.UUID) error {
+	return errors.New("connection reset")
+}
+
+func (m *repositoryMock) Audit(_ uuid.UUID, _ string, _ uuid.UUID, auditErr error) error {
+	m.audit = append(m.audit, auditErr)
+	return nil
+}
+
+type publisherMock struct {
+	published int
+}
+
+func (p *publisherMock) Replay(DeadLetter) error {
+	p.published++
+	return nil
+}
+
+func TestReplayAuditsUnresolvedPublish(t *testing.T) {
+	repository, publisher := &repositoryMock{}, &publisherMock{}
+	s := NewService(repository, publisher)
+
+	err := s.Replay(uuid.New(), uuid.New())
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, publisher.published)
+	assert.Len(t, repository.audit, 1)
+	assert.Contains(t, repository.audit[0].Error(), "message is replayed")
+}
@@ -0,0 +1,94 @@
+// Package envelope signs and optionally encrypts AMQP messages of user service
+// and lets consumers verify and decrypt them.
+//
+// Signature is computed over version, key id, timestamp, routing key, content type, encryption key id and body
+// (after encryption), so message can not be moved to other routing key or altered. Keys are identified by id
+// sent in headers, so new key may be added to consumers before publisher switches to it.
+package envelope
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	HeaderSignature       = "x-signature"
+	HeaderSignatureAlg    = "x-signature-alg"
+	HeaderSignatureKeyID  = "x-signature-key-id"
+	HeaderSignedAt        = "x-signed-at"
+	HeaderEncryption      = "x-encryption"
+	HeaderEncryptionKeyID = "x-encryption-key-id"
+
+	AlgHMACSHA256 = "hmac-sha256"
+	AlgEd25519    = "ed25519"
+	EncAES256GCM  = "aes-256-gcm"
+
+	signatureVersion = "v1"
+)
+
+// Key is signing, verification or encryption key with id used for rotation
+type Key struct {
+	ID       string
+	Material []byte
+}
+
+// ParseKeys parses comma separated list of id:base64 pairs, the first key is active one
+func ParseKeys(value string) ([]Key, error) {
+	var keys []Key
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || encoded == "" {
+			return nil, fmt.Errorf("invalid key %q, expected id:base64", pair)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		material, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		seen[id] = true
+		keys = append(keys, Key{ID: id, Material: material})
+	}
+	return keys, nil
+}
+
+// signingInput builds canonical representation of message which is signed
+func signingInput(keyID string, signedAt int64, routingKey string, contentType string, encryptionKeyID string, body []byte) []byte {
+	header := strings.Join([]string{signatureVersion, keyID, strconv.FormatInt(signedAt, 10), routingKey, contentType, encryptionKeyID}, "\n")
+	input := make([]byte, 0, len(header)+1+len(body))
+	input = append(input, header...)
+	input = append(input, '\n')
+	return append(input, body...)
+}
+
+// matchTopic reports whether routing key matches topic exchange pattern, where * matches exactly one word
+// and # matches zero or more words
+func matchTopic(pattern string, routingKey string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(words) == 0 || (pattern[0] != "*" && pattern[0] != words[0]) {
+		return false
+	}
+	return matchWords(pattern[1:], words[1:])
+}
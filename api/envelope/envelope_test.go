@@ -0,0 +1,145 @@
+package envelope
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/config"
+	"testing"
+	"time"
+)
+
+var (
+	secret        = []byte("0123456789abcdef0123456789abcdef")
+	encryptionKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func key(id string, material []byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(material)
+}
+
+// deliver converts published message to delivery as consumer receives it
+func deliver(routingKey string, msg amqp.Publishing) amqp.Delivery {
+	return amqp.Delivery{RoutingKey: routingKey, ContentType: msg.ContentType, Headers: msg.Headers, Body: msg.Body}
+}
+
+func TestSealAndOpenEncrypted(t *testing.T) {
+	s, err := NewSealer(config.Config{
+		MessageSigningKeys:          key("k2", secret) + "," + key("k1", []byte("old")),
+		MessageEncryptionKeys:       key("e1", encryptionKey),
+		MessageEncryptedRoutingKeys: "user.#",
+	})
+	assert.Nil(t, err)
+	msg := amqp.Publishing{ContentType: "application/cloudevents+json", Body: []byte(`{"email":"a@b.c"}`)}
+	assert.Nil(t, s.Seal("user.created", &msg))
+	assert.Equal(t, "k2", msg.Headers[HeaderSignatureKeyID])
+	assert.Equal(t, "e1", msg.Headers[HeaderEncryptionKeyID])
+	assert.NotContains(t, string(msg.Body), "a@b.c")
+
+	v, err := NewVerifier(AlgHMACSHA256, []Key{{ID: "k1", Material: []byte("old")}, {ID: "k2", Material: secret}},
+		[]Key{{ID: "e1", Material: encryptionKey}}, time.Minute)
+	assert.Nil(t, err)
+	body, err := v.Open(deliver("user.created", msg))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"email":"a@b.c"}`, string(body))
+
+	_, err = v.Open(deliver("user.deleted", msg))
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestSealEd25519WithoutEncryption(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	s, err := NewSealer(config.Config{
+		MessageSigningAlgorithm:     AlgEd25519,
+		MessageSigningKeys:          key("k1", seed),
+		MessageEncryptionKeys:       key("e1", encryptionKey),
+		MessageEncryptedRoutingKeys: "user.*",
+	})
+	assert.Nil(t, err)
+	msg := amqp.Publishing{ContentType: "plain/text", Body: []byte("id")}
+	assert.Nil(t, s.Seal("user.created.plain", &msg))
+	assert.NotContains(t, msg.Headers, HeaderEncryption)
+
+	publicKey, _ := base64.StdEncoding.DecodeString(s.PublicKey())
+	v, err := NewVerifier(AlgEd25519, []Key{{ID: "k1", Material: publicKey}}, nil, 0)
+	assert.Nil(t, err)
+	body, err := v.Open(deliver("user.created.plain", msg))
+	assert.Nil(t, err)
+	assert.Equal(t, "id", string(body))
+
+	msg.Body = []byte("other")
+	_, err = v.Open(deliver("user.created.plain", msg))
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestSealNeverEncryptsLegacyPlain(t *testing.T) {
+	s, err := NewSealer(config.Config{
+		MessageSigningKeys:          key("k1", secret),
+		MessageEncryptionKeys:       key("e1", encryptionKey),
+		MessageEncryptedRoutingKeys: "user.#",
+	})
+	assert.Nil(t, err)
+	msg := amqp.Publishing{Body: []byte("id")}
+	assert.Nil(t, s.Seal("user.created.plain", &msg))
+	assert.NotContains(t, msg.Headers, HeaderEncryption)
+	assert.Equal(t, "id", string(msg.Body))
+}
+
+func TestSealPrivate(t *testing.T) {
+	s, err := NewSealer(config.Config{
+		MessageSigningKeys:          key("k1", secret),
+		MessageEncryptionKeys:       key("e1", encryptionKey),
+		MessageEncryptedRoutingKeys: "user.*",
+	})
+	assert.Nil(t, err)
+	replyTo := "amq.rabbitmq.reply-to.g1h2AA"
+	msg := amqp.Publishing{ContentType: "application/json", Body: []byte(`{"email":"a@b.c"}`)}
+	assert.Nil(t, s.SealPrivate(replyTo, &msg))
+	assert.NotContains(t, string(msg.Body), "a@b.c")
+
+	v, err := NewVerifier(AlgHMACSHA256, []Key{{ID: "k1", Material: secret}}, []Key{{ID: "e1", Material: encryptionKey}}, 0)
+	assert.Nil(t, err)
+	body, err := v.Open(deliver(replyTo, msg))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"email":"a@b.c"}`, string(body))
+}
+
+func TestOpenRejectsUnknownAndExpired(t *testing.T) {
+	s, err := NewSealer(config.Config{MessageSigningKeys: key("k1", secret)})
+	assert.Nil(t, err)
+	s.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	msg := amqp.Publishing{Body: []byte("id")}
+	assert.Nil(t, s.Seal("user.locked", &msg))
+
+	v, _ := NewVerifier(AlgHMACSHA256, []Key{{ID: "k2", Material: secret}}, nil, 0)
+	_, err = v.Open(deliver("user.locked", msg))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	v, _ = NewVerifier(AlgHMACSHA256, []Key{{ID: "k1", Material: secret}}, nil, time.Minute)
+	_, err = v.Open(deliver("user.locked", msg))
+	assert.ErrorIs(t, err, ErrExpired)
+
+	_, err = v.Open(amqp.Delivery{RoutingKey: "user.locked", Body: []byte("id")})
+	assert.ErrorIs(t, err, ErrUnsigned)
+}
+
+func TestNewSealerRequiresKey(t *testing.T) {
+	_, err := NewSealer(config.Config{})
+	assert.NotNil(t, err)
+	_, err = NewSealer(config.Config{MessageSigningKeys: key("k1", []byte("short"))})
+	assert.NotNil(t, err)
+	_, err = NewSealer(config.Config{MessageSigningKeys: "k1:change-me"})
+	assert.NotNil(t, err)
+	_, err = NewSealer(config.Config{MessageSigningKeys: "k1"})
+	assert.NotNil(t, err)
+}
+
+func TestMatchTopic(t *testing.T) {
+	assert.True(t, matchTopic("user.#", "user.created.plain"))
+	assert.True(t, matchTopic("user.#", "user"))
+	assert.True(t, matchTopic("user.*", "user.created"))
+	assert.False(t, matchTopic("user.*", "user.created.plain"))
+	assert.False(t, matchTopic("user.created", "user.updated"))
+	assert.True(t, matchTopic("#.plain", "user.deleted.plain"))
+}
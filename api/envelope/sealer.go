@@ -0,0 +1,164 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang-demo/config"
+	"strings"
+	"time"
+)
+
+type Sealer interface {
+	Seal(routingKey string, msg *amqp.Publishing) error
+	SealPrivate(routingKey string, msg *amqp.Publishing) error
+}
+
+// placeholder is value of MESSAGE_SIGNING_KEYS in example configuration which must be replaced
+const placeholder = "change-me"
+
+// sealer signs every message with active signing key and encrypts bodies of messages
+// whose routing key matches one of encrypted patterns
+type sealer struct {
+	algorithm       string
+	keyID           string
+	hmacKey         []byte
+	privateKey      ed25519.PrivateKey
+	encryptionKeyID string
+	aead            cipher.AEAD
+	encrypted       []string
+	now             func() time.Time
+}
+
+// NewSealer creates sealer from MESSAGE_* settings, signing key is required while encryption is optional
+func NewSealer(cfg config.Config) (*sealer, error) {
+	if strings.Contains(cfg.MessageSigningKeys, placeholder) {
+		return nil, errors.New("MESSAGE_SIGNING_KEYS is not configured, generate key with `openssl rand -base64 32`")
+	}
+	signingKeys, err := ParseKeys(cfg.MessageSigningKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MESSAGE_SIGNING_KEYS: %w", err)
+	}
+	if len(signingKeys) == 0 {
+		return nil, errors.New("MESSAGE_SIGNING_KEYS is required")
+	}
+	s := &sealer{keyID: signingKeys[0].ID, now: time.Now}
+	switch cfg.MessageSigningAlgorithm {
+	case "", AlgHMACSHA256:
+		if len(signingKeys[0].Material) < 32 {
+			return nil, errors.New("MESSAGE_SIGNING_KEYS hmac key must be at least 32 bytes")
+		}
+		s.algorithm = AlgHMACSHA256
+		s.hmacKey = signingKeys[0].Material
+	case AlgEd25519:
+		if len(signingKeys[0].Material) != ed25519.SeedSize {
+			return nil, errors.New("MESSAGE_SIGNING_KEYS ed25519 key must be 32 bytes seed")
+		}
+		s.algorithm = AlgEd25519
+		s.privateKey = ed25519.NewKeyFromSeed(signingKeys[0].Material)
+	default:
+		return nil, fmt.Errorf("unsupported MESSAGE_SIGNING_ALGORITHM %q", cfg.MessageSigningAlgorithm)
+	}
+
+	encryptionKeys, err := ParseKeys(cfg.MessageEncryptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MESSAGE_ENCRYPTION_KEYS: %w", err)
+	}
+	if len(encryptionKeys) > 0 {
+		if s.aead, err = newAEAD(encryptionKeys[0].Material); err != nil {
+			return nil, fmt.Errorf("invalid MESSAGE_ENCRYPTION_KEYS: %w", err)
+		}
+		s.encryptionKeyID = encryptionKeys[0].ID
+		for _, pattern := range strings.Split(cfg.MessageEncryptedRoutingKeys, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				s.encrypted = append(s.encrypted, pattern)
+			}
+		}
+	}
+	return s, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("aes key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PublicKey returns base64 encoded ed25519 public key which consumers need to verify messages,
+// it is empty for hmac
+func (s *sealer) PublicKey() string {
+	if s.privateKey == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(s.privateKey.Public().(ed25519.PublicKey))
+}
+
+// Seal encrypts body if routing key requires it and adds signature headers
+func (s *sealer) Seal(routingKey string, msg *amqp.Publishing) error {
+	return s.seal(routingKey, msg, s.shouldEncrypt(routingKey))
+}
+
+// SealPrivate encrypts body whenever encryption is enabled and adds signature headers, it is used for messages
+// addressed to single consumer, e.g. RPC replies, whose routing key is queue name rather than topic
+func (s *sealer) SealPrivate(routingKey string, msg *amqp.Publishing) error {
+	return s.seal(routingKey, msg, s.aead != nil)
+}
+
+func (s *sealer) seal(routingKey string, msg *amqp.Publishing, encrypt bool) error {
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	encryptionKeyID := ""
+	if encrypt {
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		msg.Body = s.aead.Seal(nonce, nonce, msg.Body, []byte(routingKey))
+		encryptionKeyID = s.encryptionKeyID
+		msg.Headers[HeaderEncryption] = EncAES256GCM
+		msg.Headers[HeaderEncryptionKeyID] = encryptionKeyID
+	}
+
+	signedAt := s.now().Unix()
+	input := signingInput(s.keyID, signedAt, routingKey, msg.ContentType, encryptionKeyID, msg.Body)
+	var signature []byte
+	if s.algorithm == AlgEd25519 {
+		signature = ed25519.Sign(s.privateKey, input)
+	} else {
+		mac := hmac.New(sha256.New, s.hmacKey)
+		mac.Write(input)
+		signature = mac.Sum(nil)
+	}
+	msg.Headers[HeaderSignature] = base64.StdEncoding.EncodeToString(signature)
+	msg.Headers[HeaderSignatureAlg] = s.algorithm
+	msg.Headers[HeaderSignatureKeyID] = s.keyID
+	msg.Headers[HeaderSignedAt] = signedAt
+	return nil
+}
+
+// shouldEncrypt reports whether routing key matches encrypted patterns, legacy <topic>.plain messages
+// hold bare id only and are read by consumers which can't decrypt, so they are never encrypted
+func (s *sealer) shouldEncrypt(routingKey string) bool {
+	if s.aead == nil || strings.HasSuffix(routingKey, ".plain") {
+		return false
+	}
+	for _, pattern := range s.encrypted {
+		if matchTopic(pattern, routingKey) {
+			return true
+		}
+	}
+	return false
+}
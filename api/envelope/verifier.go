@@ -0,0 +1,116 @@
+package envelope
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+var (
+	ErrUnsigned         = errors.New("message is not signed")
+	ErrUnknownKey       = errors.New("message is signed or encrypted with unknown key")
+	ErrInvalidSignature = errors.New("message signature is invalid")
+	ErrExpired          = errors.New("message signature is too old")
+)
+
+type Verifier interface {
+	Open(d amqp.Delivery) ([]byte, error)
+}
+
+// verifier is helper for consumers of user events, it accepts messages signed by any of known keys
+// with configured algorithm and decrypts encrypted bodies
+type verifier struct {
+	algorithm      string
+	keys           map[string][]byte
+	decryptionKeys map[string]cipher.AEAD
+	maxAge         time.Duration
+	now            func() time.Time
+}
+
+// NewVerifier creates verifier for algorithm, verification keys are hmac secrets or ed25519 public keys.
+// Decryption keys may be empty if consumer does not receive encrypted messages, maxAge of zero disables age check
+func NewVerifier(algorithm string, keys []Key, decryptionKeys []Key, maxAge time.Duration) (*verifier, error) {
+	v := &verifier{
+		algorithm:      algorithm,
+		keys:           map[string][]byte{},
+		decryptionKeys: map[string]cipher.AEAD{},
+		maxAge:         maxAge,
+		now:            time.Now,
+	}
+	if algorithm != AlgHMACSHA256 && algorithm != AlgEd25519 {
+		return nil, fmt.Errorf("unsupported signature algorithm %q", algorithm)
+	}
+	for _, key := range keys {
+		if algorithm == AlgEd25519 && len(key.Material) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("ed25519 public key %q must be 32 bytes", key.ID)
+		}
+		v.keys[key.ID] = key.Material
+	}
+	for _, key := range decryptionKeys {
+		aead, err := newAEAD(key.Material)
+		if err != nil {
+			return nil, fmt.Errorf("decryption key %q: %w", key.ID, err)
+		}
+		v.decryptionKeys[key.ID] = aead
+	}
+	return v, nil
+}
+
+// Open verifies signature of delivery and returns its body, decrypted if it is encrypted
+func (v *verifier) Open(d amqp.Delivery) ([]byte, error) {
+	encoded, _ := d.Headers[HeaderSignature].(string)
+	algorithm, _ := d.Headers[HeaderSignatureAlg].(string)
+	keyID, _ := d.Headers[HeaderSignatureKeyID].(string)
+	signedAt, ok := d.Headers[HeaderSignedAt].(int64)
+	if encoded == "" || keyID == "" || !ok {
+		return nil, ErrUnsigned
+	}
+	if algorithm != v.algorithm {
+		return nil, fmt.Errorf("%w: unexpected algorithm %q", ErrInvalidSignature, algorithm)
+	}
+	key, ok := v.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	encryptionKeyID, _ := d.Headers[HeaderEncryptionKeyID].(string)
+	input := signingInput(keyID, signedAt, d.RoutingKey, d.ContentType, encryptionKeyID, d.Body)
+	if algorithm == AlgEd25519 {
+		ok = ed25519.Verify(key, input, signature)
+	} else {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(input)
+		ok = hmac.Equal(mac.Sum(nil), signature)
+	}
+	if !ok {
+		return nil, ErrInvalidSignature
+	}
+	if v.maxAge > 0 && v.now().Sub(time.Unix(signedAt, 0)) > v.maxAge {
+		return nil, ErrExpired
+	}
+
+	if encryptionKeyID == "" {
+		return d.Body, nil
+	}
+	if encryption, _ := d.Headers[HeaderEncryption].(string); encryption != EncAES256GCM {
+		return nil, fmt.Errorf("unsupported encryption %q", encryption)
+	}
+	aead, ok := v.decryptionKeys[encryptionKeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, encryptionKeyID)
+	}
+	if len(d.Body) < aead.NonceSize() {
+		return nil, errors.New("encrypted body is too short")
+	}
+	nonce, ciphertext := d.Body[:aead.NonceSize()], d.Body[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(d.RoutingKey))
+}
@@ -0,0 +1,99 @@
+package event
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	SpecVersion = "1.0"
+	// ContentType is used for events published in CloudEvents structured mode
+	ContentType = "application/cloudevents+json"
+)
+
+// Event is CloudEvents 1.0 envelope in structured JSON format, subject holds id of changed entity
+type Event struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	Subject         string          `json:"subject"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// Change holds field value before and after update
+type Change struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// New builds event with unique id and current time, data is marshalled to JSON
+func New(eventType string, source string, subject string, data any) (Event, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		SpecVersion:     SpecVersion,
+		ID:              uuid.NewString(),
+		Type:            eventType,
+		Source:          source,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            body,
+	}, nil
+}
+
+// Parse decodes structured CloudEvent, ok is false when payload is not an event,
+// e.g. bare id written before events were introduced
+func Parse(payload string) (Event, bool) {
+	var e Event
+	if err := json.Unmarshal([]byte(payload), &e); err != nil || e.SpecVersion == "" {
+		return Event{}, false
+	}
+	return e, true
+}
+
+// Diff compares JSON representations of before and after and returns changed fields,
+// fields listed in ignore are skipped
+func Diff(before any, after any, ignore ...string) (map[string]Change, error) {
+	b, err := toMap(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := toMap(after)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range ignore {
+		delete(b, field)
+		delete(a, field)
+	}
+
+	changes := map[string]Change{}
+	for field, value := range a {
+		if string(b[field]) != string(value) {
+			changes[field] = Change{Before: b[field], After: value}
+		}
+	}
+	for field, value := range b {
+		if _, ok := a[field]; !ok {
+			changes[field] = Change{Before: value}
+		}
+	}
+	return changes, nil
+}
+
+func toMap(v any) (map[string]json.RawMessage, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]json.RawMessage{}
+	err = json.Unmarshal(body, &m)
+	return m, err
+}
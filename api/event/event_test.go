@@ -0,0 +1,49 @@
+package event
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type entity struct {
+	Name    string `json:"name"`
+	Country string `json:"country"`
+	Secret  string `json:"-"`
+}
+
+func TestNewAndParse(t *testing.T) {
+	e, err := New("user.created", "/users", "id", entity{Name: "name", Secret: "secret"})
+	assert.Nil(t, err)
+
+	body, err := json.Marshal(e)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(body), "secret")
+
+	parsed, ok := Parse(string(body))
+	assert.True(t, ok)
+	assert.Equal(t, e.ID, parsed.ID)
+	assert.Equal(t, "id", parsed.Subject)
+	assert.Equal(t, SpecVersion, parsed.SpecVersion)
+}
+
+func TestParsePlainPayload(t *testing.T) {
+	_, ok := Parse("0b9b1b7e-1b7e-4c7e-9b1b-7e1b7e4c7e9b")
+	assert.False(t, ok)
+}
+
+func TestDiff(t *testing.T) {
+	changes, err := Diff(entity{Name: "old", Country: "xx"}, entity{Name: "new", Country: "xx"})
+
+	assert.Nil(t, err)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, `"old"`, string(changes["name"].Before.(json.RawMessage)))
+	assert.Equal(t, `"new"`, string(changes["name"].After.(json.RawMessage)))
+}
+
+func TestDiffIgnoresFields(t *testing.T) {
+	changes, err := Diff(entity{Name: "old"}, entity{Name: "new"}, "name")
+
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+}
@@ -1,23 +1,26 @@
 package api
 
 import (
+	"context"
 	"github.com/go-chi/chi/middleware"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
 )
 
-// LoggerWithLevel logger middleware implementation for chi
+// LoggerWithLevel logger middleware implementation for chi, remote ip is stored in request context for other handlers,
+// requests denied by Authorize are logged with warn level together with denial details
 func LoggerWithLevel(level log.Level) func(h http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			reqID := middleware.GetReqID(r.Context())
 			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			extraFields := log.Fields{}
+			remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				remoteIP = r.RemoteAddr
+			}
 			defer func() {
-				remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
-				if err != nil {
-					remoteIP = r.RemoteAddr
-				}
 				scheme := "http"
 				if r.TLS != nil {
 					scheme = "https"
@@ -31,12 +34,29 @@ func LoggerWithLevel(level log.Level) func(h http.Handler) http.Handler {
 				if len(reqID) > 0 {
 					fields["request_id"] = reqID
 				}
-				log.WithFields(fields).Logf(level, "%s://%s%s", scheme, r.Host, r.RequestURI)
+				entryLevel := level
+				if _, denied := extraFields["denied_action"]; denied {
+					entryLevel = log.WarnLevel
+				}
+				log.WithFields(fields).WithFields(extraFields).Logf(entryLevel, "%s://%s%s", scheme, r.Host, r.RequestURI)
 			}()
 
-			h.ServeHTTP(ww, r)
+			ctx := context.WithValue(r.Context(), "log_fields", extraFields)
+			ctx = context.WithValue(ctx, "remote_ip", remoteIP)
+			h.ServeHTTP(ww, r.WithContext(ctx))
 		}
 
 		return http.HandlerFunc(fn)
 	}
 }
+
+// addLogFields attaches fields to request log line written by LoggerWithLevel
+func addLogFields(r *http.Request, fields log.Fields) {
+	extraFields, ok := r.Context().Value("log_fields").(log.Fields)
+	if !ok {
+		return
+	}
+	for k, v := range fields {
+		extraFields[k] = v
+	}
+}
@@ -0,0 +1,18 @@
+package outbox
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// Message holds event waiting in outbox table to be published to RabbitMQ,
+// it is written in the same transaction as the change it describes.
+// Aggregate is id of changed entity, messages of one aggregate are published in order
+type Message struct {
+	ID        uuid.UUID
+	Topic     string
+	Payload   string
+	Aggregate string
+	CreatedAt time.Time
+	Attempts  int
+}
@@ -0,0 +1,100 @@
+package outbox
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/event"
+	"golang-demo/config"
+	"time"
+)
+
+type Publisher interface {
+	PublishMessage(queue string, body string) error
+	PublishEvent(queue string, body string) error
+}
+
+type relay struct {
+	repository Repository
+	publisher  Publisher
+	interval   time.Duration
+	batchSize  int
+	retention  time.Duration
+	legacy     bool
+}
+
+func NewRelay(repository Repository, publisher Publisher, cfg config.Config) *relay {
+	r := &relay{
+		repository: repository,
+		publisher:  publisher,
+		interval:   cfg.OutboxPollInterval,
+		batchSize:  cfg.OutboxBatchSize,
+		retention:  cfg.OutboxRetention,
+		legacy:     cfg.EventLegacyPlain,
+	}
+	if r.interval <= 0 {
+		r.interval = time.Second
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = 100
+	}
+	if r.retention <= 0 {
+		r.retention = 24 * time.Hour
+	}
+	return r
+}
+
+// publish sends message as CloudEvent, with legacy format enabled bare entity id is also sent
+// with <topic>.plain routing key for consumers which are not migrated yet.
+// Messages written before events were introduced hold bare id and are sent as is
+func (r *relay) publish(m Message) error {
+	e, ok := event.Parse(m.Payload)
+	if !ok {
+		return r.publisher.PublishMessage(m.Topic, m.Payload)
+	}
+	if err := r.publisher.PublishEvent(m.Topic, m.Payload); err != nil {
+		return err
+	}
+	if r.legacy {
+		return r.publisher.PublishMessage(m.Topic+".plain", e.Subject)
+	}
+	return nil
+}
+
+// Run publishes pending outbox messages until ctx is cancelled, delivery is at-least-once:
+// message may be published again if marking it as sent fails
+func (r *relay) Run(ctx context.Context) {
+	log.Infoln("outbox relay started")
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+	for {
+		for {
+			n, err := r.repository.Process(r.batchSize, func(m Message) error {
+				return r.publish(m)
+			})
+			if err != nil {
+				log.Errorln("failed to relay outbox messages", err)
+			}
+			// keep draining while messages are claimed, next message of aggregate is claimed only after previous one is sent
+			if err != nil || n == 0 || ctx.Err() != nil {
+				break
+			}
+		}
+
+		if time.Since(lastCleanup) > time.Hour {
+			lastCleanup = time.Now()
+			if n, err := r.repository.DeleteSent(time.Now().Add(-r.retention)); err != nil {
+				log.Errorln("failed to clean up outbox", err)
+			} else if n > 0 {
+				log.Infoln("removed sent outbox messages", n)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Infoln("outbox relay stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package outbox
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/event"
+	"golang-demo/config"
+	"testing"
+)
+
+type publisherMock struct {
+	messages []string
+	events   []string
+}
+
+func (p *publisherMock) PublishMessage(queue string, body string) error {
+	p.messages = append(p.messages, queue+" "+body)
+	return nil
+}
+
+func (p *publisherMock) PublishEvent(queue string, _ string) error {
+	p.events = append(p.events, queue)
+	return nil
+}
+
+func TestPublishLegacyPlain(t *testing.T) {
+	publisher := &publisherMock{}
+	r := NewRelay(nil, publisher, config.Config{EventLegacyPlain: true})
+
+	e, err := event.New("user.created", "/users", "id", nil)
+	assert.Nil(t, err)
+	body, err := json.Marshal(e)
+	assert.Nil(t, err)
+
+	assert.Nil(t, r.publish(Message{Topic: "user.created", Payload: string(body)}))
+	assert.Equal(t, []string{"user.created"}, publisher.events)
+	assert.Equal(t, []string{"user.created.plain id"}, publisher.messages)
+}
+
+func TestPublishBareID(t *testing.T) {
+	publisher := &publisherMock{}
+	r := NewRelay(nil, publisher, config.Config{})
+
+	assert.Nil(t, r.publish(Message{Topic: "user.deleted", Payload: "id"}))
+	assert.Empty(t, publisher.events)
+	assert.Equal(t, []string{"user.deleted id"}, publisher.messages)
+}
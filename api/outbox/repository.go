@@ -0,0 +1,147 @@
+package outbox
+
+import (
+	"database/sql"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"golang-demo/api/event"
+	"time"
+)
+
+type Repository interface {
+	Process(limit int, fn func(message Message) error) (int, error)
+	DeleteSent(before time.Time) (int64, error)
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *repository {
+	return &repository{db}
+}
+
+var psql sq.StatementBuilderType
+
+func init() {
+	psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+}
+
+// Insert adds message to outbox, runner is transaction of the change described by message
+func Insert(runner sq.BaseRunner, message Message) error {
+	if message.Aggregate == "" {
+		message.Aggregate = aggregate(message.Payload)
+	}
+	_, err := psql.Insert("outbox").SetMap(map[string]interface{}{
+		"topic":     message.Topic,
+		"payload":   message.Payload,
+		"aggregate": message.Aggregate,
+	}).RunWith(runner).Exec()
+	return err
+}
+
+// aggregate returns id of entity described by payload, it is subject of event or bare id in old messages
+func aggregate(payload string) string {
+	if e, ok := event.Parse(payload); ok {
+		return e.Subject
+	}
+	return payload
+}
+
+// backoff returns delay before next publish attempt, it grows exponentially up to 5 minutes
+func backoff(attempts int) time.Duration {
+	if attempts >= 9 {
+		return 5 * time.Minute
+	}
+	delay := time.Second << attempts
+	if delay > 5*time.Minute {
+		return 5 * time.Minute
+	}
+	return delay
+}
+
+// claimTimeout is how long claimed message is hidden from other relays,
+// it is published again after that if relay stopped before marking it
+const claimTimeout = time.Minute
+
+// Process claims batch of pending messages and calls fn for each of them,
+// message is marked as sent when fn succeeds or scheduled for retry otherwise.
+// Rows are claimed in short transaction and fn is called outside of it, so no locks are held while publishing.
+// Only the oldest pending message of every aggregate is claimed, later messages wait until it is sent,
+// so events of one entity are published in order even when publish fails and several relays run concurrently
+func (r *repository) Process(limit int, fn func(message Message) error) (int, error) {
+	messages, err := r.claim(limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range messages {
+		if publishErr := fn(m); publishErr != nil {
+			_, err = psql.Update("outbox").SetMap(map[string]interface{}{
+				"attempts":        m.Attempts + 1,
+				"next_attempt_at": time.Now().Add(backoff(m.Attempts)),
+				"last_error":      publishErr.Error(),
+			}).Where(sq.Eq{"id": m.ID}).RunWith(r.db).Exec()
+		} else {
+			_, err = psql.Update("outbox").Set("sent_at", time.Now()).Where(sq.Eq{"id": m.ID}).RunWith(r.db).Exec()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(messages), nil
+}
+
+// claim locks batch of pending messages and postpones their next attempt by claimTimeout,
+// locked rows are skipped, so concurrent relays claim different messages
+func (r *repository) claim(limit int) ([]Message, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := psql.Select("id", "topic", "payload", "aggregate", "created_at", "attempts").From("outbox").
+		Where(sq.Eq{"sent_at": nil}).Where("next_attempt_at <= now()").
+		Where("NOT EXISTS (SELECT 1 FROM outbox earlier WHERE earlier.aggregate = outbox.aggregate " +
+			"AND earlier.sent_at IS NULL AND earlier.created_at < outbox.created_at)").
+		OrderBy("created_at").Limit(uint64(limit)).Suffix("FOR UPDATE SKIP LOCKED").
+		RunWith(tx).Query()
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	var ids []uuid.UUID
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.Topic, &m.Payload, &m.Aggregate, &m.CreatedAt, &m.Attempts); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, m)
+		ids = append(ids, m.ID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	_, err = psql.Update("outbox").Set("next_attempt_at", time.Now().Add(claimTimeout)).
+		Where(sq.Eq{"id": ids}).RunWith(tx).Exec()
+	if err != nil {
+		return nil, err
+	}
+	return messages, tx.Commit()
+}
+
+// DeleteSent removes messages sent before given time
+func (r *repository) DeleteSent(before time.Time) (int64, error) {
+	res, err := psql.Delete("outbox").Where(sq.NotEq{"sent_at": nil}).Where(sq.Lt{"sent_at": before}).RunWith(r.db).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
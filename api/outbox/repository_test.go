@@ -0,0 +1,120 @@
+package outbox
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/event"
+	"testing"
+	"time"
+)
+
+func DbMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sqldb, mock
+}
+
+func TestInsertMessage(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO outbox \\(aggregate,payload,topic\\) VALUES (.+)").
+		WithArgs("id", "id", "user_create").WillReturnResult(sqlmock.NewResult(1, 1))
+	err := Insert(db, Message{Topic: "user_create", Payload: "id"})
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMarksSent(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	id := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM outbox WHERE (.+) AND NOT EXISTS (.+) FOR UPDATE SKIP LOCKED").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "payload", "aggregate", "created_at", "attempts"}).
+			AddRow(id, "user_create", "id", "id", time.Now(), 0))
+	mock.ExpectExec("UPDATE outbox SET next_attempt_at = (.+) WHERE id IN (.+)").
+		WithArgs(sqlmock.AnyArg(), id).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("UPDATE outbox SET sent_at = (.+) WHERE id = (.+)").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var published []string
+	n, err := repo.Process(10, func(m Message) error {
+		published = append(published, m.Topic)
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"user_create"}, published)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessSchedulesRetry(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	id := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM outbox WHERE (.+) FOR UPDATE SKIP LOCKED").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "payload", "aggregate", "created_at", "attempts"}).
+			AddRow(id, "user_update", "id", "id", time.Now(), 2))
+	mock.ExpectExec("UPDATE outbox SET next_attempt_at = (.+) WHERE id IN (.+)").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("UPDATE outbox SET attempts = (.+), last_error = (.+), next_attempt_at = (.+) WHERE id = (.+)").
+		WithArgs(3, "broker unavailable", sqlmock.AnyArg(), id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	_, err := repo.Process(10, func(m Message) error {
+		return errors.New("broker unavailable")
+	})
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessEmptyBatch(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM outbox WHERE (.+) FOR UPDATE SKIP LOCKED").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "payload", "aggregate", "created_at", "attempts"}))
+	mock.ExpectRollback()
+
+	n, err := repo.Process(10, func(m Message) error {
+		t.Fatal("nothing to publish")
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAggregate(t *testing.T) {
+	e, err := event.New("user.created", "/users", "id", nil)
+	assert.Nil(t, err)
+	body, err := json.Marshal(e)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "id", aggregate(string(body)))
+	assert.Equal(t, "id", aggregate("id"))
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, backoff(0))
+	assert.Equal(t, 8*time.Second, backoff(3))
+	assert.Equal(t, 5*time.Minute, backoff(20))
+}
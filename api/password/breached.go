@@ -0,0 +1,157 @@
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type BreachedList interface {
+	Contains(password string) (bool, error)
+}
+
+// OpenBreachedList opens breached passwords list, path is either sorted hash file or directory of range files
+func OpenBreachedList(path string) (BreachedList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &breachedRanges{dir: path}, nil
+	}
+	return openBreachedFile(path)
+}
+
+// sha1Hex returns uppercase hex SHA-1 of password as used by HIBP
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// breachedRanges searches directory of HIBP range files, file named by the first 5 hex digits of SHA-1
+// (optionally with .txt extension) holds "SUFFIX:COUNT" lines of the remaining 35 digits.
+// Full dump has file for every prefix, so missing file is reported as error
+type breachedRanges struct {
+	dir string
+}
+
+func (b *breachedRanges) Contains(password string) (bool, error) {
+	hash := sha1Hex(password)
+	prefix, suffix := hash[:5], hash[5:]
+	file, err := os.Open(filepath.Join(b.dir, prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		file, err = os.Open(filepath.Join(b.dir, prefix+".txt"))
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		candidate, _, _ := strings.Cut(scanner.Text(), ":")
+		if strings.EqualFold(strings.TrimSpace(candidate), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// breachedList searches sorted file of uppercase SHA-1 hashes with optional occurrence count,
+// one "HASH:COUNT" per line as in HIBP offline dump ordered by hash. File is not loaded in memory
+type breachedList struct {
+	file *os.File
+	size int64
+}
+
+func openBreachedFile(path string) (*breachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &breachedList{file: file, size: info.Size()}, nil
+}
+
+// Contains binary searches file for SHA-1 hash of password
+func (b *breachedList) Contains(password string) (bool, error) {
+	target := []byte(sha1Hex(password))
+
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, err := b.lineStart(mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		line, next, err := b.readLine(start)
+		if err != nil {
+			return false, err
+		}
+		hash, _, _ := bytes.Cut(line, []byte(":"))
+		switch bytes.Compare(bytes.ToUpper(bytes.TrimSpace(hash)), target) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// lineStart returns offset of first line starting at or after offset
+func (b *breachedList) lineStart(offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, 128)
+	for pos := offset - 1; pos < b.size; pos += int64(len(buf)) {
+		n, err := b.file.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return b.size, nil
+}
+
+// readLine returns line at offset without trailing newline and offset of next line
+func (b *breachedList) readLine(offset int64) ([]byte, int64, error) {
+	var line []byte
+	buf := make([]byte, 128)
+	for pos := offset; pos < b.size; pos += int64(len(buf)) {
+		n, err := b.file.ReadAt(buf, pos)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return append(line, buf[:i]...), pos + int64(i) + 1, nil
+		}
+		line = append(line, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return line, b.size, nil
+}
@@ -0,0 +1,147 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang-demo/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+type Hasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, encoded string) (bool, bool, error)
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	keyLen  uint32
+	saltLen int
+}
+
+type hasher struct {
+	algorithm  string
+	bcryptCost int
+	argon2     argon2Params
+}
+
+// NewHasher creates hasher which produces hashes in PHC string format with algorithm and parameters from config,
+// both bcrypt and argon2id hashes are accepted by Verify regardless of configured algorithm.
+// bcrypt has no PHC encoding, its hashes are kept in the modular crypt format ($2b$cost$salthash) every bcrypt library reads
+func NewHasher(cfg config.Config) (*hasher, error) {
+	h := &hasher{
+		algorithm:  cfg.PasswordHashAlgorithm,
+		bcryptCost: cfg.PasswordBcryptCost,
+		argon2: argon2Params{
+			memory:  cfg.PasswordArgon2Memory,
+			time:    cfg.PasswordArgon2Time,
+			threads: cfg.PasswordArgon2Threads,
+			keyLen:  32,
+			saltLen: 16,
+		},
+	}
+	if h.algorithm == "" {
+		h.algorithm = "argon2id"
+	}
+	if h.algorithm != "argon2id" && h.algorithm != "bcrypt" {
+		return nil, fmt.Errorf("unsupported PASSWORD_HASH_ALGORITHM %q", h.algorithm)
+	}
+	if h.bcryptCost == 0 {
+		h.bcryptCost = bcrypt.DefaultCost
+	}
+	if h.bcryptCost < bcrypt.MinCost || h.bcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("PASSWORD_BCRYPT_COST must be from %d to %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if h.argon2.memory == 0 {
+		h.argon2.memory = 64 * 1024
+	}
+	if h.argon2.time == 0 {
+		h.argon2.time = 1
+	}
+	if h.argon2.threads == 0 {
+		h.argon2.threads = 2
+	}
+	return h, nil
+}
+
+// Hash hashes password with configured algorithm
+func (h *hasher) Hash(password string) (string, error) {
+	if h.algorithm == "bcrypt" {
+		bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+		return string(bytes), err
+	}
+
+	salt := make([]byte, h.argon2.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.argon2.time, h.argon2.memory, h.argon2.threads, h.argon2.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.argon2.memory, h.argon2.time, h.argon2.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks password against encoded hash, second value reports whether hash
+// was made with other algorithm or parameters than configured and should be replaced.
+// Values without hash prefix are legacy plaintext passwords, they are compared in constant time and always need rehash
+func (h *hasher) Verify(password string, encoded string) (bool, bool, error) {
+	switch {
+	case !strings.HasPrefix(encoded, "$"):
+		// hashes of equal length are compared so length of stored password is not revealed
+		actual, expected := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(encoded))
+		return subtle.ConstantTimeCompare(actual[:], expected[:]) == 1, true, nil
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return h.verifyArgon2(password, encoded)
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return true, h.algorithm != "bcrypt" || cost != h.bcryptCost, err
+	default:
+		return false, false, ErrUnknownHashFormat
+	}
+}
+
+func (h *hasher) verifyArgon2(password string, encoded string) (bool, bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, ErrUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, ErrUnknownHashFormat
+	}
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return false, false, nil
+	}
+	outdated := h.algorithm != "argon2id" || p.memory != h.argon2.memory || p.time != h.argon2.time ||
+		p.threads != h.argon2.threads || uint32(len(key)) != h.argon2.keyLen || len(salt) != h.argon2.saltLen
+	return true, outdated, nil
+}
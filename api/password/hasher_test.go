@@ -0,0 +1,62 @@
+package password
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang-demo/config"
+	"strings"
+	"testing"
+)
+
+func TestArgon2idHash(t *testing.T) {
+	h, err := NewHasher(config.Config{PasswordHashAlgorithm: "argon2id", PasswordArgon2Memory: 1024})
+	assert.Nil(t, err)
+
+	encoded, err := h.Hash("supersecurepassword")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=2$"))
+
+	ok, rehash, err := h.Verify("supersecurepassword", encoded)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, rehash)
+
+	ok, _, err = h.Verify("wrongpassword", encoded)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestOutdatedHashNeedsRehash(t *testing.T) {
+	bcryptHasher, _ := NewHasher(config.Config{PasswordHashAlgorithm: "bcrypt", PasswordBcryptCost: 4})
+	argonHasher, _ := NewHasher(config.Config{PasswordHashAlgorithm: "argon2id", PasswordArgon2Memory: 1024})
+	strongerArgonHasher, _ := NewHasher(config.Config{PasswordHashAlgorithm: "argon2id", PasswordArgon2Memory: 2048})
+
+	bcryptHash, _ := bcryptHasher.Hash("supersecurepassword")
+	ok, rehash, err := argonHasher.Verify("supersecurepassword", bcryptHash)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	argonHash, _ := argonHasher.Hash("supersecurepassword")
+	ok, rehash, err = strongerArgonHasher.Verify("supersecurepassword", argonHash)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+}
+
+func TestLegacyPlaintextPassword(t *testing.T) {
+	h, _ := NewHasher(config.Config{})
+	ok, rehash, err := h.Verify("supersecurepassword", "supersecurepassword")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	ok, _, err = h.Verify("wrongpassword", "supersecurepassword")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestUnknownHashFormat(t *testing.T) {
+	h, _ := NewHasher(config.Config{})
+	_, _, err := h.Verify("supersecurepassword", "$argon2id$broken")
+	assert.ErrorIs(t, err, ErrUnknownHashFormat)
+}
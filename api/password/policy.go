@@ -0,0 +1,155 @@
+package password
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/config"
+	"strings"
+	"unicode"
+)
+
+// Violation describes single failed password policy rule
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError is returned by services when password does not satisfy policy
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return strings.Join(messages, ";")
+}
+
+type Policy interface {
+	Check(password string, identities ...string) []Violation
+}
+
+type policy struct {
+	minLength      int
+	maxLength      int
+	minCharClasses int
+	maxRepeatedRun int
+	breached       BreachedList
+}
+
+// NewPolicy creates password policy from config, breached passwords list is used only when PASSWORD_BREACHED_FILE is set
+func NewPolicy(cfg config.Config) (*policy, error) {
+	p := &policy{
+		minLength:      cfg.PasswordMinLength,
+		maxLength:      cfg.PasswordMaxLength,
+		minCharClasses: cfg.PasswordMinCharClasses,
+		maxRepeatedRun: cfg.PasswordMaxRepeatedRun,
+	}
+	if p.minLength <= 0 {
+		p.minLength = 8
+	}
+	if p.maxLength <= 0 {
+		p.maxLength = 72
+	}
+	if cfg.PasswordBreachedFile != "" {
+		breached, err := OpenBreachedList(cfg.PasswordBreachedFile)
+		if err != nil {
+			return nil, err
+		}
+		p.breached = breached
+	}
+	return p, nil
+}
+
+// Check validates password against every rule and returns all violations,
+// identities are values which must not be part of password, like nickname or email
+func (p *policy) Check(password string, identities ...string) []Violation {
+	var violations []Violation
+	add := func(rule string, format string, args ...any) {
+		violations = append(violations, Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(password) < p.minLength || len(password) > p.maxLength {
+		add("length", "password must be from %d to %d characters long", p.minLength, p.maxLength)
+	}
+	for _, c := range password {
+		if c > unicode.MaxASCII {
+			add("ascii", "password must contain ascii characters only")
+			break
+		}
+	}
+	if p.minCharClasses > 0 && charClasses(password) < p.minCharClasses {
+		add("char_classes", "password must contain at least %d of lowercase, uppercase, digit and symbol characters", p.minCharClasses)
+	}
+	if p.maxRepeatedRun > 0 && longestRun(password) > p.maxRepeatedRun {
+		add("repeated_run", "password must not repeat the same character more than %d times in a row", p.maxRepeatedRun)
+	}
+	if containsIdentity(password, identities) {
+		add("identity", "password must not contain nickname or email")
+	}
+	if p.breached != nil {
+		// list which can't be read must not block sign-ups, failure is logged for operators instead
+		found, err := p.breached.Contains(password)
+		if err != nil {
+			log.Errorln("failed to check password against breached passwords list", err)
+		}
+		if found {
+			add("breached", "password was found in data breaches, choose another one")
+		}
+	}
+	return violations
+}
+
+func charClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+func longestRun(password string) int {
+	longest, run := 0, 0
+	var prev rune
+	for i, c := range password {
+		if i > 0 && c == prev {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		prev = c
+	}
+	return longest
+}
+
+// containsIdentity checks identities and local part of emails case-insensitively, too short parts are ignored
+func containsIdentity(password string, identities []string) bool {
+	lowered := strings.ToLower(password)
+	for _, identity := range identities {
+		parts := []string{identity}
+		if local, _, found := strings.Cut(identity, "@"); found {
+			parts = append(parts, local)
+		}
+		for _, part := range parts {
+			part = strings.ToLower(part)
+			if len(part) >= 3 && strings.Contains(lowered, part) {
+				return true
+			}
+		}
+	}
+	return false
+}
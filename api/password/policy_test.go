@@ -0,0 +1,74 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func rules(violations []Violation) []string {
+	var names []string
+	for _, v := range violations {
+		names = append(names, v.Rule)
+	}
+	return names
+}
+
+func TestPolicyRules(t *testing.T) {
+	p, err := NewPolicy(config.Config{PasswordMinCharClasses: 3, PasswordMaxRepeatedRun: 2})
+	assert.Nil(t, err)
+
+	assert.Empty(t, p.Check("Correct-Horse7", "alice", "alice@bob.com"))
+	assert.Equal(t, []string{"length"}, rules(p.Check("Ab1!", "alice")))
+	assert.Equal(t, []string{"char_classes"}, rules(p.Check("correcthorse", "alice")))
+	assert.Equal(t, []string{"repeated_run"}, rules(p.Check("Corrrect-Horse7", "alice")))
+	assert.Equal(t, []string{"identity"}, rules(p.Check("MyAlice-2024", "alice")))
+	assert.Equal(t, []string{"identity"}, rules(p.Check("Bob.Alice-2024", "nick", "bob.alice@mail.com")))
+}
+
+func TestBreachedList(t *testing.T) {
+	var lines []string
+	for i := 0; i < 500; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprint("password", i)))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i+1))
+	}
+	sort.Strings(lines)
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	assert.Nil(t, os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600))
+
+	list, err := OpenBreachedList(path)
+	assert.Nil(t, err)
+	for _, i := range []int{0, 1, 250, 499} {
+		found, err := list.Contains(fmt.Sprint("password", i))
+		assert.Nil(t, err)
+		assert.True(t, found, i)
+	}
+	found, err := list.Contains("not-breached-password")
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func TestBreachedRanges(t *testing.T) {
+	dir := t.TempDir()
+	hash := sha1Hex("password1")
+	content := "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n" + hash[5:] + ":42\r\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(content), 0o600))
+
+	list, err := OpenBreachedList(dir)
+	assert.Nil(t, err)
+	found, err := list.Contains("password1")
+	assert.Nil(t, err)
+	assert.True(t, found)
+
+	// range file of other prefix is missing, so list is incomplete
+	found, err = list.Contains("not-breached-password")
+	assert.NotNil(t, err)
+	assert.False(t, found)
+}
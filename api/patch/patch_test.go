@@ -0,0 +1,58 @@
+package patch
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	doc := `{"title": "Goodbye!", "author": {"givenName": "John", "familyName": "Doe"}, "tags": ["example", "sample"]}`
+	patch := `{"title": "Hello!", "phoneNumber": "+01-123-456-7890", "author": {"familyName": null}, "tags": ["example"]}`
+
+	result, err := Merge([]byte(doc), []byte(patch))
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"title": "Hello!", "author": {"givenName": "John"}, "tags": ["example"], "phoneNumber": "+01-123-456-7890"}`, string(result))
+}
+
+func TestMergeInvalidPatch(t *testing.T) {
+	_, err := Merge([]byte(`{}`), []byte(`{"title":`))
+	assert.ErrorIs(t, err, ErrInvalidPatch)
+}
+
+func TestApply(t *testing.T) {
+	doc := `{"foo": ["bar", "baz"], "a/b": 1, "m~n": {"x": 1}}`
+	patch := `[
+		{"op": "test", "path": "/a~1b", "value": 1},
+		{"op": "add", "path": "/foo/1", "value": "qux"},
+		{"op": "add", "path": "/foo/-", "value": null},
+		{"op": "remove", "path": "/foo/0"},
+		{"op": "replace", "path": "/a~1b", "value": 2},
+		{"op": "copy", "from": "/m~0n", "path": "/copy"},
+		{"op": "move", "from": "/m~0n/x", "path": "/moved"}
+	]`
+
+	result, err := Apply([]byte(doc), []byte(patch))
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"foo": ["qux", "baz", null], "a/b": 2, "m~n": {}, "copy": {"x": 1}, "moved": 1}`, string(result))
+}
+
+func TestApplyErrors(t *testing.T) {
+	doc := []byte(`{"foo": ["bar"], "baz": {"qux": 1}}`)
+	for patch, expected := range map[string]error{
+		`[{"op": "test", "path": "/foo/0", "value": "baz"}]`:    ErrTestFailed,
+		`[{"op": "remove", "path": "/missing"}]`:                ErrPathNotFound,
+		`[{"op": "replace", "path": "/foo/01", "value": 1}]`:    ErrPathNotFound,
+		`[{"op": "add", "path": "/missing/child", "value": 1}]`: ErrPathNotFound,
+		`[{"op": "add", "path": "/foo/2", "value": 1}]`:         ErrPathNotFound,
+		`[{"op": "add", "path": "/foo"}]`:                       ErrInvalidPatch,
+		`[{"op": "move", "from": "/baz", "path": "/baz/qux"}]`:  ErrInvalidPatch,
+		`[{"op": "rename", "path": "/foo"}]`:                    ErrInvalidPatch,
+		`[{"op": "remove", "path": "foo"}]`:                     ErrInvalidPatch,
+		`{"op": "remove", "path": "/foo"}`:                      ErrInvalidPatch,
+	} {
+		_, err := Apply(doc, []byte(patch))
+		assert.ErrorIs(t, err, expected, patch)
+	}
+}
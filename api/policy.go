@@ -0,0 +1,38 @@
+package api
+
+import (
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/auth"
+	"net/http"
+)
+
+// Authorize middleware checks that authenticated principal may perform action on user from {userId} url param
+func Authorize(policy auth.Policy, action auth.Action) func(h http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := auth.PrincipalFromContext(r.Context())
+			if !ok {
+				_ = render.Render(w, r, auth.ErrUnauthorized(errors.New("authentication required")))
+				return
+			}
+			target, _ := uuid.Parse(chi.URLParam(r, "userId"))
+			if !policy.Allowed(principal, action, target) {
+				addLogFields(r, log.Fields{
+					"denied_action": string(action),
+					"principal_id":  principal.UserID.String(),
+					"role":          principal.Role,
+					"target_id":     chi.URLParam(r, "userId"),
+				})
+				_ = render.Render(w, r, auth.ErrForbidden(errors.New("not allowed to perform "+string(action))))
+				return
+			}
+			h.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
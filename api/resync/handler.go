@@ -0,0 +1,117 @@
+package resync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"golang-demo/api/auth"
+	"golang-demo/api/user"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+type resyncHandler struct {
+	resyncService Service
+}
+
+func NewResyncHandler(resyncService Service) *resyncHandler {
+	return &resyncHandler{resyncService}
+}
+
+// Store starts resync job, body is optional
+func (handler *resyncHandler) Store(w http.ResponseWriter, r *http.Request) {
+	var input InputJob
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil && !errors.Is(err, io.EOF) {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "rate must be between 1 and 10000"})
+		return
+	}
+
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	job, err := handler.resyncService.Start(input, principal.UserID)
+	if errors.Is(err, ErrAlreadyRunning) {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 409, StatusText: "conflict", Err: err, ErrorText: err.Error()})
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during create", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, user.Response{Data: map[string]any{"message": "successfully started", "created": job}})
+}
+
+// Get paginated resync jobs, the latest first
+func (handler *resyncHandler) Get(w http.ResponseWriter, r *http.Request) {
+	pageSize := 10
+	page := 1
+	if pageStr := r.URL.Query().Get("page"); pageStr != "" {
+		page, _ = strconv.Atoi(pageStr)
+	}
+	if pageSizeStr := r.URL.Query().Get("page_size"); pageSizeStr != "" {
+		pageSize, _ = strconv.Atoi(pageSizeStr)
+	}
+	jobs, totalCount, err := handler.resyncService.Get(page, pageSize)
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: map[string]any{"resync_jobs": jobs, "total_count": totalCount}})
+}
+
+func (handler *resyncHandler) GetByID(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "jobId"))
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+	job, err := handler.resyncService.GetById(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = render.Render(w, r, user.ErrNotFound)
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, user.Response{Data: job})
+}
+
+func (handler *resyncHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	handler.change(w, r, handler.resyncService.Cancel, "cancelled")
+}
+
+func (handler *resyncHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	handler.change(w, r, handler.resyncService.Resume, "resumed")
+}
+
+func (handler *resyncHandler) change(w http.ResponseWriter, r *http.Request, fn func(id uuid.UUID, actorID uuid.UUID) error, result string) {
+	id, err := uuid.Parse(chi.URLParam(r, "jobId"))
+	if err != nil {
+		_ = render.Render(w, r, user.ErrInvalidRequest(err))
+		return
+	}
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	err = fn(id, principal.UserID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_ = render.Render(w, r, user.ErrNotFound)
+	case errors.Is(err, ErrNotRunning), errors.Is(err, ErrNotResumable), errors.Is(err, ErrAlreadyRunning):
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 409, StatusText: "conflict", Err: err, ErrorText: err.Error()})
+	case err != nil:
+		_ = render.Render(w, r, &user.ErrResponse{HTTPStatusCode: 400, StatusText: "error during update", Err: err, ErrorText: err.Error()})
+	default:
+		render.JSON(w, r, user.Response{Data: map[string]string{"message": "successfully " + result}})
+	}
+}
@@ -0,0 +1,35 @@
+package resync
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Job publishes snapshot of every user ordered by id, LastID is keyset cursor of the last published page.
+// Total is number of users when job was started, so progress may exceed 100% if users are created meanwhile
+type Job struct {
+	ID          uuid.UUID  `json:"id"`
+	Status      string     `json:"status"`
+	RoutingKey  string     `json:"routing_key"`
+	Rate        int        `json:"rate"`
+	Total       int64      `json:"total"`
+	Published   int64      `json:"published"`
+	Progress    float64    `json:"progress"`
+	LastID      uuid.UUID  `json:"last_id"`
+	Error       *string    `json:"error"`
+	RequestedBy uuid.UUID  `json:"requested_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+}
+
+type InputJob struct {
+	Rate int `json:"rate" validate:"omitempty,min=1,max=10000"`
+}
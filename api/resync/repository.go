@@ -0,0 +1,201 @@
+package resync
+
+import (
+	"database/sql"
+	"errors"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAlreadyRunning = errors.New("resync job is already running")
+	ErrNotRunning     = errors.New("resync job is not running")
+	ErrNotResumable   = errors.New("only failed or cancelled resync job may be resumed")
+)
+
+type Repository interface {
+	Insert(routingKey string, rate int, total int64, requestedBy uuid.UUID) (Job, error)
+	Select(offset int, limit int) ([]Job, int64, error)
+	SelectById(id uuid.UUID) (Job, error)
+	Claim(leaseUntil time.Time) (Job, error)
+	Checkpoint(id uuid.UUID, lastID uuid.UUID, published int64, leaseUntil time.Time) error
+	Finish(id uuid.UUID, status string, jobErr error) error
+	Cancel(id uuid.UUID) error
+	Resume(id uuid.UUID) error
+}
+
+type repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *repository {
+	return &repository{db}
+}
+
+var psql sq.StatementBuilderType
+
+func init() {
+	psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+}
+
+var columns = []string{"id", "status", "routing_key", "rate", "total", "published", "last_id", "error", "requested_by",
+	"created_at", "updated_at", "finished_at"}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row scanner) (Job, error) {
+	var j Job
+	var errText sql.NullString
+	var finishedAt sql.NullTime
+	err := row.Scan(&j.ID, &j.Status, &j.RoutingKey, &j.Rate, &j.Total, &j.Published, &j.LastID, &errText, &j.RequestedBy,
+		&j.CreatedAt, &j.UpdatedAt, &finishedAt)
+	if err != nil {
+		return j, err
+	}
+	if errText.Valid {
+		j.Error = &errText.String
+	}
+	if finishedAt.Valid {
+		j.FinishedAt = &finishedAt.Time
+	}
+	if j.Total > 0 {
+		j.Progress = float64(j.Published) * 100 / float64(j.Total)
+	} else if j.Status == StatusCompleted {
+		j.Progress = 100
+	}
+	return j, nil
+}
+
+// isRunningConflict reports violation of unique index which allows only one running job
+func isRunningConflict(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func (r *repository) Insert(routingKey string, rate int, total int64, requestedBy uuid.UUID) (Job, error) {
+	row := psql.Insert("resync_jobs").SetMap(map[string]interface{}{
+		"routing_key":  routingKey,
+		"rate":         rate,
+		"total":        total,
+		"requested_by": requestedBy,
+	}).Suffix("RETURNING " + strings.Join(columns, ", ")).RunWith(r.db).QueryRow()
+	j, err := scanJob(row)
+	if isRunningConflict(err) {
+		return j, ErrAlreadyRunning
+	}
+	return j, err
+}
+
+func (r *repository) Select(offset int, limit int) ([]Job, int64, error) {
+	jobs := []Job{}
+	var totalCount int64
+	err := psql.Select("count(1) AS total").From("resync_jobs").RunWith(r.db).QueryRow().Scan(&totalCount)
+	if err != nil {
+		return jobs, totalCount, err
+	}
+	rows, err := psql.Select(columns...).From("resync_jobs").OrderBy("created_at DESC").
+		Offset(uint64(offset)).Limit(uint64(limit)).RunWith(r.db).Query()
+	if err != nil {
+		return jobs, totalCount, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return jobs, totalCount, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, totalCount, rows.Err()
+}
+
+func (r *repository) SelectById(id uuid.UUID) (Job, error) {
+	row := psql.Select(columns...).From("resync_jobs").Where(sq.Eq{"id": id}).RunWith(r.db).QueryRow()
+	return scanJob(row)
+}
+
+// Claim takes running job whose lease is expired, e.g. new job or job of crashed instance,
+// and leases it until leaseUntil. sql.ErrNoRows is returned when there is nothing to run
+func (r *repository) Claim(leaseUntil time.Time) (Job, error) {
+	row := psql.Update("resync_jobs").SetMap(map[string]interface{}{
+		"lease_until": leaseUntil,
+		"updated_at":  time.Now(),
+	}).Where(sq.Expr("id = (SELECT id FROM resync_jobs WHERE status = ? AND (lease_until IS NULL OR lease_until < now()) "+
+		"ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED)", StatusRunning)).
+		Suffix("RETURNING " + strings.Join(columns, ", ")).RunWith(r.db).QueryRow()
+	return scanJob(row)
+}
+
+// Checkpoint stores cursor and progress of running job and extends its lease,
+// ErrNotRunning is returned when job was cancelled meanwhile
+func (r *repository) Checkpoint(id uuid.UUID, lastID uuid.UUID, published int64, leaseUntil time.Time) error {
+	return r.updateRunning(id, map[string]interface{}{
+		"last_id":     lastID,
+		"published":   published,
+		"lease_until": leaseUntil,
+		"updated_at":  time.Now(),
+	})
+}
+
+func (r *repository) Finish(id uuid.UUID, status string, jobErr error) error {
+	var errText *string
+	if jobErr != nil {
+		text := jobErr.Error()
+		errText = &text
+	}
+	now := time.Now()
+	return r.updateRunning(id, map[string]interface{}{
+		"status":      status,
+		"error":       errText,
+		"lease_until": nil,
+		"updated_at":  now,
+		"finished_at": now,
+	})
+}
+
+func (r *repository) Cancel(id uuid.UUID) error {
+	return r.Finish(id, StatusCancelled, nil)
+}
+
+// Resume sets failed or cancelled job running again, it continues from the stored cursor
+func (r *repository) Resume(id uuid.UUID) error {
+	res, err := psql.Update("resync_jobs").SetMap(map[string]interface{}{
+		"status":      StatusRunning,
+		"error":       nil,
+		"lease_until": nil,
+		"updated_at":  time.Now(),
+		"finished_at": nil,
+	}).Where(sq.Eq{"id": id, "status": []string{StatusFailed, StatusCancelled}}).RunWith(r.db).Exec()
+	if isRunningConflict(err) {
+		return ErrAlreadyRunning
+	}
+	if err != nil {
+		return err
+	}
+	return expectRow(res, ErrNotResumable)
+}
+
+func (r *repository) updateRunning(id uuid.UUID, values map[string]interface{}) error {
+	res, err := psql.Update("resync_jobs").SetMap(values).
+		Where(sq.Eq{"id": id, "status": StatusRunning}).RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	return expectRow(res, ErrNotRunning)
+}
+
+func expectRow(res sql.Result, noRowErr error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return noRowErr
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package resync
+
+import (
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func DbMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	sqldb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sqldb, mock
+}
+
+func TestClaimJob(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	lastID := uuid.New()
+	rows := sqlmock.NewRows(columns).AddRow(uuid.New(), StatusRunning, "user.snapshot", 100, 10, 4, lastID, nil, uuid.New(),
+		time.Now(), time.Now(), nil)
+	mock.ExpectQuery("UPDATE resync_jobs SET lease_until = (.+) WHERE id = \\(SELECT id FROM resync_jobs WHERE status = (.+) " +
+		"FOR UPDATE SKIP LOCKED\\) RETURNING (.+)").WillReturnRows(rows)
+
+	job, err := repo.Claim(time.Now().Add(time.Minute))
+
+	assert.Nil(t, err)
+	assert.Equal(t, lastID, job.LastID)
+	assert.Equal(t, 40.0, job.Progress)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertJobAlreadyRunning(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectQuery("INSERT INTO resync_jobs (.+) RETURNING (.+)").WillReturnError(&pq.Error{Code: "23505"})
+
+	_, err := repo.Insert("user.snapshot", 100, 10, uuid.New())
+
+	assert.ErrorIs(t, err, ErrAlreadyRunning)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCheckpointCancelledJob(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectExec("UPDATE resync_jobs SET (.+) WHERE id = (.+) AND status = (.+)").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := repo.Checkpoint(uuid.New(), uuid.New(), 100, time.Now().Add(time.Minute))
+
+	assert.ErrorIs(t, err, ErrNotRunning)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestResumeCompletedJob(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectExec("UPDATE resync_jobs SET (.+) WHERE id = (.+) AND status IN (.+)").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := repo.Resume(uuid.New())
+
+	assert.ErrorIs(t, err, ErrNotResumable)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
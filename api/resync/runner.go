@@ -0,0 +1,164 @@
+package resync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/user"
+	"golang-demo/config"
+	"time"
+)
+
+type Publisher interface {
+	PublishEvent(routingKey string, body string) error
+}
+
+type UserRepository interface {
+	Select(name string, country string, includeDeleted bool, offset int, limit int) ([]user.User, int64, error)
+	SelectAfter(afterID uuid.UUID, limit int) ([]user.User, error)
+}
+
+// runner executes resync jobs. Job is leased by instance which runs it and cursor is stored while publishing,
+// so job of crashed instance is taken over once lease expires and users of the last page may be published twice
+type runner struct {
+	repository Repository
+	users      UserRepository
+	publisher  Publisher
+	pageSize   int
+	interval   time.Duration
+	lease      time.Duration
+	wake       chan struct{}
+}
+
+func NewRunner(repository Repository, users UserRepository, publisher Publisher, cfg config.Config) *runner {
+	r := &runner{
+		repository: repository,
+		users:      users,
+		publisher:  publisher,
+		pageSize:   cfg.ResyncPageSize,
+		interval:   cfg.ResyncPollInterval,
+		lease:      cfg.ResyncLease,
+		wake:       make(chan struct{}, 1),
+	}
+	if r.pageSize <= 0 {
+		r.pageSize = 100
+	}
+	if r.interval <= 0 {
+		r.interval = 10 * time.Second
+	}
+	if r.lease <= 0 {
+		r.lease = time.Minute
+	}
+	return r
+}
+
+// Wake makes runner look for job without waiting for the next poll
+func (r *runner) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run claims and executes jobs until ctx is cancelled
+func (r *runner) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		job, err := r.repository.Claim(time.Now().Add(r.lease))
+		switch {
+		case err == nil:
+			r.process(ctx, job)
+			continue
+		case !errors.Is(err, sql.ErrNoRows):
+			log.Errorln("failed to claim resync job", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Infoln("resync runner stopped")
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// process publishes pages of users starting after job cursor. When ctx is cancelled job is left running
+// and its lease expires, so it is resumed by the next instance.
+// Cursor is stored and lease is extended after every page and also within page once half of lease has passed,
+// so slow rate does not let lease expire while instance is still publishing
+func (r *runner) process(ctx context.Context, job Job) {
+	log.Infoln("resync job", job.ID, "started after", job.LastID, "published", job.Published, "of", job.Total)
+	limiter := time.NewTicker(time.Second / time.Duration(job.Rate))
+	defer limiter.Stop()
+	renewAt := time.Now().Add(r.lease / 2)
+	for {
+		users, err := r.users.SelectAfter(job.LastID, r.pageSize)
+		if err != nil {
+			r.finish(job, StatusFailed, err)
+			return
+		}
+		if len(users) == 0 {
+			r.finish(job, StatusCompleted, nil)
+			return
+		}
+		for i, u := range users {
+			select {
+			case <-ctx.Done():
+				return
+			case <-limiter.C:
+			}
+			if err = r.publish(job.RoutingKey, u); err != nil {
+				r.finish(job, StatusFailed, err)
+				return
+			}
+			job.LastID = u.ID
+			job.Published++
+			if i < len(users)-1 && time.Now().Before(renewAt) {
+				continue
+			}
+			if !r.checkpoint(job) {
+				return
+			}
+			renewAt = time.Now().Add(r.lease / 2)
+		}
+		log.Debugln("resync job", job.ID, "published", job.Published, "of", job.Total)
+	}
+}
+
+// checkpoint stores progress of job and extends its lease, false is returned when job must not continue
+func (r *runner) checkpoint(job Job) bool {
+	err := r.repository.Checkpoint(job.ID, job.LastID, job.Published, time.Now().Add(r.lease))
+	if errors.Is(err, ErrNotRunning) {
+		log.Infoln("resync job", job.ID, "cancelled at", job.Published, "of", job.Total)
+		return false
+	}
+	if err != nil {
+		// lease expires and job is resumed from the last stored cursor
+		log.Errorln("failed to store progress of resync job", job.ID, err)
+		return false
+	}
+	return true
+}
+
+func (r *runner) publish(routingKey string, u user.User) error {
+	body, err := user.NewEvent(user.EventSnapshot, u, nil)
+	if err != nil {
+		return err
+	}
+	return r.publisher.PublishEvent(routingKey, body)
+}
+
+func (r *runner) finish(job Job, status string, jobErr error) {
+	if err := r.repository.Finish(job.ID, status, jobErr); err != nil && !errors.Is(err, ErrNotRunning) {
+		log.Errorln("failed to finish resync job", job.ID, err)
+		return
+	}
+	if jobErr != nil {
+		log.Errorln("resync job", job.ID, status, jobErr)
+		return
+	}
+	log.Infoln("resync job", job.ID, status, "published", job.Published)
+}
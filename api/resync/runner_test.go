@@ -0,0 +1,122 @@
+package resync
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/user"
+	"golang-demo/config"
+	"sort"
+	"testing"
+	"time"
+)
+
+type repositoryMock struct {
+	Repository
+	checkpoints []uuid.UUID
+	cancelled   bool
+	status      string
+	err         error
+}
+
+func (r *repositoryMock) Checkpoint(_ uuid.UUID, lastID uuid.UUID, _ int64, _ time.Time) error {
+	if r.cancelled {
+		return ErrNotRunning
+	}
+	r.checkpoints = append(r.checkpoints, lastID)
+	return nil
+}
+
+func (r *repositoryMock) Finish(_ uuid.UUID, status string, jobErr error) error {
+	r.status = status
+	r.err = jobErr
+	return nil
+}
+
+type usersMock struct {
+	users []user.User
+}
+
+func (u *usersMock) Select(string, string, bool, int, int) ([]user.User, int64, error) {
+	return nil, int64(len(u.users)), nil
+}
+
+func (u *usersMock) SelectAfter(afterID uuid.UUID, limit int) ([]user.User, error) {
+	page := []user.User{}
+	for _, item := range u.users {
+		if item.ID.String() > afterID.String() && len(page) < limit {
+			page = append(page, item)
+		}
+	}
+	return page, nil
+}
+
+type publisherMock struct {
+	published []string
+	err       error
+}
+
+func (p *publisherMock) PublishEvent(routingKey string, _ string) error {
+	p.published = append(p.published, routingKey)
+	return p.err
+}
+
+func newUsers(n int) *usersMock {
+	users := make([]user.User, n)
+	for i := range users {
+		users[i] = user.User{ID: uuid.New()}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID.String() < users[j].ID.String() })
+	return &usersMock{users}
+}
+
+func TestProcessResumesFromCursor(t *testing.T) {
+	repo := &repositoryMock{}
+	users := newUsers(5)
+	publisher := &publisherMock{}
+	r := NewRunner(repo, users, publisher, config.Config{ResyncPageSize: 2})
+
+	r.process(context.Background(), Job{ID: uuid.New(), RoutingKey: "user.snapshot", Rate: 1000, LastID: users.users[0].ID})
+
+	assert.Len(t, publisher.published, 4)
+	assert.Equal(t, []uuid.UUID{users.users[2].ID, users.users[4].ID}, repo.checkpoints)
+	assert.Equal(t, StatusCompleted, repo.status)
+}
+
+func TestProcessStopsWhenCancelled(t *testing.T) {
+	repo := &repositoryMock{cancelled: true}
+	publisher := &publisherMock{}
+	r := NewRunner(repo, newUsers(5), publisher, config.Config{ResyncPageSize: 2})
+
+	r.process(context.Background(), Job{ID: uuid.New(), RoutingKey: "user.snapshot", Rate: 1000})
+
+	assert.Len(t, publisher.published, 2)
+	assert.Empty(t, repo.status)
+}
+
+func TestProcessFailsOnPublishError(t *testing.T) {
+	repo := &repositoryMock{}
+	publisher := &publisherMock{err: errors.New("nacked")}
+	r := NewRunner(repo, newUsers(3), publisher, config.Config{})
+
+	r.process(context.Background(), Job{ID: uuid.New(), RoutingKey: "user.snapshot", Rate: 1000})
+
+	assert.Equal(t, StatusFailed, repo.status)
+	assert.EqualError(t, repo.err, "nacked")
+	assert.Empty(t, repo.checkpoints)
+}
+
+func TestProcessExtendsLeaseWithinPage(t *testing.T) {
+	repo := &repositoryMock{}
+	users := newUsers(4)
+	publisher := &publisherMock{}
+	r := NewRunner(repo, users, publisher, config.Config{ResyncPageSize: 10, ResyncLease: 10 * time.Millisecond})
+
+	r.process(context.Background(), Job{ID: uuid.New(), RoutingKey: "user.snapshot", Rate: 100})
+
+	assert.Len(t, publisher.published, 4)
+	assert.Len(t, repo.checkpoints, 4)
+	assert.Equal(t, users.users[3].ID, repo.checkpoints[3])
+	assert.Equal(t, StatusCompleted, repo.status)
+}
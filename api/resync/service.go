@@ -0,0 +1,89 @@
+package resync
+
+import (
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/user"
+	"golang-demo/config"
+)
+
+type Service interface {
+	Start(input InputJob, actorID uuid.UUID) (Job, error)
+	Get(page int, pageSize int) ([]Job, int64, error)
+	GetById(id uuid.UUID) (Job, error)
+	Cancel(id uuid.UUID, actorID uuid.UUID) error
+	Resume(id uuid.UUID, actorID uuid.UUID) error
+}
+
+type Waker interface {
+	Wake()
+}
+
+type service struct {
+	repository Repository
+	users      UserRepository
+	waker      Waker
+	routingKey string
+	rate       int
+}
+
+func NewService(repository Repository, users UserRepository, waker Waker, cfg config.Config) *service {
+	s := &service{repository: repository, users: users, waker: waker, routingKey: cfg.ResyncRoutingKey, rate: cfg.ResyncRate}
+	if s.routingKey == "" {
+		s.routingKey = user.EventSnapshot
+	}
+	if s.rate <= 0 {
+		s.rate = 100
+	}
+	return s
+}
+
+// Start creates job publishing snapshot of all users, rate of input overrides configured one
+func (s *service) Start(input InputJob, actorID uuid.UUID) (Job, error) {
+	rate := s.rate
+	if input.Rate > 0 {
+		rate = input.Rate
+	}
+	_, total, err := s.users.Select("", "", false, 0, 0)
+	if err != nil {
+		return Job{}, err
+	}
+	job, err := s.repository.Insert(s.routingKey, rate, total, actorID)
+	if err != nil {
+		return job, err
+	}
+	log.Infoln("resync job", job.ID, "of", total, "users requested by", actorID)
+	s.waker.Wake()
+	return job, nil
+}
+
+func (s *service) Get(page int, pageSize int) ([]Job, int64, error) {
+	return s.repository.Select((page-1)*pageSize, pageSize)
+}
+
+func (s *service) GetById(id uuid.UUID) (Job, error) {
+	return s.repository.SelectById(id)
+}
+
+func (s *service) Cancel(id uuid.UUID, actorID uuid.UUID) error {
+	if _, err := s.repository.SelectById(id); err != nil {
+		return err
+	}
+	if err := s.repository.Cancel(id); err != nil {
+		return err
+	}
+	log.Infoln("resync job", id, "cancelled by", actorID)
+	return nil
+}
+
+func (s *service) Resume(id uuid.UUID, actorID uuid.UUID) error {
+	if _, err := s.repository.SelectById(id); err != nil {
+		return err
+	}
+	if err := s.repository.Resume(id); err != nil {
+		return err
+	}
+	log.Infoln("resync job", id, "resumed by", actorID)
+	s.waker.Wake()
+	return nil
+}
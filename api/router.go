@@ -3,33 +3,140 @@ package api
 import (
 	"database/sql"
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
 	"github.com/hellofresh/health-go/v5"
-	"github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
+	"golang-demo/api/apikey"
+	"golang-demo/api/auth"
+	"golang-demo/api/deadletter"
+	"golang-demo/api/password"
+	"golang-demo/api/resync"
 	"golang-demo/api/user"
+	"golang-demo/config"
 )
 
-func NewRouter(db *sql.DB, conn *amqp091.Connection, h *health.Health) *chi.Mux {
+// NewUserService builds user service, it is shared by http api and command consumer
+func NewUserService(cfg config.Config, db *sql.DB, mQ user.MQ) (user.Service, error) {
+	passwordHasher, err := password.NewHasher(cfg)
+	if err != nil {
+		return nil, err
+	}
+	revokers := []user.CredentialRevoker{auth.NewSessionRepository(db), apikey.NewRepository(db)}
+	return user.NewService(user.NewRepository(db), user.NewVerificationRepository(db), passwordHasher, mQ, revokers, cfg), nil
+}
+
+func NewRouter(cfg config.Config, db *sql.DB, userService user.Service, mQ user.MQ, deadLetterPublisher deadletter.Publisher,
+	resyncWaker resync.Waker, h *health.Health) (*chi.Mux, error) {
+	passwordPolicy, err := password.NewPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	passwordHasher, err := password.NewHasher(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	userRepository := user.NewRepository(db)
-	mQ := user.NewMQ(conn)
-	userService := user.NewService(userRepository, mQ)
-	userHandler := user.NewUserHandler(userService)
+	userHandler := user.NewUserHandler(userService, passwordPolicy)
+
+	tokenIssuer, err := auth.NewJWTIssuer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sessionRepository := auth.NewSessionRepository(db)
+	resetRepository := auth.NewPasswordResetRepository(db)
+	twoFactorRepository := auth.NewTwoFactorRepository(db)
+	lockoutGuard := auth.NewLockoutGuard(auth.NewLockoutRepository(db), mQ, cfg)
+	authService, err := auth.NewService(userRepository, sessionRepository, resetRepository, twoFactorRepository, lockoutGuard,
+		passwordPolicy, passwordHasher, tokenIssuer, mQ, cfg)
+	if err != nil {
+		return nil, err
+	}
+	apiKeyService := apikey.NewService(apikey.NewRepository(db))
+	apiKeyHandler := apikey.NewAPIKeyHandler(apiKeyService)
+	authHandler := auth.NewAuthHandler(authService, tokenIssuer, apiKeyService)
+	deadLetterService := deadletter.NewService(deadletter.NewRepository(db), deadLetterPublisher)
+	deadLetterHandler := deadletter.NewDeadLetterHandler(deadLetterService)
+	resyncService := resync.NewService(resync.NewRepository(db), userRepository, resyncWaker, cfg)
+	resyncHandler := resync.NewResyncHandler(resyncService)
+	policy := auth.NewRolePolicy()
 
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
 	r.Use(LoggerWithLevel(log.InfoLevel))
 	r.Use(render.SetContentType(render.ContentTypeJSON))
 
+	r.Route("/auth", func(r chi.Router) {
+		r.Post("/login", authHandler.Login)
+		r.Post("/login/2fa", authHandler.LoginTwoFactor)
+		r.Post("/refresh", authHandler.Refresh)
+		r.Post("/password-reset", authHandler.RequestPasswordReset)
+		r.Post("/password-reset/confirm", authHandler.ResetPassword)
+	})
 	r.Route("/users", func(r chi.Router) {
-		r.Get("/", userHandler.Get)
 		r.Post("/", userHandler.Store)
-		r.Route("/{userId}", func(r chi.Router) {
-			r.Use(userHandler.UserCtx)
-			r.Get("/", userHandler.GetByID)
-			r.Put("/", userHandler.Update)
-			r.Delete("/", userHandler.Delete)
+		r.With(userHandler.UserCtx).Post("/{userId}/verify-email", userHandler.VerifyEmail)
+		r.Group(func(r chi.Router) {
+			r.Use(authHandler.Authenticate)
+			r.With(Authorize(policy, auth.ActionUserList)).Get("/", userHandler.Get)
+			// audit log and restore are available for deleted users, so user is not loaded by UserCtx
+			r.With(Authorize(policy, auth.ActionUserAudit)).Get("/{userId}/audit", userHandler.GetAudit)
+			r.With(Authorize(policy, auth.ActionUserRestore)).Post("/{userId}/restore", userHandler.Restore)
+			// access is checked before user is loaded, so denied request can't tell whether user exists
+			r.Route("/{userId}", func(r chi.Router) {
+				r.With(Authorize(policy, auth.ActionUserRead), userHandler.UserCtx).Get("/", userHandler.GetByID)
+				r.With(Authorize(policy, auth.ActionUserUpdate), userHandler.UserCtx).Put("/", userHandler.Update)
+				r.With(Authorize(policy, auth.ActionUserUpdate), userHandler.UserCtx).Patch("/", userHandler.Patch)
+				r.With(Authorize(policy, auth.ActionUserDelete), userHandler.UserCtx).Delete("/", userHandler.Delete)
+				r.With(Authorize(policy, auth.ActionUserSetRole), userHandler.UserCtx).Put("/role", userHandler.SetRole)
+				r.With(Authorize(policy, auth.ActionUserUpdate), userHandler.UserCtx).Post("/verify-email/resend", userHandler.ResendVerification)
+				r.With(Authorize(policy, auth.ActionPasswordChange), userHandler.UserCtx).Post("/password", authHandler.ChangePassword)
+				r.With(Authorize(policy, auth.ActionLockoutManage), userHandler.UserCtx).Delete("/lockout", authHandler.UnlockUser)
+				r.Route("/2fa", func(r chi.Router) {
+					r.Use(Authorize(policy, auth.ActionTwoFactor))
+					r.Use(userHandler.UserCtx)
+					r.Post("/", authHandler.EnrollTOTP)
+					r.Post("/confirm", authHandler.ConfirmTOTP)
+					r.Delete("/", authHandler.DisableTOTP)
+				})
+				r.Route("/sessions", func(r chi.Router) {
+					r.With(Authorize(policy, auth.ActionSessionRead), userHandler.UserCtx).Get("/", authHandler.GetSessions)
+					r.With(Authorize(policy, auth.ActionSessionRevoke), userHandler.UserCtx).Delete("/", authHandler.RevokeSessions)
+					r.With(Authorize(policy, auth.ActionSessionRevoke), userHandler.UserCtx).Delete("/{sessionId}", authHandler.RevokeSession)
+				})
+			})
 		})
 	})
+	r.Route("/api-keys", func(r chi.Router) {
+		r.Use(authHandler.Authenticate)
+		r.Use(Authorize(policy, auth.ActionAPIKeyManage))
+		r.Get("/", apiKeyHandler.Get)
+		r.Post("/", apiKeyHandler.Store)
+		r.Delete("/{keyId}", apiKeyHandler.Revoke)
+	})
+	r.Route("/lockouts", func(r chi.Router) {
+		r.Use(authHandler.Authenticate)
+		r.Use(Authorize(policy, auth.ActionLockoutManage))
+		r.Delete("/ips/{ip}", authHandler.UnlockIP)
+	})
+	r.Route("/dead-letters", func(r chi.Router) {
+		r.Use(authHandler.Authenticate)
+		r.Use(Authorize(policy, auth.ActionDeadLetterManage))
+		r.Get("/", deadLetterHandler.Get)
+		r.Get("/{deadLetterId}", deadLetterHandler.GetByID)
+		r.Post("/{deadLetterId}/replay", deadLetterHandler.Replay)
+		r.Delete("/{deadLetterId}", deadLetterHandler.Discard)
+	})
+	r.Route("/resync-jobs", func(r chi.Router) {
+		r.Use(authHandler.Authenticate)
+		r.Use(Authorize(policy, auth.ActionResyncManage))
+		r.Get("/", resyncHandler.Get)
+		r.Post("/", resyncHandler.Store)
+		r.Get("/{jobId}", resyncHandler.GetByID)
+		r.Post("/{jobId}/resume", resyncHandler.Resume)
+		r.Delete("/{jobId}", resyncHandler.Cancel)
+	})
 	r.Get("/status", h.HandlerFunc)
-	return r
+	return r, nil
 }
@@ -2,58 +2,258 @@ package user
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
+	"golang-demo/api/broker"
+	"golang-demo/api/envelope"
+	"golang-demo/api/event"
+	"golang-demo/config"
+	"strings"
 	"time"
 )
 
 type MQ interface {
-	PublishMessage(queue string, body string)
+	PublishMessage(routingKey string, body string) error
+	PublishPrivateMessage(routingKey string, body string) error
+	PublishEvent(routingKey string, body string) error
 }
 
+var ErrPublishNacked = errors.New("message was not confirmed by rabbitmq")
+
+// mq is long-lived publisher, it reuses pool of channels in confirm mode,
+// channels closed by broker or reconnection are dropped from pool. Every message is sealed,
+// i.e. signed and encrypted if it carries PII, before it is sent
 type mq struct {
-	conn *amqp.Connection
+	conn           *broker.Connection
+	sealer         envelope.Sealer
+	exchange       string
+	channels       chan *amqp.Channel
+	wait           time.Duration
+	confirmTimeout time.Duration
+}
+
+func NewMQ(conn *broker.Connection, sealer envelope.Sealer, cfg config.Config) *mq {
+	m := &mq{
+		conn:           conn,
+		sealer:         sealer,
+		exchange:       exchangeName(cfg),
+		wait:           cfg.MqPublishWait,
+		confirmTimeout: cfg.MqConfirmTimeout,
+	}
+	poolSize := cfg.MqChannelPoolSize
+	if poolSize <= 0 {
+		poolSize = 4
+	}
+	m.channels = make(chan *amqp.Channel, poolSize)
+	if m.confirmTimeout <= 0 {
+		m.confirmTimeout = 5 * time.Second
+	}
+	return m
+}
+
+func exchangeName(cfg config.Config) string {
+	if cfg.MqExchange == "" {
+		return "users.events"
+	}
+	return cfg.MqExchange
+}
+
+// Binding binds queue to exchange by routing key pattern, e.g. user.* or user.#
+type Binding struct {
+	Queue      string
+	RoutingKey string
 }
 
-func NewMQ(conn *amqp.Connection) *mq {
-	return &mq{conn}
+// ParseBindings parses comma separated list of queue:pattern pairs,
+// queue may be listed several times to bind it by several patterns
+func ParseBindings(value string) ([]Binding, error) {
+	var bindings []Binding
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		queue, key, ok := strings.Cut(pair, ":")
+		if !ok || queue == "" || key == "" {
+			return nil, fmt.Errorf("invalid binding %q, expected queue:pattern", pair)
+		}
+		bindings = append(bindings, Binding{Queue: queue, RoutingKey: key})
+	}
+	return bindings, nil
 }
 
-// PublishMessage sends message to RabbitMQ, where body contains user id
-// and queueName in [user_create, user_update, user_delete]
-// for other services notification about user changes
-func (m *mq) PublishMessage(queueName string, body string) {
-	ch, err := m.conn.Channel()
+// DeclareTopology declares durable topic exchange and durable queues bound to it, command queues
+// with dead-letter exchange and RPC queue. It is called at startup and after reconnect. Other services may bind their own queues to the exchange
+func DeclareTopology(conn *amqp.Connection, cfg config.Config) error {
+	bindings, err := ParseBindings(cfg.MqBindings)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer ch.Close()
 
-	q, err := ch.QueueDeclare(
-		queueName, // name
-		false,     // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
+	exchange := exchangeName(cfg)
+	err = ch.ExchangeDeclare(
+		exchange, // name
+		"topic",  // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
 	)
+	if err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		if _, err = ch.QueueDeclare(b.Queue, true, false, false, false, nil); err != nil {
+			return err
+		}
+		if err = ch.QueueBind(b.Queue, b.RoutingKey, exchange, false, nil); err != nil {
+			return err
+		}
+		log.Infoln("bound queue", b.Queue, "to", exchange, "by", b.RoutingKey)
+	}
+	if err = declareCommandQueues(ch, cfg); err != nil {
+		return err
+	}
+	return declareRPCQueue(ch, cfg)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// PublishMessage sends plain message to users exchange
+func (m *mq) PublishMessage(routingKey string, body string) error {
+	return m.publish(m.exchange, routingKey, amqp.Publishing{
+		ContentType:  "plain/text",
+		DeliveryMode: amqp.Persistent,
+		Body:         []byte(body),
+	})
+}
+
+// PublishPrivateMessage sends plain message to users exchange, message carries secret, e.g. reset token,
+// so it is encrypted whenever encryption is enabled regardless of routing key patterns
+func (m *mq) PublishPrivateMessage(routingKey string, body string) error {
+	return m.send(m.exchange, routingKey, amqp.Publishing{
+		ContentType:  "plain/text",
+		DeliveryMode: amqp.Persistent,
+		Body:         []byte(body),
+	}, true)
+}
+
+// PublishEvent sends CloudEvent in structured JSON format to users exchange, where routingKey in
+// [user.created, user.updated, user.deleted] for other services notification about user changes
+func (m *mq) PublishEvent(routingKey string, body string) error {
+	return m.publish(m.exchange, routingKey, amqp.Publishing{
+		ContentType:  event.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         []byte(body),
+	})
+}
+
+// Reply sends RPC response to reply_to queue of request through default exchange,
+// response carries user data, so it is encrypted whenever encryption is enabled
+func (m *mq) Reply(replyTo string, correlationID string, body []byte) error {
+	return m.send("", replyTo, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: correlationID,
+		Body:          body,
+	}, true)
+}
+
+// channel takes open channel from pool or opens new one in confirm mode,
+// while disconnected it waits for reconnection up to publish wait
+func (m *mq) channel() (*amqp.Channel, error) {
+	for {
+		select {
+		case ch := <-m.channels:
+			if !ch.IsClosed() {
+				return ch, nil
+			}
+		default:
+			conn, err := m.conn.Get(m.wait)
+			if err != nil {
+				return nil, err
+			}
+			ch, err := conn.Channel()
+			if err != nil {
+				return nil, err
+			}
+			if err = ch.Confirm(false); err != nil {
+				ch.Close()
+				return nil, err
+			}
+			return ch, nil
+		}
+	}
+}
+
+// release returns channel to pool, channel is closed when publish failed or pool is full
+func (m *mq) release(ch *amqp.Channel, err error) {
+	if err != nil || ch.IsClosed() {
+		ch.Close()
+		return
+	}
+	select {
+	case m.channels <- ch:
+	default:
+		ch.Close()
+	}
+}
+
+// publish sends message and waits for broker confirmation
+func (m *mq) publish(exchange string, routingKey string, msg amqp.Publishing) error {
+	return m.send(exchange, routingKey, msg, false)
+}
+
+// send seals message and publishes it, private message is encrypted regardless of routing key patterns
+func (m *mq) send(exchange string, routingKey string, msg amqp.Publishing, private bool) error {
+	body := string(msg.Body)
+	if m.sealer != nil {
+		seal := m.sealer.Seal
+		if private {
+			seal = m.sealer.SealPrivate
+		}
+		if err := seal(routingKey, &msg); err != nil {
+			log.Errorln("failed to seal message", err)
+			return err
+		}
+		if _, ok := msg.Headers[envelope.HeaderEncryption]; ok {
+			body = "<encrypted>"
+		}
+	}
+
+	ch, err := m.channel()
+	if err != nil {
+		log.Errorln("failed to send message", err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.confirmTimeout)
 	defer cancel()
 
-	err = ch.PublishWithContext(ctx,
-		"",     // exchange
-		q.Name, // routing key
-		false,  // mandatory
-		false,  // immediate
-		amqp.Publishing{
-			ContentType: "plain/text",
-			Body:        []byte(body),
-		})
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		msg)
+	if err == nil {
+		var acked bool
+		acked, err = confirmation.WaitContext(ctx)
+		if err == nil && !acked {
+			err = ErrPublishNacked
+		}
+	}
+	m.release(ch, err)
 
 	if err != nil {
 		log.Errorln("failed to send message", err)
-	} else {
-		log.Infoln("message sent", queueName, body)
+		return err
 	}
+	log.Infoln("message sent", routingKey, body)
+	return nil
 }
@@ -0,0 +1,22 @@
+package user
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseBindings(t *testing.T) {
+	bindings, err := ParseBindings("audit:user.*, search:user.created,search:user.updated,")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Binding{
+		{Queue: "audit", RoutingKey: "user.*"},
+		{Queue: "search", RoutingKey: "user.created"},
+		{Queue: "search", RoutingKey: "user.updated"},
+	}, bindings)
+}
+
+func TestParseInvalidBinding(t *testing.T) {
+	_, err := ParseBindings("audit")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,168 @@
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
+	"golang-demo/api/event"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ActorAnonymous = "anonymous"
+	ActorUser      = "user"
+	ActorAPIKey    = "api_key"
+	ActorService   = "service"
+
+	AuditCreate         = "create"
+	AuditUpdate         = "update"
+	AuditSetRole        = "set_role"
+	AuditUpdateCountry  = "update_country"
+	AuditDeactivate     = "deactivate"
+	AuditActivate       = "activate"
+	AuditDelete         = "delete"
+	AuditRestore        = "restore"
+	AuditPurge          = "purge"
+	AuditPasswordReset  = "password_reset"
+	AuditPasswordChange = "password_change"
+	AuditPasswordRehash = "password_rehash"
+	AuditEmailVerify    = "email_verify"
+	AuditTOTPEnable     = "totp_enable"
+	AuditTOTPDisable    = "totp_disable"
+	AuditRecoveryCode   = "recovery_code_use"
+
+	redacted = "[REDACTED]"
+)
+
+// Actor is who performs user mutation, id is user or api key id depending on type
+type Actor struct {
+	Type      string     `json:"type"`
+	ID        *uuid.UUID `json:"id"`
+	RequestID string     `json:"request_id"`
+	IP        string     `json:"ip"`
+}
+
+// ServiceActor is actor of mutation made by service itself, e.g. purge of deleted users
+func ServiceActor(requestID string) Actor {
+	return Actor{Type: ActorService, RequestID: requestID}
+}
+
+// ContextWithActor stores actor of authenticated request, it is called by Authenticate middleware
+func ContextWithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, "actor", actor)
+}
+
+// RequestActor returns actor of request with request id and remote ip, unauthenticated requests are anonymous
+func RequestActor(r *http.Request) Actor {
+	actor, ok := r.Context().Value("actor").(Actor)
+	if !ok {
+		actor = Actor{Type: ActorAnonymous}
+	}
+	actor.RequestID = middleware.GetReqID(r.Context())
+	actor.IP, _ = r.Context().Value("remote_ip").(string)
+	return actor
+}
+
+// AuditEntry records single mutation of user, diff holds changed fields with password redacted.
+// Entries of every user are chained, hash covers entry fields and hash of previous entry.
+// Diff and ip of purged user are erased, redacted_at marks such entries
+type AuditEntry struct {
+	ID         uuid.UUID       `json:"id"`
+	UserID     uuid.UUID       `json:"user_id"`
+	Seq        int64           `json:"seq"`
+	Action     string          `json:"action"`
+	ActorType  string          `json:"actor_type"`
+	ActorID    *uuid.UUID      `json:"actor_id"`
+	RequestID  string          `json:"request_id"`
+	IP         string          `json:"ip"`
+	Diff       json.RawMessage `json:"diff"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+	CreatedAt  time.Time       `json:"created_at"`
+	RedactedAt *time.Time      `json:"redacted_at,omitempty"`
+}
+
+// ComputeHash returns sha256 of entry fields and previous hash, diff is hashed as stored
+func (e AuditEntry) ComputeHash() string {
+	actorID := ""
+	if e.ActorID != nil {
+		actorID = e.ActorID.String()
+	}
+	input := strings.Join([]string{e.PrevHash, e.UserID.String(), strconv.FormatInt(e.Seq, 10), e.Action, e.ActorType, actorID,
+		e.RequestID, e.IP, e.CreatedAt.UTC().Format(time.RFC3339Nano), string(e.Diff)}, "\n")
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyChain checks entries ordered by seq starting from the first one, it returns seq of the first
+// entry which is altered or out of chain, 0 means chain is intact
+func VerifyChain(entries []AuditEntry) int64 {
+	return VerifyChainFrom(0, "", entries)
+}
+
+// VerifyChainFrom checks entries ordered by seq which follow already verified entry with given seq and hash.
+// Hash of redacted entry can not be recomputed, only its place in chain is checked
+func VerifyChainFrom(seq int64, prevHash string, entries []AuditEntry) int64 {
+	for _, e := range entries {
+		seq++
+		if e.Seq != seq || e.PrevHash != prevHash || (e.RedactedAt == nil && e.ComputeHash() != e.Hash) {
+			return seq
+		}
+		prevHash = e.Hash
+	}
+	return 0
+}
+
+// auditDiff returns changed fields of user, before is nil for created user and after is nil for deleted one.
+// Password is never written, its change is marked as redacted
+func auditDiff(before *User, after *User) (json.RawMessage, error) {
+	var b, a any
+	if before != nil {
+		b = before
+	}
+	if after != nil {
+		a = after
+	}
+	changes, err := event.Diff(b, a, "updated_at", "version")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case before == nil && after == nil:
+		return json.RawMessage(`{}`), nil
+	case before == nil && after != nil:
+		changes["password"] = event.Change{After: redacted}
+	case before != nil && after != nil && before.Password != after.Password:
+		changes["password"] = event.Change{Before: redacted, After: redacted}
+	}
+	return json.Marshal(changes)
+}
+
+// audit writes entry of user mutation in transaction tx
+func audit(tx Repository, action string, userID uuid.UUID, actor Actor, before *User, after *User) error {
+	diff, err := auditDiff(before, after)
+	if err != nil {
+		return err
+	}
+	return tx.InsertAudit(AuditEntry{
+		UserID:    userID,
+		Action:    action,
+		ActorType: actor.Type,
+		ActorID:   actor.ID,
+		RequestID: actor.RequestID,
+		IP:        actor.IP,
+		Diff:      diff,
+	})
+}
+
+// Audit writes entry of user mutation performed outside of user service, e.g. password reset,
+// it must be called with repository of the transaction which changed user
+func Audit(tx Repository, action string, actor Actor, before User, after User) error {
+	return audit(tx, action, after.ID, actor, &before, &after)
+}
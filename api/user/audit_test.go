@@ -0,0 +1,120 @@
+package user
+
+import (
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func chain(n int) []AuditEntry {
+	userID := uuid.New()
+	entries := make([]AuditEntry, n)
+	prevHash := ""
+	for i := range entries {
+		entries[i] = AuditEntry{UserID: userID, Seq: int64(i + 1), Action: AuditUpdate, ActorType: ActorService,
+			Diff: json.RawMessage(`{}`), PrevHash: prevHash, CreatedAt: time.Now()}
+		entries[i].Hash = entries[i].ComputeHash()
+		prevHash = entries[i].Hash
+	}
+	return entries
+}
+
+func TestVerifyChain(t *testing.T) {
+	assert.Equal(t, int64(0), VerifyChain(chain(3)))
+
+	tampered := chain(3)
+	tampered[1].Diff = json.RawMessage(`{"role": {"before": "member", "after": "admin"}}`)
+	assert.Equal(t, int64(2), VerifyChain(tampered))
+
+	removed := chain(3)
+	assert.Equal(t, int64(2), VerifyChain(append(removed[:1], removed[2:]...)))
+
+	redactedAt := time.Now()
+	redacted := chain(3)
+	redacted[1].IP = "10.0.0.1"
+	redacted[1].RedactedAt = &redactedAt
+	assert.Equal(t, int64(0), VerifyChain(redacted))
+	redacted[1].PrevHash = "other"
+	assert.Equal(t, int64(2), VerifyChain(redacted))
+}
+
+func TestRedactAudit(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	userID := uuid.New()
+	mock.ExpectExec("UPDATE user_audit SET diff = (.+), ip = (.+), redacted_at = (.+) WHERE redacted_at IS NULL AND user_id = (.+)").
+		WithArgs([]byte(`{}`), "", sqlmock.AnyArg(), userID).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	assert.Nil(t, repo.RedactAudit(userID))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifyChainFromCheckpoint(t *testing.T) {
+	entries := chain(4)
+	assert.Equal(t, int64(0), VerifyChainFrom(2, entries[1].Hash, entries[2:]))
+	assert.Equal(t, int64(3), VerifyChainFrom(2, "other", entries[2:]))
+	assert.Equal(t, int64(3), VerifyChainFrom(2, entries[1].Hash, entries[3:]))
+}
+
+func TestSaveAuditCheckpoint(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	userID := uuid.New()
+	mock.ExpectQuery("SELECT seq, hash FROM user_audit_checkpoints WHERE user_id = (.+)").
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "hash"}))
+	mock.ExpectQuery("SELECT (.+) FROM user_audit WHERE user_id = (.+) AND seq > (.+) ORDER BY seq").
+		WithArgs(userID, int64(0)).WillReturnRows(sqlmock.NewRows(auditColumns))
+	mock.ExpectExec("INSERT INTO user_audit_checkpoints (.+) ON CONFLICT \\(user_id\\) DO UPDATE (.+) WHERE user_audit_checkpoints.seq < excluded.seq").
+		WithArgs("hash", 3, userID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	seq, hash, err := repo.SelectAuditCheckpoint(userID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), seq)
+	assert.Empty(t, hash)
+	entries, err := repo.SelectAuditChain(userID, seq)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+	assert.Nil(t, repo.SaveAuditCheckpoint(userID, 3, "hash"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAuditDiffRedactsPassword(t *testing.T) {
+	before := User{ID: uuid.New(), Nickname: "nick", Password: "hash1", Country: "KZ"}
+	after := before
+	after.Password = "hash2"
+	after.Country = "DE"
+
+	diff, err := auditDiff(&before, &after)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"country": {"before": "KZ", "after": "DE"}, "password": {"before": "[REDACTED]", "after": "[REDACTED]"}}`, string(diff))
+
+	diff, err = auditDiff(&before, nil)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(diff), "hash1")
+	assert.Contains(t, string(diff), `"nickname":{"before":"nick","after":null}`)
+}
+
+func TestInsertAuditChainsToPreviousEntry(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectQuery("SELECT seq, hash FROM user_audit WHERE user_id = (.+) ORDER BY seq DESC LIMIT 1").
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "hash"}).AddRow(4, "prev"))
+	mock.ExpectExec("INSERT INTO user_audit (.+) VALUES (.+)").
+		WithArgs(AuditDelete, sqlmock.AnyArg(), ActorService, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), "prev", sqlmock.AnyArg(), int64(5), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := repo.InsertAudit(AuditEntry{UserID: uuid.New(), Action: AuditDelete, ActorType: ActorService, Diff: json.RawMessage(`{}`)})
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,358 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/broker"
+	"golang-demo/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CommandDelete        = "user.delete"
+	CommandBulkDelete    = "user.bulk_delete"
+	CommandDeactivate    = "user.deactivate"
+	CommandActivate      = "user.activate"
+	CommandSetRole       = "user.set_role"
+	CommandUpdateCountry = "user.update_country"
+)
+
+// CommandError marks command which can't succeed on retry, e.g. malformed body or unknown user,
+// such messages are rejected to dead-letter exchange right away
+type CommandError struct {
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+type CommandUser struct {
+	UserID uuid.UUID `json:"user_id" validate:"required"`
+}
+
+type CommandUsers struct {
+	UserIDs []uuid.UUID `json:"user_ids" validate:"required,min=1,max=1000"`
+}
+
+type CommandRole struct {
+	UserID uuid.UUID `json:"user_id" validate:"required"`
+	InputRole
+}
+
+type CommandCountry struct {
+	UserID  uuid.UUID `json:"user_id" validate:"required"`
+	Country string    `json:"country" validate:"required,iso3166_1_alpha2"`
+}
+
+// CallerAuthenticator checks api key of AMQP command or RPC request, it returns actor recorded in audit log
+// and scopes granted to key
+type CallerAuthenticator interface {
+	AuthenticateCaller(rawKey string) (Actor, []string, error)
+}
+
+// commandScope is api key scope required by every command, all of them change users
+const commandScope = "users:write"
+
+// consumer reads commands from configured queues with manual acks, command name is taken
+// from AMQP type property and body holds JSON arguments. Sender is authenticated by api key
+// from authorization header, like in http api
+type consumer struct {
+	conn          *broker.Connection
+	service       Service
+	authenticator CallerAuthenticator
+	queues        []string
+	concurrency   int
+	validate      *validator.Validate
+}
+
+func NewConsumer(conn *broker.Connection, service Service, authenticator CallerAuthenticator, cfg config.Config) *consumer {
+	c := &consumer{
+		conn:          conn,
+		service:       service,
+		authenticator: authenticator,
+		queues:        commandQueues(cfg),
+		concurrency:   cfg.MqCommandConcurrency,
+		validate:      validator.New(),
+	}
+	if c.concurrency <= 0 {
+		c.concurrency = 4
+	}
+	return c
+}
+
+func commandQueues(cfg config.Config) []string {
+	var queues []string
+	for _, queue := range strings.Split(cfg.MqCommandQueues, ",") {
+		if queue = strings.TrimSpace(queue); queue != "" {
+			queues = append(queues, queue)
+		}
+	}
+	return queues
+}
+
+// DeadLetterQueues returns names of queues receiving rejected commands
+func DeadLetterQueues(cfg config.Config) []string {
+	var queues []string
+	for _, queue := range commandQueues(cfg) {
+		queues = append(queues, queue+".dead")
+	}
+	return queues
+}
+
+func deadLetterExchange(cfg config.Config) string {
+	if cfg.MqDeadLetterExchange == "" {
+		return "users.dlx"
+	}
+	return cfg.MqDeadLetterExchange
+}
+
+// declareCommandQueues declares command queues with dead-letter exchange,
+// rejected commands are routed to <queue>.dead queue
+func declareCommandQueues(ch *amqp.Channel, cfg config.Config) error {
+	queues := commandQueues(cfg)
+	if len(queues) == 0 {
+		return nil
+	}
+	dlx := deadLetterExchange(cfg)
+	if err := ch.ExchangeDeclare(dlx, "direct", true, false, false, false, nil); err != nil {
+		return err
+	}
+	for _, queue := range queues {
+		dead := queue + ".dead"
+		if _, err := ch.QueueDeclare(dead, true, false, false, false, nil); err != nil {
+			return err
+		}
+		if err := ch.QueueBind(dead, dead, dlx, false, nil); err != nil {
+			return err
+		}
+		_, err := ch.QueueDeclare(queue, true, false, false, false, amqp.Table{
+			"x-dead-letter-exchange":    dlx,
+			"x-dead-letter-routing-key": dead,
+		})
+		if err != nil {
+			return err
+		}
+		log.Infoln("declared command queue", queue, "with dead-letter queue", dead)
+	}
+	return nil
+}
+
+// Run consumes every command queue until ctx is cancelled, consuming is restarted after reconnect
+func (c *consumer) Run(ctx context.Context) {
+	runQueues(ctx, c.queues, func(ctx context.Context, queue string) error {
+		return consumeQueue(ctx, c.conn, queue, c.concurrency, c.handle)
+	})
+	log.Infoln("command consumer stopped")
+}
+
+// runQueues calls consume for every queue in own goroutine and calls it again after it fails,
+// e.g. when connection is lost, until ctx is cancelled
+func runQueues(ctx context.Context, queues []string, consume func(ctx context.Context, queue string) error) {
+	var wg sync.WaitGroup
+	for _, queue := range queues {
+		wg.Add(1)
+		go func(queue string) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := consume(ctx, queue); err != nil {
+					log.Errorln("failed to consume from", queue, err)
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}(queue)
+	}
+	wg.Wait()
+}
+
+// consumeQueue passes deliveries of single queue to handle with manual acks,
+// at most concurrency deliveries are handled at once
+func consumeQueue(ctx context.Context, conn *broker.Connection, queue string, concurrency int, handle func(d amqp.Delivery)) error {
+	amqpConn, err := conn.Get(time.Second)
+	if err != nil {
+		return err
+	}
+	ch, err := amqpConn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err = ch.Qos(concurrency, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	log.Infoln("consuming from", queue)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, concurrency)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return broker.ErrDisconnected
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handle(d)
+				<-sem
+			}()
+		}
+	}
+}
+
+// handle acks handled command, rejects permanent failures to dead-letter exchange and requeues
+// other failures once, so redelivered command is dead-lettered when it fails again.
+// Command of unauthenticated or unauthorized sender is dead-lettered without being handled
+func (c *consumer) handle(d amqp.Delivery) {
+	actor, err := c.authenticate(d)
+	if err == nil {
+		err = c.dispatch(d.Type, d.Body, actor)
+	}
+	var commandErr *CommandError
+	switch {
+	case err == nil:
+		_ = d.Ack(false)
+		log.Infoln("handled command", d.Type, d.MessageId)
+	case errors.As(err, &commandErr) || d.Redelivered:
+		_ = d.Nack(false, false)
+		log.Errorln("rejected command", d.Type, d.MessageId, err)
+	default:
+		_ = d.Nack(false, true)
+		log.Warnln("failed to handle command, requeued", d.Type, d.MessageId, err)
+	}
+}
+
+// authenticate checks api key from "authorization: ApiKey <key>" header and its scope,
+// request id of actor is message id of command
+func (c *consumer) authenticate(d amqp.Delivery) (Actor, error) {
+	key, ok := apiKey(d)
+	if !ok {
+		return Actor{}, &CommandError{errors.New("missing api key")}
+	}
+	actor, scopes, err := c.authenticator.AuthenticateCaller(key)
+	if err != nil {
+		return Actor{}, &CommandError{err}
+	}
+	if !hasScope(scopes, commandScope) {
+		return Actor{}, &CommandError{fmt.Errorf("api key lacks %s scope", commandScope)}
+	}
+	actor.RequestID = d.MessageId
+	return actor, nil
+}
+
+// apiKey returns key from "authorization: ApiKey <key>" header of delivery
+func apiKey(d amqp.Delivery) (string, bool) {
+	header, _ := d.Headers["authorization"].(string)
+	scheme, key, found := strings.Cut(header, " ")
+	if !found || key == "" || !strings.EqualFold(scheme, "ApiKey") {
+		return "", false
+	}
+	return key, true
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *consumer) dispatch(command string, body []byte, actor Actor) error {
+	switch command {
+	case CommandDelete:
+		var input CommandUser
+		if err := c.decode(body, &input); err != nil {
+			return err
+		}
+		return c.delete(input.UserID, actor)
+	case CommandBulkDelete:
+		var input CommandUsers
+		if err := c.decode(body, &input); err != nil {
+			return err
+		}
+		for _, id := range input.UserIDs {
+			if err := c.delete(id, actor); err != nil {
+				return err
+			}
+		}
+		return nil
+	case CommandDeactivate:
+		var input CommandUser
+		if err := c.decode(body, &input); err != nil {
+			return err
+		}
+		return notFound(c.service.Deactivate(input.UserID, actor))
+	case CommandActivate:
+		var input CommandUser
+		if err := c.decode(body, &input); err != nil {
+			return err
+		}
+		return notFound(c.service.Activate(input.UserID, actor))
+	case CommandSetRole:
+		var input CommandRole
+		if err := c.decode(body, &input); err != nil {
+			return err
+		}
+		return notFound(c.service.SetRole(input.UserID, input.Role, actor))
+	case CommandUpdateCountry:
+		var input CommandCountry
+		if err := c.decode(body, &input); err != nil {
+			return err
+		}
+		return notFound(c.service.UpdateCountry(input.UserID, input.Country, actor))
+	default:
+		return &CommandError{fmt.Errorf("unknown command %q", command)}
+	}
+}
+
+// delete is idempotent, redelivered command for already deleted user succeeds
+func (c *consumer) delete(id uuid.UUID, actor Actor) error {
+	err := c.service.Delete(id, 0, actor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+func (c *consumer) decode(body []byte, v any) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return &CommandError{err}
+	}
+	if err := c.validate.Struct(v); err != nil {
+		return &CommandError{err}
+	}
+	return nil
+}
+
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return &CommandError{err}
+	}
+	return err
+}
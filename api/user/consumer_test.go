@@ -0,0 +1,192 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type serviceMock struct {
+	Service
+	deleted     []uuid.UUID
+	deactivated []uuid.UUID
+	country     string
+	patched     map[string]interface{}
+	version     int64
+	err         error
+}
+
+func (s *serviceMock) Delete(id uuid.UUID, version int64, _ Actor) error {
+	if id == uuid.Nil {
+		return sql.ErrNoRows
+	}
+	if s.err != nil {
+		return s.err
+	}
+	s.version = version
+	s.deleted = append(s.deleted, id)
+	return nil
+}
+
+func (s *serviceMock) Deactivate(id uuid.UUID, _ Actor) error {
+	if id == uuid.Nil {
+		return sql.ErrNoRows
+	}
+	s.deactivated = append(s.deactivated, id)
+	return nil
+}
+
+func (s *serviceMock) Activate(id uuid.UUID, _ Actor) error {
+	if id == uuid.Nil {
+		return sql.ErrNoRows
+	}
+	for i, deactivated := range s.deactivated {
+		if deactivated == id {
+			s.deactivated = append(s.deactivated[:i], s.deactivated[i+1:]...)
+		}
+	}
+	return nil
+}
+
+func (s *serviceMock) UpdateCountry(_ uuid.UUID, country string, _ Actor) error {
+	s.country = country
+	return nil
+}
+
+func (s *serviceMock) SetRole(_ uuid.UUID, _ string, _ Actor) error {
+	return sql.ErrNoRows
+}
+
+type authenticatorMock struct {
+	id     uuid.UUID
+	scopes []string
+}
+
+func (a *authenticatorMock) AuthenticateCaller(rawKey string) (Actor, []string, error) {
+	if rawKey != "prefix.secret" {
+		return Actor{}, nil, errors.New("invalid, revoked or expired api key")
+	}
+	return Actor{Type: ActorAPIKey, ID: &a.id}, a.scopes, nil
+}
+
+type acknowledgerMock struct {
+	acked   bool
+	nacked  bool
+	requeue bool
+}
+
+func (a *acknowledgerMock) Ack(uint64, bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *acknowledgerMock) Nack(_ uint64, _ bool, requeue bool) error {
+	a.nacked = true
+	a.requeue = requeue
+	return nil
+}
+
+func (a *acknowledgerMock) Reject(_ uint64, requeue bool) error {
+	a.nacked = true
+	a.requeue = requeue
+	return nil
+}
+
+func newConsumerMock(service Service) *consumer {
+	return &consumer{service: service, validate: validator.New()}
+}
+
+func TestHandleDeadLettersUnauthorizedCommand(t *testing.T) {
+	service := &serviceMock{}
+	c := newConsumerMock(service)
+	body := []byte(`{"user_id": "` + uuid.NewString() + `"}`)
+	command := func(authorization any) amqp.Delivery {
+		return amqp.Delivery{Type: CommandDelete, MessageId: "1", Headers: amqp.Table{"authorization": authorization}, Body: body}
+	}
+
+	c.authenticator = &authenticatorMock{scopes: []string{"users:read"}}
+	for _, authorization := range []any{nil, "Bearer token", "ApiKey prefix.wrong", "ApiKey prefix.secret"} {
+		ack := &acknowledgerMock{}
+		d := command(authorization)
+		d.Acknowledger = ack
+		c.handle(d)
+		assert.True(t, ack.nacked, authorization)
+		assert.False(t, ack.requeue, authorization)
+	}
+	assert.Empty(t, service.deleted)
+
+	c.authenticator = &authenticatorMock{scopes: []string{"users:write"}}
+	ack := &acknowledgerMock{}
+	d := command("ApiKey prefix.secret")
+	d.Acknowledger = ack
+	c.handle(d)
+	assert.True(t, ack.acked)
+	assert.Len(t, service.deleted, 1)
+}
+
+func TestDispatchBulkDelete(t *testing.T) {
+	service := &serviceMock{}
+	c := newConsumerMock(service)
+	id := uuid.New()
+
+	err := c.dispatch(CommandBulkDelete, []byte(`{"user_ids": ["`+id.String()+`", "`+uuid.Nil.String()+`"]}`), ServiceActor("1"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []uuid.UUID{id}, service.deleted)
+}
+
+func TestDispatchDeactivateAndActivate(t *testing.T) {
+	service := &serviceMock{}
+	c := newConsumerMock(service)
+	id := uuid.New()
+	body := []byte(`{"user_id": "` + id.String() + `"}`)
+
+	// deactivated user is not deleted
+	assert.Nil(t, c.dispatch(CommandDeactivate, body, ServiceActor("1")))
+	assert.Equal(t, []uuid.UUID{id}, service.deactivated)
+	assert.Empty(t, service.deleted)
+
+	assert.Nil(t, c.dispatch(CommandActivate, body, ServiceActor("2")))
+	assert.Empty(t, service.deactivated)
+
+	// redelivered activate of active user succeeds
+	assert.Nil(t, c.dispatch(CommandActivate, body, ServiceActor("2")))
+
+	var commandErr *CommandError
+	err := c.dispatch(CommandActivate, []byte(`{"user_id": "`+uuid.Nil.String()+`"}`), ServiceActor("3"))
+	assert.True(t, errors.As(err, &commandErr))
+}
+
+func TestDispatchUpdateCountry(t *testing.T) {
+	service := &serviceMock{}
+	c := newConsumerMock(service)
+
+	err := c.dispatch(CommandUpdateCountry, []byte(`{"user_id": "`+uuid.NewString()+`", "country": "DE"}`), ServiceActor("1"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "DE", service.country)
+}
+
+func TestDispatchRejectsPoisonMessages(t *testing.T) {
+	c := newConsumerMock(&serviceMock{})
+	var commandErr *CommandError
+
+	err := c.dispatch("user.unknown", []byte(`{}`), ServiceActor("1"))
+	assert.True(t, errors.As(err, &commandErr))
+
+	err = c.dispatch(CommandUpdateCountry, []byte(`not json`), ServiceActor("1"))
+	assert.True(t, errors.As(err, &commandErr))
+
+	err = c.dispatch(CommandUpdateCountry, []byte(`{"user_id": "`+uuid.NewString()+`", "country": "Germany"}`), ServiceActor("1"))
+	assert.True(t, errors.As(err, &commandErr))
+
+	err = c.dispatch(CommandSetRole, []byte(`{"user_id": "`+uuid.NewString()+`", "role": "admin"}`), ServiceActor("1"))
+	assert.True(t, errors.As(err, &commandErr))
+
+	err = c.dispatch(CommandDelete, []byte(`{}`), ServiceActor("1"))
+	assert.True(t, errors.As(err, &commandErr))
+}
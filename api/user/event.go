@@ -0,0 +1,100 @@
+package user
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"golang-demo/api/event"
+	"time"
+)
+
+const (
+	EventSource = "/golang-demo/users"
+
+	EventCreated = "user.created"
+	EventUpdated = "user.updated"
+	EventDeleted = "user.deleted"
+	// EventRestored is sent when deleted user is restored before purge
+	EventRestored = "user.restored"
+	// EventPurged is the final event of user, consumers should erase everything they keep about user
+	EventPurged = "user.purged"
+	// EventPasswordChanged is sent when user changes own password, like other user events it carries no password
+	EventPasswordChanged = "user.password_changed"
+	// EventSnapshot carries current state of user published by resync job
+	EventSnapshot = "user.snapshot"
+)
+
+// EventData is data of user CloudEvent, user holds snapshot without password,
+// changes lists changed fields with values before and after update
+type EventData struct {
+	User    User                    `json:"user"`
+	Changes map[string]event.Change `json:"changes,omitempty"`
+}
+
+// NewEvent builds CloudEvent JSON of user change, changes are computed against before when it is given
+func NewEvent(eventType string, u User, before *User) (string, error) {
+	data := EventData{User: u}
+	if before != nil {
+		changes, err := event.Diff(before, u, "updated_at", "version")
+		if err != nil {
+			return "", err
+		}
+		data.Changes = changes
+	}
+	e, err := event.New(eventType, EventSource, u.ID.String(), data)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// PurgeData is data of user.purged event, it carries no personal data since user is erased
+type PurgeData struct {
+	UserID    uuid.UUID `json:"user_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// NewPurgeEvent builds CloudEvent JSON of user purge
+func NewPurgeEvent(id uuid.UUID, deletedAt time.Time) (string, error) {
+	e, err := event.New(EventPurged, EventSource, id.String(), PurgeData{UserID: id, DeletedAt: deletedAt})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// enqueueEvent writes user event to outbox in transaction tx, event type is used as routing key.
+// Events are not written in CDC mode since they are published from replication slot
+func (s *service) enqueueEvent(tx Repository, eventType string, u User, before *User) error {
+	if s.cdc {
+		return nil
+	}
+	body, err := NewEvent(eventType, u, before)
+	if err != nil {
+		return err
+	}
+	return tx.Enqueue(eventType, body)
+}
+
+// enqueuePurge writes user.purged event to outbox in transaction tx, it is not written in CDC mode
+func (s *service) enqueuePurge(tx Repository, u User) error {
+	if s.cdc {
+		return nil
+	}
+	var deletedAt time.Time
+	if u.DeletedAt != nil {
+		deletedAt = *u.DeletedAt
+	}
+	body, err := NewPurgeEvent(u.ID, deletedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Enqueue(EventPurged, body)
+}
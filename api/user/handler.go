@@ -1,45 +1,95 @@
 package user
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+	"golang-demo/api/password"
+	"golang-demo/api/patch"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
 type userHandler struct {
-	userService Service
+	userService    Service
+	passwordPolicy password.Policy
 }
 
-func NewUserHandler(userService Service) *userHandler {
-	return &userHandler{userService}
+func NewUserHandler(userService Service, passwordPolicy password.Policy) *userHandler {
+	return &userHandler{userService, passwordPolicy}
 }
 
 // make validation errors more user friendly
-func validationErrorsToStr(errors validator.ValidationErrors) string {
-	var errorMessages []string
+func validationErrorsToList(errors validator.ValidationErrors) []FieldError {
+	var fieldErrors []FieldError
 	for _, vError := range errors {
 		switch fieldName := vError.Field(); fieldName {
 		case "FirstName":
-			errorMessages = append(errorMessages, "first_name required")
+			fieldErrors = append(fieldErrors, FieldError{"first_name", vError.Tag(), "first_name required"})
 		case "LastName":
-			errorMessages = append(errorMessages, "last_name required")
+			fieldErrors = append(fieldErrors, FieldError{"last_name", vError.Tag(), "last_name required"})
 		case "Nickname":
-			errorMessages = append(errorMessages, "nickname required")
+			fieldErrors = append(fieldErrors, FieldError{"nickname", vError.Tag(), "nickname required"})
 		case "Password":
-			errorMessages = append(errorMessages, "password must be ascii only,min=8,max=72")
+			fieldErrors = append(fieldErrors, FieldError{"password", vError.Tag(), "password required"})
 		case "Email":
-			errorMessages = append(errorMessages, "email required")
+			fieldErrors = append(fieldErrors, FieldError{"email", vError.Tag(), "email required"})
 		case "Country":
-			errorMessages = append(errorMessages, "country must be two-letter country code uppercase")
+			fieldErrors = append(fieldErrors, FieldError{"country", vError.Tag(), "country must be two-letter country code uppercase"})
 		}
 	}
-	return strings.Join(errorMessages, ";")
+	return fieldErrors
+}
+
+// PasswordViolationsToList converts password policy violations to field errors of password field
+func PasswordViolationsToList(violations []password.Violation) []FieldError {
+	fieldErrors := make([]FieldError, len(violations))
+	for i, v := range violations {
+		fieldErrors[i] = FieldError{"password", v.Rule, v.Message}
+	}
+	return fieldErrors
+}
+
+// validateInput checks input fields and password policy, returns nil if input is valid
+func (handler *userHandler) validateInput(input InputUser) render.Renderer {
+	var fieldErrors []FieldError
+	validate := validator.New()
+	if err := validate.Struct(input); err != nil {
+		fieldErrors = validationErrorsToList(err.(validator.ValidationErrors))
+	}
+	if input.Password != "" {
+		violations := handler.passwordPolicy.Check(input.Password, input.Nickname, input.Email)
+		fieldErrors = append(fieldErrors, PasswordViolationsToList(violations)...)
+	}
+	if len(fieldErrors) > 0 {
+		return ErrValidation(fieldErrors)
+	}
+	return nil
+}
+
+// validateUpdate checks input fields except password, which can't be changed by update
+func (handler *userHandler) validateUpdate(input InputUser) render.Renderer {
+	var fieldErrors []FieldError
+	validate := validator.New()
+	if err := validate.StructExcept(input, "Password"); err != nil {
+		fieldErrors = validationErrorsToList(err.(validator.ValidationErrors))
+	}
+	if input.Password != "" {
+		fieldErrors = append(fieldErrors, FieldError{"password", "excluded", "password can be changed only by POST /users/{userId}/password"})
+	}
+	if len(fieldErrors) > 0 {
+		return ErrValidation(fieldErrors)
+	}
+	return nil
 }
 
 func (handler *userHandler) Store(w http.ResponseWriter, r *http.Request) {
@@ -50,14 +100,12 @@ func (handler *userHandler) Store(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	validate := validator.New()
-	if err = validate.Struct(input); err != nil {
-		validationErrors := err.(validator.ValidationErrors)
-		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: validationErrorsToStr(validationErrors)})
+	if errResponse := handler.validateInput(input); errResponse != nil {
+		_ = render.Render(w, r, errResponse)
 		return
 	}
 
-	created, err := handler.userService.Store(input)
+	created, err := handler.userService.Store(input, RequestActor(r))
 	if err != nil {
 		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during create", Err: err, ErrorText: err.Error()})
 		return
@@ -79,7 +127,8 @@ func (handler *userHandler) Get(w http.ResponseWriter, r *http.Request) {
 	}
 	name := r.URL.Query().Get("name")
 	country := r.URL.Query().Get("country")
-	users, totalCount, err := handler.userService.Get(name, country, page, pageSize)
+	includeDeleted := r.URL.Query().Get("include_deleted") == "true"
+	users, totalCount, err := handler.userService.Get(name, country, includeDeleted, page, pageSize)
 	if err != nil {
 		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
 		return
@@ -87,13 +136,45 @@ func (handler *userHandler) Get(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, Response{map[string]any{"users": users, "total_count": totalCount}})
 }
 
+// GetByID returns user with its version as ETag, it may be sent back in If-Match header of PUT and DELETE
 func (handler *userHandler) GetByID(w http.ResponseWriter, r *http.Request) {
 	userByID := r.Context().Value("user").(User)
+	w.Header().Set("ETag", etag(userByID.Version))
 	render.JSON(w, r, Response{userByID})
 }
 
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ifMatch resolves If-Match header against current user, it returns version which change must be conditioned on,
+// 0 when header is absent or "*", and false when none of entity tags matches
+func ifMatch(r *http.Request, current User) (int64, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag(current.Version) {
+			return current.Version, true
+		}
+	}
+	return 0, false
+}
+
+// errPreconditionFailed responds 412 with current version of user as ETag
+func errPreconditionFailed(w http.ResponseWriter, r *http.Request, version int64) {
+	w.Header().Set("ETag", etag(version))
+	_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 412, StatusText: "precondition failed", ErrorText: "user was changed, reload it and retry"})
+}
+
 func (handler *userHandler) Update(w http.ResponseWriter, r *http.Request) {
-	userId := r.Context().Value("user").(User).ID
+	current := r.Context().Value("user").(User)
+	version, ok := ifMatch(r, current)
+	if !ok {
+		errPreconditionFailed(w, r, current.Version)
+		return
+	}
 	var input InputUser
 	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
@@ -101,14 +182,111 @@ func (handler *userHandler) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if errResponse := handler.validateUpdate(input); errResponse != nil {
+		_ = render.Render(w, r, errResponse)
+		return
+	}
+
+	err = handler.userService.Update(current.ID, input, version, RequestActor(r))
+	var conflict *VersionConflictError
+	if errors.As(err, &conflict) {
+		errPreconditionFailed(w, r, conflict.Actual)
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during update", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, Response{map[string]string{"message": "successfully updated"}})
+}
+
+// Patch changes user by JSON Merge Patch (RFC 7386) or JSON Patch (RFC 6902) body chosen by Content-Type,
+// patch is applied to PatchUser document of user and only changed fields are validated and stored
+func (handler *userHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	current := r.Context().Value("user").(User)
+	if _, ok := ifMatch(r, current); !ok {
+		errPreconditionFailed(w, r, current.Version)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	doc, err := json.Marshal(NewPatchUser(current))
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	var patched []byte
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case patch.MergePatchType:
+		patched, err = patch.Merge(doc, body)
+	case patch.JSONPatchType:
+		patched, err = patch.Apply(doc, body)
+	default:
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 415, StatusText: "unsupported media type",
+			ErrorText: "content type must be " + patch.MergePatchType + " or " + patch.JSONPatchType})
+		return
+	}
+	if errors.Is(err, patch.ErrTestFailed) {
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 409, StatusText: "conflict", Err: err, ErrorText: err.Error()})
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	var input PatchUser
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&input); err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	columns, fields := input.Changes(current)
+	if len(columns) == 0 {
+		render.JSON(w, r, Response{map[string]string{"message": "nothing to update"}})
+		return
+	}
+	if err = validator.New().StructPartial(input, fields...); err != nil {
+		_ = render.Render(w, r, ErrValidation(validationErrorsToList(err.(validator.ValidationErrors))))
+		return
+	}
+
+	// patch is applied to loaded user, so write is conditioned on its version even without If-Match
+	err = handler.userService.Patch(current.ID, columns, current.Version, RequestActor(r))
+	var conflict *VersionConflictError
+	if errors.As(err, &conflict) {
+		errPreconditionFailed(w, r, conflict.Actual)
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during update", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, Response{map[string]string{"message": "successfully updated"}})
+}
+
+func (handler *userHandler) SetRole(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value("user").(User).ID
+	var input InputRole
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
 	validate := validator.New()
 	if err = validate.Struct(input); err != nil {
-		validationErrors := err.(validator.ValidationErrors)
-		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: validationErrorsToStr(validationErrors)})
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "role must be one of admin,support,member"})
 		return
 	}
 
-	err = handler.userService.Update(userId, input)
+	err = handler.userService.SetRole(userId, input.Role, RequestActor(r))
 	if err != nil {
 		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during update", Err: err, ErrorText: err.Error()})
 		return
@@ -117,8 +295,18 @@ func (handler *userHandler) Update(w http.ResponseWriter, r *http.Request) {
 }
 
 func (handler *userHandler) Delete(w http.ResponseWriter, r *http.Request) {
-	id := r.Context().Value("user").(User).ID
-	err := handler.userService.Delete(id)
+	current := r.Context().Value("user").(User)
+	version, ok := ifMatch(r, current)
+	if !ok {
+		errPreconditionFailed(w, r, current.Version)
+		return
+	}
+	err := handler.userService.Delete(current.ID, version, RequestActor(r))
+	var conflict *VersionConflictError
+	if errors.As(err, &conflict) {
+		errPreconditionFailed(w, r, conflict.Actual)
+		return
+	}
 	if err != nil {
 		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during delete", Err: err, ErrorText: err.Error()})
 		return
@@ -126,15 +314,118 @@ func (handler *userHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, Response{map[string]string{"message": "successfully deleted"}})
 }
 
+// Restore undoes deletion of user, it is not loaded by UserCtx since deleted users are not found there
+func (handler *userHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	userId, err := uuid.Parse(chi.URLParam(r, "userId"))
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	err = handler.userService.Restore(userId, RequestActor(r))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_ = render.Render(w, r, ErrNotFound)
+	case errors.Is(err, ErrNotDeleted), errors.Is(err, ErrNicknameTaken):
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 409, StatusText: "conflict", Err: err, ErrorText: err.Error()})
+	case err != nil:
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during restore", Err: err, ErrorText: err.Error()})
+	default:
+		render.JSON(w, r, Response{map[string]string{"message": "successfully restored"}})
+	}
+}
+
+// GetAudit returns paginated audit log of user, the latest first, with result of hash chain verification,
+// verify=full query param verifies the whole chain instead of entries added since the last verification
+func (handler *userHandler) GetAudit(w http.ResponseWriter, r *http.Request) {
+	userId, err := uuid.Parse(chi.URLParam(r, "userId"))
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	pageSize := 10
+	page := 1
+	if pageStr := r.URL.Query().Get("page"); pageStr != "" {
+		page, _ = strconv.Atoi(pageStr)
+	}
+	if pageSizeStr := r.URL.Query().Get("page_size"); pageSizeStr != "" {
+		pageSize, _ = strconv.Atoi(pageSizeStr)
+	}
+	full := r.URL.Query().Get("verify") == "full"
+	entries, totalCount, brokenAt, err := handler.userService.GetAudit(userId, page, pageSize, full)
+	if err != nil {
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
+		return
+	}
+	data := map[string]any{"entries": entries, "total_count": totalCount, "chain_valid": brokenAt == 0}
+	if brokenAt != 0 {
+		data["broken_at"] = brokenAt
+	}
+	render.JSON(w, r, Response{data})
+}
+
+func (handler *userHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value("user").(User).ID
+	var input InputEmailVerification
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	validate := validator.New()
+	if err = validate.Struct(input); err != nil {
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "validation errors", Err: err, ErrorText: "token required"})
+		return
+	}
+
+	err = handler.userService.VerifyEmail(userId, input.Token, RequestActor(r))
+	if errors.Is(err, ErrVerificationTokenInvalid) {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during verification", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.JSON(w, r, Response{map[string]string{"message": "email successfully verified"}})
+}
+
+func (handler *userHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value("user").(User).ID
+	err := handler.userService.ResendVerification(userId)
+	if errors.Is(err, ErrVerificationThrottled) {
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 429, StatusText: "too many requests", Err: err, ErrorText: err.Error()})
+		return
+	}
+	if errors.Is(err, ErrEmailAlreadyVerified) {
+		_ = render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, &ErrResponse{HTTPStatusCode: 400, StatusText: "error during resend", Err: err, ErrorText: err.Error()})
+		return
+	}
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, Response{map[string]string{"message": "verification email will be sent"}})
+}
+
 type Response struct {
 	Data interface{} `json:"data"`
 }
 
 type ErrResponse struct {
-	Err            error  `json:"-"`
-	HTTPStatusCode int    `json:"-"`
-	StatusText     string `json:"status"`
-	ErrorText      string `json:"error,omitempty"`
+	Err            error        `json:"-"`
+	HTTPStatusCode int          `json:"-"`
+	StatusText     string       `json:"status"`
+	ErrorText      string       `json:"error,omitempty"`
+	Errors         []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes single failed validation rule of input field
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
 }
 
 func (e *ErrResponse) Render(_ http.ResponseWriter, r *http.Request) error {
@@ -151,6 +442,19 @@ func ErrInvalidRequest(err error) render.Renderer {
 	}
 }
 
+func ErrValidation(fieldErrors []FieldError) render.Renderer {
+	messages := make([]string, len(fieldErrors))
+	for i, e := range fieldErrors {
+		messages[i] = e.Message
+	}
+	return &ErrResponse{
+		HTTPStatusCode: 400,
+		StatusText:     "validation errors",
+		ErrorText:      strings.Join(messages, ";"),
+		Errors:         fieldErrors,
+	}
+}
+
 var ErrNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "resource not found"}
 
 // UserCtx retrieves user by id and stores it in request context
@@ -162,7 +466,12 @@ func (handler *userHandler) UserCtx(next http.Handler) http.Handler {
 			_ = render.Render(w, r, ErrInvalidRequest(err))
 			return
 		}
-		userById, err := handler.userService.GetById(userId)
+		var userById User
+		if r.Method == http.MethodGet && r.URL.Query().Get("include_deleted") == "true" {
+			userById, err = handler.userService.GetByIdWithDeleted(userId)
+		} else {
+			userById, err = handler.userService.GetById(userId)
+		}
 		if err != nil {
 			_ = render.Render(w, r, ErrNotFound)
 			return
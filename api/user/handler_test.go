@@ -0,0 +1,188 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/patch"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func (s *serviceMock) Patch(_ uuid.UUID, columns map[string]interface{}, version int64, _ Actor) error {
+	s.patched = columns
+	s.version = version
+	return s.err
+}
+
+func (s *serviceMock) Update(_ uuid.UUID, _ InputUser, version int64, _ Actor) error {
+	s.version = version
+	return s.err
+}
+
+func testUser() User {
+	return User{ID: uuid.New(), FirstName: "John", LastName: "Doe", Nickname: "nickname", Email: "john@example.com",
+		Country: "US", Version: 5}
+}
+
+// serve calls handler with user loaded into request context the same way as UserCtx does
+func serve(handler http.HandlerFunc, current User, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, r.WithContext(context.WithValue(r.Context(), "user", current)))
+	return w
+}
+
+const updateBody = `{"first_name": "Jane", "last_name": "Doe", "nickname": "nickname", "email": "jane@example.com", "country": "US"}`
+
+func newPatchRequest(contentType string, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+func TestPatchUnsupportedMediaType(t *testing.T) {
+	service := &serviceMock{}
+	handler := NewUserHandler(service, nil)
+
+	w := serve(handler.Patch, testUser(), newPatchRequest("application/json", `{"country": "DE"}`))
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Nil(t, service.patched)
+}
+
+func TestPatchMerge(t *testing.T) {
+	service := &serviceMock{}
+	handler := NewUserHandler(service, nil)
+	current := testUser()
+
+	w := serve(handler.Patch, current, newPatchRequest(patch.MergePatchType, `{"country": "DE", "first_name": "Jane"}`))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]interface{}{"country": "DE", "first_name": "Jane"}, service.patched)
+	// write is conditioned on version of loaded user even without If-Match
+	assert.Equal(t, current.Version, service.version)
+}
+
+func TestPatchMergeValidatesChangedFields(t *testing.T) {
+	service := &serviceMock{}
+	handler := NewUserHandler(service, nil)
+
+	w := serve(handler.Patch, testUser(), newPatchRequest(patch.MergePatchType, `{"country": "Germany"}`))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Nil(t, service.patched)
+}
+
+func TestPatchJSONPatch(t *testing.T) {
+	service := &serviceMock{}
+	handler := NewUserHandler(service, nil)
+	body := `[{"op": "test", "path": "/nickname", "value": "nickname"},
+		{"op": "replace", "path": "/email", "value": "jane@example.com"}]`
+
+	w := serve(handler.Patch, testUser(), newPatchRequest(patch.JSONPatchType, body))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, map[string]interface{}{"email": "jane@example.com"}, service.patched)
+}
+
+func TestPatchFailedTestIsConflict(t *testing.T) {
+	service := &serviceMock{}
+	handler := NewUserHandler(service, nil)
+	body := `[{"op": "test", "path": "/nickname", "value": "other"}, {"op": "replace", "path": "/country", "value": "DE"}]`
+
+	w := serve(handler.Patch, testUser(), newPatchRequest(patch.JSONPatchType, body))
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Nil(t, service.patched)
+}
+
+func TestPatchVersionConflict(t *testing.T) {
+	current := testUser()
+	service := &serviceMock{err: &VersionConflictError{ID: current.ID, Expected: current.Version, Actual: current.Version + 1}}
+	handler := NewUserHandler(service, nil)
+
+	w := serve(handler.Patch, current, newPatchRequest(patch.MergePatchType, `{"country": "DE"}`))
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, etag(current.Version+1), w.Header().Get("ETag"))
+	var response ErrResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "precondition failed", response.StatusText)
+}
+
+func TestGetByIDSetsETag(t *testing.T) {
+	handler := NewUserHandler(&serviceMock{}, nil)
+
+	w := serve(handler.GetByID, testUser(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"5"`, w.Header().Get("ETag"))
+}
+
+func TestUpdateIfMatch(t *testing.T) {
+	service := &serviceMock{}
+	handler := NewUserHandler(service, nil)
+	r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(updateBody))
+	r.Header.Set("If-Match", `"4", "5"`)
+
+	w := serve(handler.Update, testUser(), r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(5), service.version)
+}
+
+func TestUpdateStaleIfMatch(t *testing.T) {
+	service := &serviceMock{version: -1}
+	handler := NewUserHandler(service, nil)
+	r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(updateBody))
+	r.Header.Set("If-Match", `"4"`)
+
+	w := serve(handler.Update, testUser(), r)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, `"5"`, w.Header().Get("ETag"))
+	assert.Equal(t, int64(-1), service.version)
+}
+
+func TestUpdateVersionConflict(t *testing.T) {
+	current := testUser()
+	service := &serviceMock{err: &VersionConflictError{ID: current.ID, Expected: 5, Actual: 6}}
+	handler := NewUserHandler(service, nil)
+	r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(updateBody))
+	r.Header.Set("If-Match", `"5"`)
+
+	w := serve(handler.Update, current, r)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, `"6"`, w.Header().Get("ETag"))
+}
+
+func TestDeleteStaleIfMatch(t *testing.T) {
+	service := &serviceMock{}
+	handler := NewUserHandler(service, nil)
+	r := httptest.NewRequest(http.MethodDelete, "/", nil)
+	r.Header.Set("If-Match", `"4"`)
+
+	w := serve(handler.Delete, testUser(), r)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, `"5"`, w.Header().Get("ETag"))
+	assert.Empty(t, service.deleted)
+}
+
+func TestDeleteVersionConflict(t *testing.T) {
+	current := testUser()
+	service := &serviceMock{err: &VersionConflictError{ID: current.ID, Expected: 5, Actual: 7}}
+	handler := NewUserHandler(service, nil)
+	r := httptest.NewRequest(http.MethodDelete, "/", nil)
+	r.Header.Set("If-Match", `"5"`)
+
+	w := serve(handler.Delete, current, r)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, `"7"`, w.Header().Get("ETag"))
+	assert.Empty(t, service.deleted)
+}
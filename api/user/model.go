@@ -5,25 +5,81 @@ import (
 	"time"
 )
 
+const (
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+	RoleMember  = "member"
+)
+
 // User holds the structure of user entity in db, all fields are shown in response json except password
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Nickname  string    `json:"nickname"`
-	Password  string    `json:"-"`
-	Email     string    `json:"email"`
-	Country   string    `json:"country"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              uuid.UUID  `json:"id"`
+	FirstName       string     `json:"first_name"`
+	LastName        string     `json:"last_name"`
+	Nickname        string     `json:"nickname"`
+	Password        string     `json:"-"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Country         string     `json:"country"`
+	Role            string     `json:"role"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	DeactivatedAt   *time.Time `json:"deactivated_at"`
+	DeletedAt       *time.Time `json:"deleted_at"`
+	Version         int64      `json:"version"`
 }
 
-// InputUser represents json body for users POST/PUT api
+// InputUser represents json body for users POST/PUT api, password is additionally checked by password policy.
+// Password is set only on create, it is changed by password change api
 type InputUser struct {
 	FirstName string `json:"first_name" validate:"required"`
 	LastName  string `json:"last_name" validate:"required"`
 	Nickname  string `json:"nickname" validate:"required"`
-	Password  string `json:"password" validate:"required,ascii,min=8,max=72"`
+	Password  string `json:"password" validate:"required"`
+	Email     string `json:"email" validate:"required,email"`
+	Country   string `json:"country" validate:"required,iso3166_1_alpha2"`
+}
+
+// PatchUser is user document which PATCH api body is applied to, password can't be patched
+type PatchUser struct {
+	FirstName string `json:"first_name" validate:"required"`
+	LastName  string `json:"last_name" validate:"required"`
+	Nickname  string `json:"nickname" validate:"required"`
 	Email     string `json:"email" validate:"required,email"`
 	Country   string `json:"country" validate:"required,iso3166_1_alpha2"`
 }
+
+func NewPatchUser(u User) PatchUser {
+	return PatchUser{FirstName: u.FirstName, LastName: u.LastName, Nickname: u.Nickname, Email: u.Email, Country: u.Country}
+}
+
+// Changes returns columns changed by patch compared to user and names of changed fields for partial validation
+func (p PatchUser) Changes(u User) (map[string]interface{}, []string) {
+	columns := map[string]interface{}{}
+	var fields []string
+	for _, c := range []struct {
+		column, field, before, after string
+	}{
+		{"first_name", "FirstName", u.FirstName, p.FirstName},
+		{"last_name", "LastName", u.LastName, p.LastName},
+		{"nickname", "Nickname", u.Nickname, p.Nickname},
+		{"email", "Email", u.Email, p.Email},
+		{"country", "Country", u.Country, p.Country},
+	} {
+		if c.before != c.after {
+			columns[c.column] = c.after
+			fields = append(fields, c.field)
+		}
+	}
+	return columns, fields
+}
+
+// InputRole represents json body for user role PUT api
+type InputRole struct {
+	Role string `json:"role" validate:"required,oneof=admin support member"`
+}
+
+// InputEmailVerification represents json body for email verification api
+type InputEmailVerification struct {
+	Token string `json:"token" validate:"required"`
+}
@@ -0,0 +1,60 @@
+package user
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/config"
+	"time"
+)
+
+// purger hard-deletes users which are deleted longer than retention period, user.purged event is the last
+// event of user. Several instances may run purger, users locked by one of them are skipped by others
+type purger struct {
+	service   Service
+	retention time.Duration
+	interval  time.Duration
+	batchSize int
+}
+
+func NewPurger(service Service, cfg config.Config) *purger {
+	p := &purger{
+		service:   service,
+		retention: cfg.UserRetention,
+		interval:  cfg.UserPurgeInterval,
+		batchSize: cfg.UserPurgeBatchSize,
+	}
+	if p.interval <= 0 {
+		p.interval = time.Hour
+	}
+	if p.batchSize <= 0 {
+		p.batchSize = 100
+	}
+	return p
+}
+
+// Run purges users every interval until ctx is cancelled, purge is disabled when retention is not set
+func (p *purger) Run(ctx context.Context) {
+	if p.retention <= 0 {
+		log.Infoln("user purge is disabled")
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			n, err := p.service.Purge(time.Now().Add(-p.retention), p.batchSize)
+			if err != nil {
+				log.Errorln("failed to purge deleted users", err)
+			}
+			if err != nil || n < p.batchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			log.Infoln("user purger stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,27 +2,53 @@ package user
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"golang-demo/api/outbox"
 	"strings"
 	"time"
 )
 
 type Repository interface {
 	Insert(input InputUser) (uuid.UUID, error)
-	Select(name string, country string, offset int, limit int) ([]User, int64, error)
+	Select(name string, country string, includeDeleted bool, offset int, limit int) ([]User, int64, error)
 	SelectById(id uuid.UUID) (User, error)
-	Update(id uuid.UUID, input InputUser) error
-	Delete(id uuid.UUID) error
+	SelectByIdWithDeleted(id uuid.UUID) (User, error)
+	SelectPurgeable(deletedBefore time.Time, limit int) ([]User, error)
+	SelectAfter(afterID uuid.UUID, limit int) ([]User, error)
+	SelectByLogin(login string) (User, error)
+	Update(id uuid.UUID, input InputUser, version int64) error
+	UpdateFields(id uuid.UUID, columns map[string]interface{}, version int64) error
+	UpdateRole(id uuid.UUID, role string) error
+	UpdatePassword(id uuid.UUID, passwordHash string) error
+	UpdateCountry(id uuid.UUID, country string) error
+	VerifyEmail(id uuid.UUID, tokenHash string) error
+	Deactivate(id uuid.UUID) error
+	Activate(id uuid.UUID) error
+	Delete(id uuid.UUID, version int64) error
+	Restore(id uuid.UUID) error
+	Purge(id uuid.UUID) error
+	Enqueue(topic string, payload string) error
+	InsertAudit(entry AuditEntry) error
+	SelectAudit(userID uuid.UUID, offset int, limit int) ([]AuditEntry, int64, error)
+	RedactAudit(userID uuid.UUID) error
+	SelectAuditChain(userID uuid.UUID, afterSeq int64) ([]AuditEntry, error)
+	SelectAuditCheckpoint(userID uuid.UUID) (int64, string, error)
+	SaveAuditCheckpoint(userID uuid.UUID, seq int64, hash string) error
+	Transaction(fn func(tx Repository) error) error
+	Runner() sq.BaseRunner
 }
 
 type repository struct {
-	db *sql.DB
+	db   sq.StdSqlCtx
+	conn *sql.DB
 }
 
 func NewRepository(db *sql.DB) *repository {
-	return &repository{db}
+	return &repository{db, db}
 }
 
 var psql sq.StatementBuilderType
@@ -31,6 +57,207 @@ func init() {
 	psql = sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 }
 
+var ErrNicknameTaken = errors.New("nickname is taken by other user")
+
+// VersionConflictError is returned by conditional change when user was changed after expected version was read
+type VersionConflictError struct {
+	ID       uuid.UUID
+	Expected int64
+	Actual   int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("user %s was changed, expected version %d, actual %d", e.ID, e.Expected, e.Actual)
+}
+
+// nextVersion increases version of user on every change
+var nextVersion = sq.Expr("version + 1")
+
+var userColumns = []string{"id", "first_name", "last_name", "nickname", "password", "email", "email_verified_at", "country", "role", "created_at", "updated_at", "deactivated_at", "deleted_at", "version"}
+
+// notDeleted excludes soft deleted users, they are returned only when asked explicitly
+var notDeleted = sq.Eq{"deleted_at": nil}
+
+// userFields returns scan destinations in userColumns order
+func userFields(u *User) []interface{} {
+	return []interface{}{&u.ID, &u.FirstName, &u.LastName, &u.Nickname, &u.Password, &u.Email, &u.EmailVerifiedAt, &u.Country, &u.Role, &u.CreatedAt, &u.UpdatedAt, &u.DeactivatedAt, &u.DeletedAt, &u.Version}
+}
+
+func scanUsers(rows *sql.Rows) ([]User, error) {
+	users := []User{}
+	defer rows.Close()
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(userFields(&u)...); err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Transaction runs fn with repository bound to single db transaction, which is committed when fn succeeds.
+// Calling Transaction on repository passed to fn reuses the same transaction
+func (r *repository) Transaction(fn func(tx Repository) error) error {
+	if r.conn == nil {
+		return fn(r)
+	}
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = fn(&repository{db: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyEmail consumes token and marks email as verified, token issued for previous email of user is rejected.
+// It must run in Transaction, so used token is kept when user is not changed
+func (r *repository) VerifyEmail(id uuid.UUID, tokenHash string) error {
+	var email string
+	err := psql.Update("email_verification_tokens").Set("used_at", time.Now()).
+		Where(sq.Eq{"token_hash": tokenHash, "user_id": id, "used_at": nil}).Where("expires_at > now()").
+		Suffix("RETURNING email").RunWith(r.db).QueryRow().Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	res, err := psql.Update("users").Set("email_verified_at", time.Now()).Set("version", nextVersion).
+		Where(sq.Eq{"id": id, "email": email}).RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrVerificationTokenInvalid
+	}
+	return nil
+}
+
+// Runner returns db handle repository is bound to, it is transaction inside Transaction,
+// so repositories of other packages may change user in the same transaction
+func (r *repository) Runner() sq.BaseRunner {
+	return r.db
+}
+
+// Enqueue adds event to outbox, it is published to RabbitMQ by outbox relay after transaction commit
+func (r *repository) Enqueue(topic string, payload string) error {
+	return outbox.Insert(r.db, outbox.Message{Topic: topic, Payload: payload})
+}
+
+var auditColumns = []string{"id", "user_id", "seq", "action", "actor_type", "actor_id", "request_id", "ip", "diff", "prev_hash", "hash", "created_at", "redacted_at"}
+
+// InsertAudit appends entry to audit chain of user, it must run in transaction which changes user,
+// so concurrent mutations of the same user are serialized by row lock and unique (user_id, seq)
+func (r *repository) InsertAudit(entry AuditEntry) error {
+	var seq int64
+	err := psql.Select("seq", "hash").From("user_audit").Where(sq.Eq{"user_id": entry.UserID}).
+		OrderBy("seq DESC").Limit(1).RunWith(r.db).QueryRow().Scan(&seq, &entry.PrevHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	entry.Seq = seq + 1
+	// db keeps microseconds, hash must be reproducible from stored value
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	entry.Hash = entry.ComputeHash()
+	_, err = psql.Insert("user_audit").SetMap(map[string]interface{}{
+		"user_id":    entry.UserID,
+		"seq":        entry.Seq,
+		"action":     entry.Action,
+		"actor_type": entry.ActorType,
+		"actor_id":   entry.ActorID,
+		"request_id": entry.RequestID,
+		"ip":         entry.IP,
+		"diff":       []byte(entry.Diff),
+		"prev_hash":  entry.PrevHash,
+		"hash":       entry.Hash,
+		"created_at": entry.CreatedAt,
+	}).RunWith(r.db).Exec()
+	return err
+}
+
+// RedactAudit erases diff and ip of audit entries of purged user, user_audit trigger allows only this update
+func (r *repository) RedactAudit(userID uuid.UUID) error {
+	_, err := psql.Update("user_audit").SetMap(map[string]interface{}{
+		"diff":        []byte(`{}`),
+		"ip":          "",
+		"redacted_at": time.Now(),
+	}).Where(sq.Eq{"user_id": userID, "redacted_at": nil}).RunWith(r.db).Exec()
+	return err
+}
+
+func scanAuditEntries(rows *sql.Rows) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	defer rows.Close()
+	for rows.Next() {
+		var e AuditEntry
+		var diff []byte
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Seq, &e.Action, &e.ActorType, &e.ActorID, &e.RequestID, &e.IP, &diff,
+			&e.PrevHash, &e.Hash, &e.CreatedAt, &e.RedactedAt); err != nil {
+			return entries, err
+		}
+		e.Diff = diff
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// SelectAudit returns page of audit entries of user, the latest first
+func (r *repository) SelectAudit(userID uuid.UUID, offset int, limit int) ([]AuditEntry, int64, error) {
+	var totalCount int64
+	err := psql.Select("count(1) AS total").From("user_audit").Where(sq.Eq{"user_id": userID}).
+		RunWith(r.db).QueryRow().Scan(&totalCount)
+	if err != nil {
+		return []AuditEntry{}, totalCount, err
+	}
+	rows, err := psql.Select(auditColumns...).From("user_audit").Where(sq.Eq{"user_id": userID}).
+		OrderBy("seq DESC").Offset(uint64(offset)).Limit(uint64(limit)).RunWith(r.db).Query()
+	if err != nil {
+		return []AuditEntry{}, totalCount, err
+	}
+	entries, err := scanAuditEntries(rows)
+	return entries, totalCount, err
+}
+
+// SelectAuditChain returns audit entries of user after given seq ordered by seq for chain verification
+func (r *repository) SelectAuditChain(userID uuid.UUID, afterSeq int64) ([]AuditEntry, error) {
+	rows, err := psql.Select(auditColumns...).From("user_audit").Where(sq.Eq{"user_id": userID}).
+		Where(sq.Gt{"seq": afterSeq}).OrderBy("seq").RunWith(r.db).Query()
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	return scanAuditEntries(rows)
+}
+
+// SelectAuditCheckpoint returns seq and hash of the last verified audit entry of user, 0 and empty hash if
+// chain was not verified yet
+func (r *repository) SelectAuditCheckpoint(userID uuid.UUID) (int64, string, error) {
+	var seq int64
+	var hash string
+	err := psql.Select("seq", "hash").From("user_audit_checkpoints").Where(sq.Eq{"user_id": userID}).
+		RunWith(r.db).QueryRow().Scan(&seq, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", nil
+	}
+	return seq, hash, err
+}
+
+// SaveAuditCheckpoint stores the last verified audit entry of user, checkpoint never moves back
+func (r *repository) SaveAuditCheckpoint(userID uuid.UUID, seq int64, hash string) error {
+	_, err := psql.Insert("user_audit_checkpoints").SetMap(map[string]interface{}{
+		"user_id":     userID,
+		"seq":         seq,
+		"hash":        hash,
+		"verified_at": time.Now(),
+	}).Suffix("ON CONFLICT (user_id) DO UPDATE SET seq = excluded.seq, hash = excluded.hash, " +
+		"verified_at = excluded.verified_at WHERE user_audit_checkpoints.seq < excluded.seq").RunWith(r.db).Exec()
+	return err
+}
+
 func (r *repository) Insert(input InputUser) (uuid.UUID, error) {
 	var id uuid.UUID
 	query :=
@@ -49,20 +276,24 @@ func (r *repository) Insert(input InputUser) (uuid.UUID, error) {
 	return id, nil
 }
 
-func (r *repository) Select(name string, country string, offset int, limit int) ([]User, int64, error) {
+func (r *repository) Select(name string, country string, includeDeleted bool, offset int, limit int) ([]User, int64, error) {
 	var users []User
 	var totalCount int64
 
 	builder := func(sel sq.SelectBuilder) sq.SelectBuilder {
 		query := sel.From("users")
 		if name != "" {
-			query = query.Where("first_name ILIKE ? OR last_name ILIKE ?",
-				fmt.Sprint("%", name, "%"),
-				fmt.Sprint("%", name, "%"))
+			query = query.Where(sq.Or{
+				sq.ILike{"first_name": fmt.Sprint("%", name, "%")},
+				sq.ILike{"last_name": fmt.Sprint("%", name, "%")},
+			})
 		}
 		if country != "" {
 			query = query.Where("country = ?", strings.ToUpper(country))
 		}
+		if !includeDeleted {
+			query = query.Where(notDeleted)
+		}
 		return query
 	}
 
@@ -70,14 +301,14 @@ func (r *repository) Select(name string, country string, offset int, limit int)
 	if err != nil {
 		return users, totalCount, err
 	}
-	rows, err := builder(psql.Select("id", "first_name", "last_name", "nickname", "password", "email", "country", "created_at", "updated_at")).
+	rows, err := builder(psql.Select(userColumns...)).
 		Offset(uint64(offset)).Limit(uint64(limit)).RunWith(r.db).Query()
 	if err != nil {
 		return users, totalCount, err
 	}
 	for rows.Next() {
 		var u User
-		err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Nickname, &u.Password, &u.Email, &u.Country, &u.CreatedAt, &u.UpdatedAt)
+		err := rows.Scan(userFields(&u)...)
 		if err != nil {
 			return users, totalCount, err
 		}
@@ -90,34 +321,275 @@ func (r *repository) Select(name string, country string, offset int, limit int)
 	return users, totalCount, nil
 }
 
+// SelectAfter returns page of users ordered by id starting after afterID, it is used to walk all users
+// with keyset pagination which is stable while users are changed
+func (r *repository) SelectAfter(afterID uuid.UUID, limit int) ([]User, error) {
+	users := []User{}
+	rows, err := psql.Select(userColumns...).From("users").Where(sq.Gt{"id": afterID}).Where(notDeleted).
+		OrderBy("id").Limit(uint64(limit)).RunWith(r.db).Query()
+	if err != nil {
+		return users, err
+	}
+	return scanUsers(rows)
+}
+
 func (r *repository) SelectById(id uuid.UUID) (User, error) {
 	var u User
 	query :=
-		psql.Select("id", "first_name", "last_name", "nickname", "password", "email", "country", "created_at", "updated_at").
-			From("users").Where(sq.Eq{"id": id})
-	err := query.RunWith(r.db).QueryRow().Scan(&u.ID, &u.FirstName, &u.LastName, &u.Nickname, &u.Password, &u.Email, &u.Country, &u.CreatedAt, &u.UpdatedAt)
+		psql.Select(userColumns...).
+			From("users").Where(sq.Eq{"id": id}).Where(notDeleted)
+	err := query.RunWith(r.db).QueryRow().Scan(userFields(&u)...)
 	if err != nil {
 		return u, err
 	}
 	return u, nil
 }
 
-func (r *repository) Update(id uuid.UUID, input InputUser) error {
+// SelectByIdWithDeleted finds user by id including soft deleted one
+func (r *repository) SelectByIdWithDeleted(id uuid.UUID) (User, error) {
+	var u User
+	err := psql.Select(userColumns...).From("users").Where(sq.Eq{"id": id}).
+		RunWith(r.db).QueryRow().Scan(userFields(&u)...)
+	return u, err
+}
+
+// SelectPurgeable returns users deleted before deletedBefore and locks them,
+// users locked by other purger are skipped
+func (r *repository) SelectPurgeable(deletedBefore time.Time, limit int) ([]User, error) {
+	rows, err := psql.Select(userColumns...).From("users").Where(sq.Lt{"deleted_at": deletedBefore}).
+		OrderBy("deleted_at").Limit(uint64(limit)).Suffix("FOR UPDATE SKIP LOCKED").RunWith(r.db).Query()
+	if err != nil {
+		return []User{}, err
+	}
+	return scanUsers(rows)
+}
+
+// SelectByLogin finds user by nickname or email, used for authentication
+func (r *repository) SelectByLogin(login string) (User, error) {
+	var u User
+	query :=
+		psql.Select(userColumns...).
+			From("users").Where(sq.Or{sq.Eq{"nickname": login}, sq.Eq{"email": login}}).Where(notDeleted)
+	err := query.RunWith(r.db).QueryRow().Scan(userFields(&u)...)
+	if err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+// Update overwrites user fields except password, changed email becomes unverified.
+// Update is applied only to given version of user, 0 version overwrites any
+func (r *repository) Update(id uuid.UUID, input InputUser, version int64) error {
 	query := psql.Update("users").SetMap(map[string]interface{}{
-		"first_name": input.FirstName,
-		"last_name":  input.LastName,
-		"nickname":   input.Nickname,
-		"password":   input.Password,
-		"email":      input.Email,
-		"country":    input.Country,
+		"first_name":        input.FirstName,
+		"last_name":         input.LastName,
+		"nickname":          input.Nickname,
+		"email_verified_at": sq.Expr("CASE WHEN email = ? THEN email_verified_at END", input.Email),
+		"email":             input.Email,
+		"country":           input.Country,
+		"updated_at":        time.Now(),
+		"version":           nextVersion,
+	}).Where("id = ?", id)
+	if version > 0 {
+		query = query.Where(sq.Eq{"version": version})
+	}
+	res, err := query.RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	return r.expectVersion(res, id, version)
+}
+
+// patchableColumns are columns which may be changed by UpdateFields
+var patchableColumns = map[string]bool{"first_name": true, "last_name": true, "nickname": true, "email": true, "country": true}
+
+// UpdateFields changes only given columns of user, changed email becomes unverified.
+// Change is applied only to given version of user, 0 version changes any
+func (r *repository) UpdateFields(id uuid.UUID, columns map[string]interface{}, version int64) error {
+	values := map[string]interface{}{
 		"updated_at": time.Now(),
+		"version":    nextVersion,
+	}
+	for column, value := range columns {
+		if !patchableColumns[column] {
+			return fmt.Errorf("column %s can't be updated", column)
+		}
+		values[column] = value
+	}
+	if email, ok := columns["email"]; ok {
+		values["email_verified_at"] = sq.Expr("CASE WHEN email = ? THEN email_verified_at END", email)
+	}
+	query := psql.Update("users").SetMap(values).Where("id = ?", id)
+	if version > 0 {
+		query = query.Where(sq.Eq{"version": version})
+	}
+	res, err := query.RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	return r.expectVersion(res, id, version)
+}
+
+func (r *repository) UpdateRole(id uuid.UUID, role string) error {
+	query := psql.Update("users").SetMap(map[string]interface{}{
+		"role":       role,
+		"updated_at": time.Now(),
+		"version":    nextVersion,
+	}).Where("id = ?", id)
+	_, err := query.RunWith(r.db).Exec()
+	return err
+}
+
+func (r *repository) UpdateCountry(id uuid.UUID, country string) error {
+	query := psql.Update("users").SetMap(map[string]interface{}{
+		"country":    country,
+		"updated_at": time.Now(),
+		"version":    nextVersion,
 	}).Where("id = ?", id)
 	_, err := query.RunWith(r.db).Exec()
 	return err
 }
 
-func (r *repository) Delete(id uuid.UUID) error {
-	query := psql.Delete("users").Where("id = ?", id)
+func (r *repository) UpdatePassword(id uuid.UUID, passwordHash string) error {
+	query := psql.Update("users").SetMap(map[string]interface{}{
+		"password":   passwordHash,
+		"updated_at": time.Now(),
+		"version":    nextVersion,
+	}).Where("id = ?", id)
 	_, err := query.RunWith(r.db).Exec()
 	return err
 }
+
+// Deactivate marks active user as deactivated, user data is kept as is
+func (r *repository) Deactivate(id uuid.UUID) error {
+	query := psql.Update("users").SetMap(map[string]interface{}{
+		"deactivated_at": time.Now(),
+		"updated_at":     time.Now(),
+		"version":        nextVersion,
+	}).Where(sq.Eq{"id": id}).Where(sq.Eq{"deactivated_at": nil}).Where(notDeleted)
+	res, err := query.RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// Activate clears deactivation mark
+func (r *repository) Activate(id uuid.UUID) error {
+	query := psql.Update("users").SetMap(map[string]interface{}{
+		"deactivated_at": nil,
+		"updated_at":     time.Now(),
+		"version":        nextVersion,
+	}).Where(sq.Eq{"id": id}).Where(sq.NotEq{"deactivated_at": nil}).Where(notDeleted)
+	res, err := query.RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// Delete marks user as deleted, row is removed by Purge after retention period.
+// Deletion is applied only to given version of user, 0 version deletes any
+func (r *repository) Delete(id uuid.UUID, version int64) error {
+	query := psql.Update("users").SetMap(map[string]interface{}{
+		"deleted_at": time.Now(),
+		"version":    nextVersion,
+	}).Where(sq.Eq{"id": id}).Where(notDeleted)
+	if version > 0 {
+		query = query.Where(sq.Eq{"version": version})
+	}
+	res, err := query.RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	return r.expectVersion(res, id, version)
+}
+
+// Restore clears deletion mark, ErrNicknameTaken is returned when nickname was taken by other user meanwhile
+func (r *repository) Restore(id uuid.UUID) error {
+	query := psql.Update("users").SetMap(map[string]interface{}{
+		"deleted_at": nil,
+		"updated_at": time.Now(),
+		"version":    nextVersion,
+	}).Where(sq.Eq{"id": id}).Where(sq.NotEq{"deleted_at": nil})
+	res, err := query.RunWith(r.db).Exec()
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrNicknameTaken
+	}
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// Purge removes row of deleted user
+func (r *repository) Purge(id uuid.UUID) error {
+	query := psql.Delete("users").Where(sq.Eq{"id": id}).Where(sq.NotEq{"deleted_at": nil})
+	res, err := query.RunWith(r.db).Exec()
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// expectVersion tells why conditional change did not change any row: sql.ErrNoRows is returned
+// when user does not exist and VersionConflictError when it has other version
+func (r *repository) expectVersion(res sql.Result, id uuid.UUID, version int64) error {
+	err := expectRow(res)
+	if !errors.Is(err, sql.ErrNoRows) || version == 0 {
+		return err
+	}
+	var actual int64
+	err = psql.Select("version").From("users").Where(sq.Eq{"id": id}).Where(notDeleted).
+		RunWith(r.db).QueryRow().Scan(&actual)
+	if err != nil {
+		return err
+	}
+	return &VersionConflictError{ID: id, Expected: version, Actual: actual}
+}
+
+// expectRow returns sql.ErrNoRows when statement did not change any row
+func expectRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+var ErrVerificationTokenInvalid = errors.New("invalid, used or expired email verification token")
+
+type VerificationRepository interface {
+	Insert(userID uuid.UUID, email string, tokenHash string, expiresAt time.Time) error
+	LastIssuedAt(userID uuid.UUID) (time.Time, error)
+}
+
+type verificationRepository struct {
+	db *sql.DB
+}
+
+func NewVerificationRepository(db *sql.DB) *verificationRepository {
+	return &verificationRepository{db}
+}
+
+func (r *verificationRepository) Insert(userID uuid.UUID, email string, tokenHash string, expiresAt time.Time) error {
+	_, err := psql.Insert("email_verification_tokens").SetMap(map[string]interface{}{
+		"token_hash": tokenHash,
+		"user_id":    userID,
+		"email":      email,
+		"expires_at": expiresAt,
+	}).RunWith(r.db).Exec()
+	return err
+}
+
+// LastIssuedAt returns creation time of the newest token of user or zero time if there are none
+func (r *verificationRepository) LastIssuedAt(userID uuid.UUID) (time.Time, error) {
+	var lastIssuedAt sql.NullTime
+	err := psql.Select("max(created_at)").From("email_verification_tokens").Where(sq.Eq{"user_id": userID}).
+		RunWith(r.db).QueryRow().Scan(&lastIssuedAt)
+	return lastIssuedAt.Time, err
+}
@@ -4,7 +4,7 @@ import (
 	"database/sql"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -28,8 +28,8 @@ func TestFindUserById(t *testing.T) {
 	repo := NewRepository(db)
 
 	id := uuid.New()
-	users := sqlmock.NewRows([]string{"id", "first_name", "last_name", "nickname", "password", "email", "country", "created_at", "updated_at"}).
-		AddRow(id, "firstname", "lastname", "nickname", "passwd", "example@mail.com", "xx", time.Now(), time.Now())
+	users := sqlmock.NewRows(userColumns).
+		AddRow(id, "firstname", "lastname", "nickname", "passwd", "example@mail.com", nil, "xx", "member", time.Now(), time.Now(), nil, nil, 1)
 
 	expectedSQL := "SELECT (.+) FROM users WHERE id =(.+)"
 	mock.ExpectQuery(expectedSQL).WillReturnRows(users)
@@ -39,21 +39,53 @@ func TestFindUserById(t *testing.T) {
 	assert.Nil(t, mock.ExpectationsWereMet())
 }
 
+func TestFindUserByLogin(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	users := sqlmock.NewRows(userColumns).
+		AddRow(uuid.New(), "firstname", "lastname", "nickname", "passwd", "example@mail.com", nil, "xx", "member", time.Now(), time.Now(), nil, nil, 1)
+
+	expectedSQL := "SELECT (.+) FROM users WHERE \\(nickname = (.+) OR email = (.+)\\)"
+	mock.ExpectQuery(expectedSQL).WillReturnRows(users)
+	_, err := repo.SelectByLogin("nickname")
+
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDeactivateUser(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectExec("UPDATE users SET deactivated_at = (.+) WHERE id = (.+) AND deactivated_at IS NULL").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users SET deactivated_at = (.+) WHERE id = (.+) AND deactivated_at IS NOT NULL").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	id := uuid.New()
+
+	assert.Nil(t, repo.Deactivate(id))
+	assert.Equal(t, sql.ErrNoRows, repo.Activate(id))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
 func TestFindUser(t *testing.T) {
 	db, mock := DbMock(t)
 	defer db.Close()
 	repo := NewRepository(db)
 
-	expectedCount := "SELECT count(.+) AS total FROM users WHERE first_name ILIKE (.+) OR last_name ILIKE (.+)"
-	expectedSelect := "SELECT (.+) FROM users WHERE first_name ILIKE (.+) OR last_name ILIKE (.+) LIMIT (.+) OFFSET (.+)"
+	expectedCount := "SELECT count(.+) AS total FROM users WHERE \\(first_name ILIKE (.+) OR last_name ILIKE (.+)\\) AND deleted_at IS NULL"
+	expectedSelect := "SELECT (.+) FROM users WHERE \\(first_name ILIKE (.+) OR last_name ILIKE (.+)\\) AND deleted_at IS NULL LIMIT (.+) OFFSET (.+)"
 
 	mock.ExpectQuery(expectedCount).WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow(0))
 
-	usersRow := sqlmock.NewRows([]string{"id", "first_name", "last_name", "nickname", "password", "email", "country", "created_at", "updated_at"}).
-		AddRow(uuid.New(), "firstname", "lastname", "nickname", "passwd", "example@mail.com", "xx", time.Now(), time.Now())
+	usersRow := sqlmock.NewRows(userColumns).
+		AddRow(uuid.New(), "firstname", "lastname", "nickname", "passwd", "example@mail.com", nil, "xx", "member", time.Now(), time.Now(), nil, nil, 1)
 	mock.ExpectQuery(expectedSelect).WillReturnRows(usersRow)
 
-	_, _, err := repo.Select("name", "", 0, 1)
+	_, _, err := repo.Select("name", "", false, 0, 1)
 
 	assert.Nil(t, mock.ExpectationsWereMet())
 	assert.Nil(t, err)
@@ -77,9 +109,43 @@ func TestDeleteUser(t *testing.T) {
 	defer db.Close()
 	repo := NewRepository(db)
 
-	expectedSQL := "DELETE FROM users WHERE id = (.+)"
+	expectedSQL := "UPDATE users SET deleted_at = (.+) WHERE id = (.+) AND deleted_at IS NULL"
 	mock.ExpectExec(expectedSQL).WillReturnResult(sqlmock.NewResult(1, 1))
-	err := repo.Delete(uuid.New())
+	err := repo.Delete(uuid.New(), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteDeletedUser(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectExec("UPDATE users SET deleted_at = (.+)").WillReturnResult(sqlmock.NewResult(0, 0))
+	err := repo.Delete(uuid.New(), 0)
+	assert.Equal(t, sql.ErrNoRows, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRestoreUserNicknameTaken(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectExec("UPDATE users SET deleted_at = (.+), updated_at = (.+) WHERE id = (.+) AND deleted_at IS NOT NULL").
+		WillReturnError(&pq.Error{Code: "23505"})
+	err := repo.Restore(uuid.New())
+	assert.Equal(t, ErrNicknameTaken, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPurgeUser(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectExec("DELETE FROM users WHERE id = (.+) AND deleted_at IS NOT NULL").WillReturnResult(sqlmock.NewResult(0, 1))
+	err := repo.Purge(uuid.New())
 	assert.Nil(t, err)
 	assert.Nil(t, mock.ExpectationsWereMet())
 }
@@ -91,7 +157,145 @@ func TestUpdateUser(t *testing.T) {
 
 	expectedSQL := "UPDATE users SET (.+) WHERE id = (.+)"
 	mock.ExpectExec(expectedSQL).WillReturnResult(sqlmock.NewResult(1, 1))
-	err := repo.Update(uuid.New(), InputUser{FirstName: "name"})
+	err := repo.Update(uuid.New(), InputUser{FirstName: "name"}, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateUserVersionConflict(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+	id := uuid.New()
+
+	mock.ExpectExec("UPDATE users SET (.+) WHERE id = (.+) AND version = (.+)").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version FROM users WHERE id = (.+) AND deleted_at IS NULL").
+		WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(3))
+	err := repo.Update(id, InputUser{FirstName: "name"}, 2)
+
+	var conflict *VersionConflictError
+	assert.ErrorAs(t, err, &conflict)
+	assert.Equal(t, int64(2), conflict.Expected)
+	assert.Equal(t, int64(3), conflict.Actual)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateUserFields(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectExec("UPDATE users SET country = \\$1, updated_at = \\$2, version = version \\+ 1 WHERE id = \\$3").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	err := repo.UpdateFields(uuid.New(), map[string]interface{}{"country": "DE"}, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateUserFieldsRejectsPassword(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	err := repo.UpdateFields(uuid.New(), map[string]interface{}{"password": "passwd"}, 0)
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateUserRole(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	expectedSQL := "UPDATE users SET role = (.+), updated_at = (.+) WHERE id = (.+)"
+	mock.ExpectExec(expectedSQL).WillReturnResult(sqlmock.NewResult(1, 1))
+	err := repo.UpdateRole(uuid.New(), RoleAdmin)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateUserPassword(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	expectedSQL := "UPDATE users SET password = (.+), updated_at = (.+) WHERE id = (.+)"
+	mock.ExpectExec(expectedSQL).WillReturnResult(sqlmock.NewResult(1, 1))
+	err := repo.UpdatePassword(uuid.New(), "hash")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifyEmail(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE email_verification_tokens SET used_at = (.+) WHERE (.+) RETURNING email").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("example@mail.com"))
+	mock.ExpectExec("UPDATE users SET email_verified_at = (.+), version = version \\+ 1 WHERE (.+)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repo.Transaction(func(tx Repository) error {
+		return tx.VerifyEmail(uuid.New(), "hash")
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestVerifyEmailWithTokenForOldEmail(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE email_verification_tokens SET used_at = (.+) WHERE (.+) RETURNING email").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("old@mail.com"))
+	mock.ExpectExec("UPDATE users SET email_verified_at = (.+) WHERE (.+)").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := repo.Transaction(func(tx Repository) error {
+		return tx.VerifyEmail(uuid.New(), "hash")
+	})
+	assert.ErrorIs(t, err, ErrVerificationTokenInvalid)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTransactionRollsBackOnError(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET deleted_at = (.+)").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO outbox (.+) VALUES (.+)").WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	err := repo.Transaction(func(tx Repository) error {
+		if err := tx.Delete(uuid.New(), 0); err != nil {
+			return err
+		}
+		return tx.Enqueue("user_delete", "id")
+	})
+
+	assert.Equal(t, sql.ErrConnDone, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSelectUsersAfter(t *testing.T) {
+	db, mock := DbMock(t)
+	defer db.Close()
+	repo := NewRepository(db)
+
+	users := sqlmock.NewRows(userColumns).
+		AddRow(uuid.New(), "firstname", "lastname", "nickname", "passwd", "example@mail.com", nil, "xx", "member", time.Now(), time.Now(), nil, nil, 1)
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id > (.+) ORDER BY id LIMIT 100").WillReturnRows(users)
+	result, err := repo.SelectAfter(uuid.Nil, 100)
+
 	assert.Nil(t, err)
+	assert.Len(t, result, 1)
 	assert.Nil(t, mock.ExpectationsWereMet())
 }
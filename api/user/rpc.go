@@ -0,0 +1,202 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+	"golang-demo/api/broker"
+	"golang-demo/api/password"
+	"golang-demo/config"
+	"net/http"
+)
+
+const (
+	MethodGetById = "user.get_by_id"
+	MethodGet     = "user.get"
+	MethodStore   = "user.store"
+)
+
+// RPCRequestGetById is payload of user.get_by_id request
+type RPCRequestGetById struct {
+	UserID uuid.UUID `json:"user_id"`
+}
+
+// RPCRequestGet is payload of user.get request, it mirrors query params of GET /users
+type RPCRequestGet struct {
+	Name           string `json:"name"`
+	Country        string `json:"country"`
+	IncludeDeleted bool   `json:"include_deleted"`
+	Page           int    `json:"page"`
+	PageSize       int    `json:"page_size"`
+}
+
+// RPCResponse is reply to RPC request, status code and error are the same as of http api
+type RPCResponse struct {
+	StatusCode int          `json:"status_code"`
+	Data       any          `json:"data,omitempty"`
+	Error      *ErrResponse `json:"error,omitempty"`
+}
+
+type Replier interface {
+	Reply(replyTo string, correlationID string, body []byte) error
+}
+
+// rpcScopes are api key scopes required by RPC methods
+var rpcScopes = map[string]string{
+	MethodGetById: "users:read",
+	MethodGet:     "users:read",
+	MethodStore:   "users:write",
+}
+
+// rpcServer serves user lookups and creation over AMQP, method is taken from AMQP type property,
+// body holds JSON arguments and response is sent to reply_to queue with the same correlation_id.
+// Caller is authenticated by api key from authorization header, like in http api
+type rpcServer struct {
+	conn          *broker.Connection
+	replier       Replier
+	handler       *userHandler
+	authenticator CallerAuthenticator
+	queue         string
+	concurrency   int
+}
+
+func NewRPCServer(conn *broker.Connection, replier Replier, userService Service, passwordPolicy password.Policy,
+	authenticator CallerAuthenticator, cfg config.Config) *rpcServer {
+	s := &rpcServer{
+		conn:          conn,
+		replier:       replier,
+		handler:       NewUserHandler(userService, passwordPolicy),
+		authenticator: authenticator,
+		queue:         cfg.MqRPCQueue,
+		concurrency:   cfg.MqRPCConcurrency,
+	}
+	if s.concurrency <= 0 {
+		s.concurrency = 4
+	}
+	return s
+}
+
+// declareRPCQueue declares queue of RPC requests, requests are not dead-lettered since caller waits for reply
+func declareRPCQueue(ch *amqp.Channel, cfg config.Config) error {
+	if cfg.MqRPCQueue == "" {
+		return nil
+	}
+	_, err := ch.QueueDeclare(cfg.MqRPCQueue, true, false, false, false, nil)
+	return err
+}
+
+// Run serves requests until ctx is cancelled, consuming is restarted after reconnect
+func (s *rpcServer) Run(ctx context.Context) {
+	if s.queue == "" {
+		return
+	}
+	runQueues(ctx, []string{s.queue}, func(ctx context.Context, queue string) error {
+		return consumeQueue(ctx, s.conn, queue, s.concurrency, s.handle)
+	})
+	log.Infoln("rpc server stopped")
+}
+
+// handle replies to request and acks it, requests without reply_to are dropped.
+// Lookup is requeued once when reply fails, user.store is acked anyway as its change is committed
+func (s *rpcServer) handle(d amqp.Delivery) {
+	if d.ReplyTo == "" {
+		_ = d.Nack(false, false)
+		log.Warnln("dropped rpc request without reply_to", d.Type, d.CorrelationId)
+		return
+	}
+	response := RPCResponse{}
+	if actor, errResponse := s.authenticate(d); errResponse != nil {
+		response = errorReply(errResponse)
+	} else {
+		response = s.call(d.Type, d.Body, actor)
+	}
+	body, err := json.Marshal(response)
+	if err == nil {
+		err = s.replier.Reply(d.ReplyTo, d.CorrelationId, body)
+	}
+	if err != nil && d.Type != MethodStore {
+		// caller times out, lookup may be handled again by other instance
+		_ = d.Nack(false, !d.Redelivered)
+		log.Errorln("failed to reply to rpc request", d.Type, d.CorrelationId, err)
+		return
+	}
+	if err != nil {
+		// user is already created, handling request again would create duplicate
+		log.Errorln("failed to reply to rpc request, request is not retried", d.Type, d.CorrelationId, err)
+	}
+	_ = d.Ack(false)
+}
+
+// authenticate checks api key from "authorization: ApiKey <key>" header and its scope for requested method,
+// request id of actor is correlation id of request
+func (s *rpcServer) authenticate(d amqp.Delivery) (Actor, render.Renderer) {
+	key, ok := apiKey(d)
+	if !ok {
+		return Actor{}, &ErrResponse{HTTPStatusCode: 401, StatusText: "unauthorized", ErrorText: "missing api key"}
+	}
+	actor, scopes, err := s.authenticator.AuthenticateCaller(key)
+	if err != nil {
+		return Actor{}, &ErrResponse{HTTPStatusCode: 401, StatusText: "unauthorized", Err: err, ErrorText: err.Error()}
+	}
+	if scope, ok := rpcScopes[d.Type]; ok && !hasScope(scopes, scope) {
+		log.Warnln("denied rpc request", d.Type, "of", actor.Type, actor.ID)
+		return Actor{}, &ErrResponse{HTTPStatusCode: 403, StatusText: "forbidden", ErrorText: "api key lacks " + scope + " scope"}
+	}
+	actor.RequestID = d.CorrelationId
+	return actor, nil
+}
+
+func (s *rpcServer) call(method string, body []byte, actor Actor) RPCResponse {
+	switch method {
+	case MethodGetById:
+		var input RPCRequestGetById
+		if err := json.Unmarshal(body, &input); err != nil {
+			return errorReply(ErrInvalidRequest(err))
+		}
+		u, err := s.handler.userService.GetById(input.UserID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errorReply(ErrNotFound)
+		}
+		if err != nil {
+			return errorReply(&ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
+		}
+		return RPCResponse{StatusCode: http.StatusOK, Data: u}
+	case MethodGet:
+		input := RPCRequestGet{Page: 1, PageSize: 10}
+		if err := json.Unmarshal(body, &input); err != nil {
+			return errorReply(ErrInvalidRequest(err))
+		}
+		users, totalCount, err := s.handler.userService.Get(input.Name, input.Country, input.IncludeDeleted, input.Page, input.PageSize)
+		if err != nil {
+			return errorReply(&ErrResponse{HTTPStatusCode: 400, StatusText: "error during select", Err: err, ErrorText: err.Error()})
+		}
+		return RPCResponse{StatusCode: http.StatusOK, Data: map[string]any{"users": users, "total_count": totalCount}}
+	case MethodStore:
+		var input InputUser
+		if err := json.Unmarshal(body, &input); err != nil {
+			return errorReply(ErrInvalidRequest(err))
+		}
+		if errResponse := s.handler.validateInput(input); errResponse != nil {
+			return errorReply(errResponse)
+		}
+		created, err := s.handler.userService.Store(input, actor)
+		if err != nil {
+			return errorReply(&ErrResponse{HTTPStatusCode: 400, StatusText: "error during create", Err: err, ErrorText: err.Error()})
+		}
+		return RPCResponse{StatusCode: http.StatusOK, Data: map[string]any{"message": "successfully created", "created": created}}
+	default:
+		return errorReply(ErrInvalidRequest(fmt.Errorf("unknown method %q", method)))
+	}
+}
+
+// errorReply converts error response of http api to RPC response
+func errorReply(renderer render.Renderer) RPCResponse {
+	errResponse := renderer.(*ErrResponse)
+	return RPCResponse{StatusCode: errResponse.HTTPStatusCode, Error: errResponse}
+}
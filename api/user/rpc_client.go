@@ -0,0 +1,211 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang-demo/api/broker"
+	"golang-demo/api/envelope"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const directReplyTo = "amq.rabbitmq.reply-to"
+
+var ErrRPCTimeout = errors.New("rpc request timed out")
+
+// RPCError is error reply of user service, it holds the same status and errors as http api
+type RPCError struct {
+	StatusCode int
+	Response   ErrResponse
+}
+
+func (e *RPCError) Error() string {
+	if e.Response.ErrorText == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, e.Response.StatusText)
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Response.StatusText, e.Response.ErrorText)
+}
+
+// RPCClient calls user service over AMQP, replies are received through direct reply-to pseudo queue.
+// Channel is reopened on reconnected connection when it is closed, calls waiting on closed channel time out.
+// It is safe for concurrent use
+type RPCClient struct {
+	conn     *broker.Connection
+	verifier envelope.Verifier
+	apiKey   string
+	queue    string
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	ch      *amqp.Channel
+	pending map[string]chan amqp.Delivery
+}
+
+// NewRPCClient opens channel on conn for requests to queue authenticated by apiKey,
+// calls fail with ErrRPCTimeout after timeout. Replies are verified and decrypted by verifier,
+// it is required when service encrypts messages
+func NewRPCClient(conn *broker.Connection, verifier envelope.Verifier, apiKey string, queue string, timeout time.Duration) (*RPCClient, error) {
+	c := &RPCClient{conn: conn, verifier: verifier, apiKey: apiKey, queue: queue, timeout: timeout,
+		pending: map[string]chan amqp.Delivery{}}
+	if _, err := c.channel(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// channel returns open channel consuming replies, closed channel is replaced by new one.
+// Direct reply-to requires requests to be published on the channel which consumes replies
+func (c *RPCClient) channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch != nil && !c.ch.IsClosed() {
+		return c.ch, nil
+	}
+	conn, err := c.conn.Get(c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := ch.Consume(directReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	c.ch = ch
+	go c.dispatch(replies)
+	return ch, nil
+}
+
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch == nil {
+		return nil
+	}
+	return c.ch.Close()
+}
+
+// dispatch passes replies to waiting calls by correlation id, replies to timed out calls are dropped
+func (c *RPCClient) dispatch(replies <-chan amqp.Delivery) {
+	for d := range replies {
+		c.mu.Lock()
+		reply, ok := c.pending[d.CorrelationId]
+		delete(c.pending, d.CorrelationId)
+		c.mu.Unlock()
+		if ok {
+			reply <- d
+		}
+	}
+}
+
+func (c *RPCClient) GetById(ctx context.Context, id uuid.UUID) (User, error) {
+	var u User
+	err := c.call(ctx, MethodGetById, RPCRequestGetById{UserID: id}, &u)
+	return u, err
+}
+
+func (c *RPCClient) Get(ctx context.Context, request RPCRequestGet) ([]User, int64, error) {
+	var result struct {
+		Users      []User `json:"users"`
+		TotalCount int64  `json:"total_count"`
+	}
+	err := c.call(ctx, MethodGet, request, &result)
+	return result.Users, result.TotalCount, err
+}
+
+func (c *RPCClient) Store(ctx context.Context, input InputUser) (uuid.UUID, error) {
+	var result struct {
+		Created uuid.UUID `json:"created"`
+	}
+	err := c.call(ctx, MethodStore, input, &result)
+	return result.Created, err
+}
+
+// call publishes request and waits for reply, request expires in broker after timeout
+// so it is not handled when nobody waits for reply
+func (c *RPCClient) call(ctx context.Context, method string, request any, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	correlationID := uuid.NewString()
+	reply := make(chan amqp.Delivery, 1)
+	c.mu.Lock()
+	c.pending[correlationID] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, correlationID)
+		c.mu.Unlock()
+	}()
+
+	ch, err := c.channel()
+	if err != nil {
+		return err
+	}
+	err = ch.PublishWithContext(ctx, "", c.queue, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		Headers:       amqp.Table{"authorization": "ApiKey " + c.apiKey},
+		Type:          method,
+		CorrelationId: correlationID,
+		ReplyTo:       directReplyTo,
+		Expiration:    strconv.FormatInt(c.timeout.Milliseconds(), 10),
+		Body:          body,
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ErrRPCTimeout
+		}
+		return ctx.Err()
+	case d := <-reply:
+		body, err := c.open(d)
+		if err != nil {
+			return err
+		}
+		return decodeReply(body, result)
+	}
+}
+
+// open verifies reply and decrypts its body, reply is used as is without verifier
+func (c *RPCClient) open(d amqp.Delivery) ([]byte, error) {
+	if c.verifier == nil {
+		return d.Body, nil
+	}
+	return c.verifier.Open(d)
+}
+
+// decodeReply unmarshals data of successful reply to result, error reply is returned as *RPCError
+func decodeReply(body []byte, result any) error {
+	var response struct {
+		StatusCode int             `json:"status_code"`
+		Data       json.RawMessage `json:"data"`
+		Error      *ErrResponse    `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return err
+	}
+	if response.StatusCode >= 400 {
+		rpcErr := &RPCError{StatusCode: response.StatusCode}
+		if response.Error != nil {
+			rpcErr.Response = *response.Error
+		}
+		return rpcErr
+	}
+	return json.Unmarshal(response.Data, result)
+}
@@ -0,0 +1,118 @@
+package user
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"golang-demo/api/envelope"
+	"golang-demo/config"
+	"testing"
+	"time"
+)
+
+func (s *serviceMock) GetById(id uuid.UUID) (User, error) {
+	if id == uuid.Nil {
+		return User{}, sql.ErrNoRows
+	}
+	return User{ID: id, Nickname: "nickname"}, nil
+}
+
+func TestRPCRoundTrip(t *testing.T) {
+	server := &rpcServer{handler: NewUserHandler(&serviceMock{}, nil)}
+	id := uuid.New()
+
+	body, err := json.Marshal(server.call(MethodGetById, []byte(`{"user_id": "`+id.String()+`"}`), ServiceActor("1")))
+	assert.Nil(t, err)
+
+	var u User
+	assert.Nil(t, decodeReply(body, &u))
+	assert.Equal(t, id, u.ID)
+	assert.Equal(t, "nickname", u.Nickname)
+}
+
+func TestRPCNotFound(t *testing.T) {
+	server := &rpcServer{handler: NewUserHandler(&serviceMock{}, nil)}
+
+	body, err := json.Marshal(server.call(MethodGetById, []byte(`{"user_id": "`+uuid.Nil.String()+`"}`), ServiceActor("1")))
+	assert.Nil(t, err)
+
+	var rpcErr *RPCError
+	err = decodeReply(body, &User{})
+	assert.True(t, errors.As(err, &rpcErr))
+	assert.Equal(t, 404, rpcErr.StatusCode)
+	assert.Equal(t, "resource not found", rpcErr.Response.StatusText)
+}
+
+func TestRPCUnknownMethod(t *testing.T) {
+	server := &rpcServer{handler: NewUserHandler(&serviceMock{}, nil)}
+
+	response := server.call("user.unknown", []byte(`{}`), ServiceActor("1"))
+
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Equal(t, "invalid request", response.Error.StatusText)
+}
+
+func TestRPCAuthenticate(t *testing.T) {
+	server := &rpcServer{authenticator: &authenticatorMock{id: uuid.New(), scopes: []string{"users:read"}}}
+	request := func(method string, authorization any) amqp.Delivery {
+		return amqp.Delivery{Type: method, CorrelationId: "1", Headers: amqp.Table{"authorization": authorization}}
+	}
+
+	actor, errResponse := server.authenticate(request(MethodGet, "ApiKey prefix.secret"))
+	assert.Nil(t, errResponse)
+	assert.Equal(t, ActorAPIKey, actor.Type)
+	assert.Equal(t, "1", actor.RequestID)
+
+	for authorization, status := range map[any]int{nil: 401, "Bearer token": 401, "ApiKey prefix.wrong": 401} {
+		_, errResponse = server.authenticate(request(MethodGet, authorization))
+		assert.Equal(t, status, errResponse.(*ErrResponse).HTTPStatusCode)
+	}
+	_, errResponse = server.authenticate(request(MethodStore, "ApiKey prefix.secret"))
+	assert.Equal(t, 403, errResponse.(*ErrResponse).HTTPStatusCode)
+}
+
+type replierMock struct{}
+
+func (r *replierMock) Reply(string, string, []byte) error {
+	return errors.New("channel closed")
+}
+
+func TestRPCStoreIsNotRetriedWhenReplyFails(t *testing.T) {
+	server := &rpcServer{replier: &replierMock{}, handler: NewUserHandler(&serviceMock{}, nil), authenticator: &authenticatorMock{}}
+
+	for method, acked := range map[string]bool{MethodStore: true, MethodGetById: false} {
+		ack := &acknowledgerMock{}
+		server.handle(amqp.Delivery{Acknowledger: ack, Type: method, ReplyTo: "reply", Body: []byte(`{}`)})
+		assert.Equal(t, acked, ack.acked, method)
+		assert.Equal(t, !acked, ack.requeue, method)
+	}
+}
+
+func TestRPCClientOpensEncryptedReply(t *testing.T) {
+	cfg := config.Config{
+		MessageSigningKeys:    "k1:" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")),
+		MessageEncryptionKeys: "e1:" + base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210")),
+	}
+	sealer, err := envelope.NewSealer(cfg)
+	assert.Nil(t, err)
+	signingKeys, _ := envelope.ParseKeys(cfg.MessageSigningKeys)
+	encryptionKeys, _ := envelope.ParseKeys(cfg.MessageEncryptionKeys)
+	verifier, err := envelope.NewVerifier(envelope.AlgHMACSHA256, signingKeys, encryptionKeys, time.Minute)
+	assert.Nil(t, err)
+
+	replyTo := directReplyTo + ".g1h2AA"
+	msg := amqp.Publishing{ContentType: "application/json", Body: []byte(`{"status_code": 200, "data": {"nickname": "nickname"}}`)}
+	assert.Nil(t, sealer.SealPrivate(replyTo, &msg))
+	assert.NotContains(t, string(msg.Body), "nickname")
+
+	c := &RPCClient{verifier: verifier}
+	body, err := c.open(amqp.Delivery{RoutingKey: replyTo, ContentType: msg.ContentType, Headers: msg.Headers, Body: msg.Body})
+	assert.Nil(t, err)
+	var u User
+	assert.Nil(t, decodeReply(body, &u))
+	assert.Equal(t, "nickname", u.Nickname)
+}
@@ -1,44 +1,116 @@
 package user
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
+	"golang-demo/api/password"
+	"golang-demo/config"
+	"time"
 )
 
+var ErrEmailAlreadyVerified = errors.New("email already verified")
+var ErrVerificationThrottled = errors.New("verification email was sent recently, try again later")
+var ErrNotDeleted = errors.New("user is not deleted")
+
 type Service interface {
-	Store(input InputUser) (uuid.UUID, error)
-	Get(name string, country string, page int, pageSize int) ([]User, int64, error)
+	Store(input InputUser, actor Actor) (uuid.UUID, error)
+	Get(name string, country string, includeDeleted bool, page int, pageSize int) ([]User, int64, error)
 	GetById(id uuid.UUID) (User, error)
-	Update(id uuid.UUID, input InputUser) error
-	Delete(id uuid.UUID) error
+	GetByIdWithDeleted(id uuid.UUID) (User, error)
+	GetAudit(id uuid.UUID, page int, pageSize int, full bool) ([]AuditEntry, int64, int64, error)
+	Update(id uuid.UUID, input InputUser, version int64, actor Actor) error
+	Patch(id uuid.UUID, columns map[string]interface{}, version int64, actor Actor) error
+	SetRole(id uuid.UUID, role string, actor Actor) error
+	UpdateCountry(id uuid.UUID, country string, actor Actor) error
+	Deactivate(id uuid.UUID, actor Actor) error
+	Activate(id uuid.UUID, actor Actor) error
+	Delete(id uuid.UUID, version int64, actor Actor) error
+	Restore(id uuid.UUID, actor Actor) error
+	Purge(deletedBefore time.Time, limit int) (int, error)
+	VerifyEmail(id uuid.UUID, token string, actor Actor) error
+	ResendVerification(id uuid.UUID) error
+}
+
+// CredentialRevoker revokes credentials of deleted user, e.g. sessions or api keys, in transaction tx
+// which deletes user, it returns number of revoked credentials
+type CredentialRevoker interface {
+	RevokeUser(tx Repository, userID uuid.UUID) (int64, error)
 }
 
 type service struct {
-	repository Repository
-	amqp       MQ
+	repository             Repository
+	verificationRepository VerificationRepository
+	hasher                 password.Hasher
+	amqp                   MQ
+	revokers               []CredentialRevoker
+	verificationTTL        time.Duration
+	resendInterval         time.Duration
+	cdc                    bool
 }
 
-func NewService(repository Repository, amqp MQ) *service {
-	return &service{repository, amqp}
+func NewService(repository Repository, verificationRepository VerificationRepository, hasher password.Hasher, amqp MQ,
+	revokers []CredentialRevoker, cfg config.Config) *service {
+	s := &service{
+		repository:             repository,
+		verificationRepository: verificationRepository,
+		hasher:                 hasher,
+		amqp:                   amqp,
+		revokers:               revokers,
+		verificationTTL:        cfg.EmailVerificationTTL,
+		resendInterval:         cfg.EmailVerificationResendInterval,
+		cdc:                    cfg.CdcEnabled,
+	}
+	if s.verificationTTL <= 0 {
+		s.verificationTTL = 24 * time.Hour
+	}
+	if s.resendInterval <= 0 {
+		s.resendInterval = time.Minute
+	}
+	return s
 }
 
-func (s *service) Store(input InputUser) (uuid.UUID, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(input.Password), 14)
-	input.Password = string(bytes)
-	id, err := s.repository.Insert(input)
+func (s *service) Store(input InputUser, actor Actor) (uuid.UUID, error) {
+	hash, err := s.hasher.Hash(input.Password)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	input.Password = hash
+	var id uuid.UUID
+	err = s.repository.Transaction(func(tx Repository) error {
+		id, err = tx.Insert(input)
+		if err != nil {
+			return err
+		}
+		created, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := audit(tx, AuditCreate, id, actor, nil, &created); err != nil {
+			return err
+		}
+		return s.enqueueEvent(tx, EventCreated, created, nil)
+	})
 	if err != nil {
 		return id, err
 	}
-	s.amqp.PublishMessage("user_create", id.String())
 	log.Infoln("created user", id)
+	if err = s.sendVerification(id, input.Email); err != nil {
+		log.Errorln("failed to send email verification for user", id, err)
+	}
 	return id, nil
 }
 
-func (s *service) Get(name string, country string, page int, pageSize int) ([]User, int64, error) {
+func (s *service) Get(name string, country string, includeDeleted bool, page int, pageSize int) ([]User, int64, error) {
 	offset := (page - 1) * pageSize
 	limit := pageSize
-	users, totalCount, err := s.repository.Select(name, country, offset, limit)
+	users, totalCount, err := s.repository.Select(name, country, includeDeleted, offset, limit)
 	return users, totalCount, err
 }
 
@@ -47,16 +119,378 @@ func (s *service) GetById(id uuid.UUID) (User, error) {
 	return user, err
 }
 
-func (s *service) Update(id uuid.UUID, input InputUser) error {
-	err := s.repository.Update(id, input)
-	s.amqp.PublishMessage("user_update", id.String())
+func (s *service) GetByIdWithDeleted(id uuid.UUID) (User, error) {
+	return s.repository.SelectByIdWithDeleted(id)
+}
+
+// GetAudit returns page of audit entries of user and seq of the first entry which breaks hash chain, 0 if chain is intact.
+// Only entries added after stored checkpoint are verified, intact chain moves checkpoint forward. Full verification
+// starts from the first entry, it finds entries altered after they were checkpointed
+func (s *service) GetAudit(id uuid.UUID, page int, pageSize int, full bool) ([]AuditEntry, int64, int64, error) {
+	entries, totalCount, err := s.repository.SelectAudit(id, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return entries, totalCount, 0, err
+	}
+	var seq int64
+	var hash string
+	if !full {
+		if seq, hash, err = s.repository.SelectAuditCheckpoint(id); err != nil {
+			return entries, totalCount, 0, err
+		}
+	}
+	chain, err := s.repository.SelectAuditChain(id, seq)
+	if err != nil {
+		return entries, totalCount, 0, err
+	}
+	if brokenAt := VerifyChainFrom(seq, hash, chain); brokenAt != 0 || len(chain) == 0 {
+		return entries, totalCount, brokenAt, nil
+	}
+	last := chain[len(chain)-1]
+	if err = s.repository.SaveAuditCheckpoint(id, last.Seq, last.Hash); err != nil {
+		log.Errorln("failed to save audit checkpoint of user", id, err)
+	}
+	return entries, totalCount, 0, nil
+}
+
+// Update overwrites user except password if it still has given version, 0 version overwrites any.
+// VersionConflictError is returned when user was changed meanwhile
+func (s *service) Update(id uuid.UUID, input InputUser, version int64, actor Actor) error {
+	var current User
+	err := s.repository.Transaction(func(tx Repository) error {
+		var err error
+		current, err = tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Update(id, input, version); err != nil {
+			return err
+		}
+		updated, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := audit(tx, AuditUpdate, id, actor, &current, &updated); err != nil {
+			return err
+		}
+		return s.enqueueEvent(tx, EventUpdated, updated, &current)
+	})
+	if err != nil {
+		return err
+	}
 	log.Infoln("updated user", id)
-	return err
+	if current.Email != input.Email {
+		if err := s.sendVerification(id, input.Email); err != nil {
+			log.Errorln("failed to send email verification for user", id, err)
+		}
+	}
+	return nil
+}
+
+// Patch changes only given columns of user if it still has given version, 0 version changes any
+func (s *service) Patch(id uuid.UUID, columns map[string]interface{}, version int64, actor Actor) error {
+	var updated User
+	err := s.repository.Transaction(func(tx Repository) error {
+		current, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.UpdateFields(id, columns, version); err != nil {
+			return err
+		}
+		updated, err = tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := audit(tx, AuditUpdate, id, actor, &current, &updated); err != nil {
+			return err
+		}
+		return s.enqueueEvent(tx, EventUpdated, updated, &current)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infoln("patched user", id)
+	if _, ok := columns["email"]; ok {
+		if err := s.sendVerification(id, updated.Email); err != nil {
+			log.Errorln("failed to send email verification for user", id, err)
+		}
+	}
+	return nil
+}
+
+func (s *service) SetRole(id uuid.UUID, role string, actor Actor) error {
+	err := s.repository.Transaction(func(tx Repository) error {
+		current, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.UpdateRole(id, role); err != nil {
+			return err
+		}
+		updated, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := audit(tx, AuditSetRole, id, actor, &current, &updated); err != nil {
+			return err
+		}
+		return s.enqueueEvent(tx, EventUpdated, updated, &current)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infoln("changed role of user", id, "to", role)
+	return nil
+}
+
+func (s *service) UpdateCountry(id uuid.UUID, country string, actor Actor) error {
+	err := s.repository.Transaction(func(tx Repository) error {
+		current, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.UpdateCountry(id, country); err != nil {
+			return err
+		}
+		updated, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := audit(tx, AuditUpdateCountry, id, actor, &current, &updated); err != nil {
+			return err
+		}
+		return s.enqueueEvent(tx, EventUpdated, updated, &current)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infoln("changed country of user", id, "to", country)
+	return nil
+}
+
+// Deactivate blocks login and token refresh of user until it is activated, user is not deleted and nothing
+// is lost. Deactivating deactivated user changes nothing
+func (s *service) Deactivate(id uuid.UUID, actor Actor) error {
+	return s.setDeactivated(id, true, actor)
 }
 
-func (s *service) Delete(id uuid.UUID) error {
-	err := s.repository.Delete(id)
-	s.amqp.PublishMessage("user_delete", id.String())
-	log.Infoln("deleted user", id)
-	return err
+// Activate lifts deactivation of user, activating active user changes nothing
+func (s *service) Activate(id uuid.UUID, actor Actor) error {
+	return s.setDeactivated(id, false, actor)
+}
+
+func (s *service) setDeactivated(id uuid.UUID, deactivate bool, actor Actor) error {
+	changed := false
+	err := s.repository.Transaction(func(tx Repository) error {
+		current, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if (current.DeactivatedAt != nil) == deactivate {
+			return nil
+		}
+		action := AuditDeactivate
+		if deactivate {
+			err = tx.Deactivate(id)
+		} else {
+			action = AuditActivate
+			err = tx.Activate(id)
+		}
+		if err != nil {
+			return err
+		}
+		updated, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := audit(tx, action, id, actor, &current, &updated); err != nil {
+			return err
+		}
+		changed = true
+		return s.enqueueEvent(tx, EventUpdated, updated, &current)
+	})
+	if err != nil || !changed {
+		return err
+	}
+	if deactivate {
+		log.Infoln("deactivated user", id)
+	} else {
+		log.Infoln("activated user", id)
+	}
+	return nil
+}
+
+// Delete marks user as deleted if it still has given version, 0 version deletes any.
+// Sessions and api keys of user are revoked in the same transaction and stay revoked after restore
+func (s *service) Delete(id uuid.UUID, version int64, actor Actor) error {
+	var revoked int64
+	err := s.repository.Transaction(func(tx Repository) error {
+		current, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(id, version); err != nil {
+			return err
+		}
+		for _, revoker := range s.revokers {
+			n, err := revoker.RevokeUser(tx, id)
+			if err != nil {
+				return err
+			}
+			revoked += n
+		}
+		deleted, err := tx.SelectByIdWithDeleted(id)
+		if err != nil {
+			return err
+		}
+		if err := audit(tx, AuditDelete, id, actor, &current, &deleted); err != nil {
+			return err
+		}
+		return s.enqueueEvent(tx, EventDeleted, current, nil)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infoln("deleted user", id, "revoked credentials:", revoked)
+	return nil
+}
+
+// Restore undoes deletion of user which is not purged yet
+func (s *service) Restore(id uuid.UUID, actor Actor) error {
+	err := s.repository.Transaction(func(tx Repository) error {
+		current, err := tx.SelectByIdWithDeleted(id)
+		if err != nil {
+			return err
+		}
+		if current.DeletedAt == nil {
+			return ErrNotDeleted
+		}
+		if err := tx.Restore(id); err != nil {
+			return err
+		}
+		restored, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		if err := audit(tx, AuditRestore, id, actor, &current, &restored); err != nil {
+			return err
+		}
+		return s.enqueueEvent(tx, EventRestored, restored, nil)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infoln("restored user", id)
+	return nil
+}
+
+// Purge removes up to limit users deleted before deletedBefore, audit log of purged users is kept
+func (s *service) Purge(deletedBefore time.Time, limit int) (int, error) {
+	var purged []User
+	err := s.repository.Transaction(func(tx Repository) error {
+		users, err := tx.SelectPurgeable(deletedBefore, limit)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			if err := tx.Purge(u.ID); err != nil {
+				return err
+			}
+			if err := tx.RedactAudit(u.ID); err != nil {
+				return err
+			}
+			if err := audit(tx, AuditPurge, u.ID, ServiceActor(""), nil, nil); err != nil {
+				return err
+			}
+			if err := s.enqueuePurge(tx, u); err != nil {
+				return err
+			}
+		}
+		purged = users
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range purged {
+		log.Infoln("purged user", u.ID)
+	}
+	return len(purged), nil
+}
+
+// sendVerification issues email verification token and asks mailer service to deliver it,
+// only sha256 hash of token is stored in db
+func (s *service) sendVerification(id uuid.UUID, email string) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expiresAt := time.Now().Add(s.verificationTTL)
+	if err := s.verificationRepository.Insert(id, email, hashToken(token), expiresAt); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"user_id":    id,
+		"email":      email,
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	return s.amqp.PublishMessage("user.email_verification_requested", string(body))
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyEmail consumes verification token and marks email as verified, change is audited as done by user themselves
+func (s *service) VerifyEmail(id uuid.UUID, token string, actor Actor) error {
+	actor.Type = ActorUser
+	actor.ID = &id
+	err := s.repository.Transaction(func(tx Repository) error {
+		current, err := tx.SelectById(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrVerificationTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.VerifyEmail(id, hashToken(token)); err != nil {
+			return err
+		}
+		verified, err := tx.SelectById(id)
+		if err != nil {
+			return err
+		}
+		return audit(tx, AuditEmailVerify, id, actor, &current, &verified)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infoln("verified email of user", id)
+	return nil
+}
+
+// ResendVerification sends new verification token, at most one per resend interval
+func (s *service) ResendVerification(id uuid.UUID) error {
+	u, err := s.repository.SelectById(id)
+	if err != nil {
+		return err
+	}
+	if u.EmailVerifiedAt != nil {
+		return ErrEmailAlreadyVerified
+	}
+	lastIssuedAt, err := s.verificationRepository.LastIssuedAt(id)
+	if err != nil {
+		return err
+	}
+	if time.Since(lastIssuedAt) < s.resendInterval {
+		return ErrVerificationThrottled
+	}
+	return s.sendVerification(id, u.Email)
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"github.com/spf13/viper"
+	"time"
 )
 
 type Config struct {
@@ -13,6 +14,83 @@ type Config struct {
 	MqHost     string `mapstructure:"RABBITMQ_HOST"`
 	MqUser     string `mapstructure:"RABBITMQ_DEFAULT_USER"`
 	MqPassword string `mapstructure:"RABBITMQ_DEFAULT_PASS"`
+	MqExchange string `mapstructure:"RABBITMQ_EXCHANGE"`
+	MqBindings string `mapstructure:"RABBITMQ_BINDINGS"`
+
+	MqChannelPoolSize   int           `mapstructure:"RABBITMQ_CHANNEL_POOL_SIZE"`
+	MqPublishWait       time.Duration `mapstructure:"RABBITMQ_PUBLISH_WAIT"`
+	MqConfirmTimeout    time.Duration `mapstructure:"RABBITMQ_CONFIRM_TIMEOUT"`
+	MqReconnectMinDelay time.Duration `mapstructure:"RABBITMQ_RECONNECT_MIN_DELAY"`
+	MqReconnectMaxDelay time.Duration `mapstructure:"RABBITMQ_RECONNECT_MAX_DELAY"`
+
+	MqCommandQueues      string `mapstructure:"RABBITMQ_COMMAND_QUEUES"`
+	MqCommandConcurrency int    `mapstructure:"RABBITMQ_COMMAND_CONCURRENCY"`
+	MqDeadLetterExchange string `mapstructure:"RABBITMQ_DEAD_LETTER_EXCHANGE"`
+
+	MqRPCQueue       string `mapstructure:"RABBITMQ_RPC_QUEUE"`
+	MqRPCConcurrency int    `mapstructure:"RABBITMQ_RPC_CONCURRENCY"`
+
+	OutboxPollInterval time.Duration `mapstructure:"OUTBOX_POLL_INTERVAL"`
+	OutboxBatchSize    int           `mapstructure:"OUTBOX_BATCH_SIZE"`
+	OutboxRetention    time.Duration `mapstructure:"OUTBOX_RETENTION"`
+	EventLegacyPlain   bool          `mapstructure:"EVENT_LEGACY_PLAIN"`
+
+	MessageSigningAlgorithm     string `mapstructure:"MESSAGE_SIGNING_ALGORITHM"`
+	MessageSigningKeys          string `mapstructure:"MESSAGE_SIGNING_KEYS"`
+	MessageEncryptionKeys       string `mapstructure:"MESSAGE_ENCRYPTION_KEYS"`
+	MessageEncryptedRoutingKeys string `mapstructure:"MESSAGE_ENCRYPTED_ROUTING_KEYS"`
+
+	CdcEnabled      bool          `mapstructure:"CDC_ENABLED"`
+	CdcSlot         string        `mapstructure:"CDC_SLOT"`
+	CdcPublication  string        `mapstructure:"CDC_PUBLICATION"`
+	CdcPollInterval time.Duration `mapstructure:"CDC_POLL_INTERVAL"`
+	CdcBatchSize    int           `mapstructure:"CDC_BATCH_SIZE"`
+
+	UserRetention      time.Duration `mapstructure:"USER_RETENTION"`
+	UserPurgeInterval  time.Duration `mapstructure:"USER_PURGE_INTERVAL"`
+	UserPurgeBatchSize int           `mapstructure:"USER_PURGE_BATCH_SIZE"`
+
+	ResyncRoutingKey   string        `mapstructure:"RESYNC_ROUTING_KEY"`
+	ResyncRate         int           `mapstructure:"RESYNC_RATE"`
+	ResyncPageSize     int           `mapstructure:"RESYNC_PAGE_SIZE"`
+	ResyncPollInterval time.Duration `mapstructure:"RESYNC_POLL_INTERVAL"`
+	ResyncLease        time.Duration `mapstructure:"RESYNC_LEASE"`
+
+	JwtAlgorithm      string        `mapstructure:"JWT_ALGORITHM"`
+	JwtSecret         string        `mapstructure:"JWT_SECRET"`
+	JwtPrivateKeyPath string        `mapstructure:"JWT_PRIVATE_KEY_PATH"`
+	JwtPublicKeyPath  string        `mapstructure:"JWT_PUBLIC_KEY_PATH"`
+	JwtIssuer         string        `mapstructure:"JWT_ISSUER"`
+	JwtAccessTTL      time.Duration `mapstructure:"JWT_ACCESS_TTL"`
+	JwtRefreshTTL     time.Duration `mapstructure:"JWT_REFRESH_TTL"`
+
+	SessionCheckInterval time.Duration `mapstructure:"SESSION_CHECK_INTERVAL"`
+
+	PasswordResetTTL time.Duration `mapstructure:"PASSWORD_RESET_TTL"`
+
+	PasswordMinLength      int    `mapstructure:"PASSWORD_MIN_LENGTH"`
+	PasswordMaxLength      int    `mapstructure:"PASSWORD_MAX_LENGTH"`
+	PasswordMinCharClasses int    `mapstructure:"PASSWORD_MIN_CHAR_CLASSES"`
+	PasswordMaxRepeatedRun int    `mapstructure:"PASSWORD_MAX_REPEATED_RUN"`
+	PasswordBreachedFile   string `mapstructure:"PASSWORD_BREACHED_FILE"`
+
+	PasswordHashAlgorithm string `mapstructure:"PASSWORD_HASH_ALGORITHM"`
+	PasswordBcryptCost    int    `mapstructure:"PASSWORD_BCRYPT_COST"`
+	PasswordArgon2Memory  uint32 `mapstructure:"PASSWORD_ARGON2_MEMORY"`
+	PasswordArgon2Time    uint32 `mapstructure:"PASSWORD_ARGON2_TIME"`
+	PasswordArgon2Threads uint8  `mapstructure:"PASSWORD_ARGON2_THREADS"`
+
+	TotpIssuer        string `mapstructure:"TOTP_ISSUER"`
+	TotpEncryptionKey string `mapstructure:"TOTP_ENCRYPTION_KEY"`
+
+	LockoutMaxAccountFailures int           `mapstructure:"LOCKOUT_MAX_ACCOUNT_FAILURES"`
+	LockoutMaxIPFailures      int           `mapstructure:"LOCKOUT_MAX_IP_FAILURES"`
+	LockoutFailureWindow      time.Duration `mapstructure:"LOCKOUT_FAILURE_WINDOW"`
+	LockoutDuration           time.Duration `mapstructure:"LOCKOUT_DURATION"`
+	LockoutBaseDelay          time.Duration `mapstructure:"LOCKOUT_BASE_DELAY"`
+
+	EmailVerificationTTL            time.Duration `mapstructure:"EMAIL_VERIFICATION_TTL"`
+	EmailVerificationResendInterval time.Duration `mapstructure:"EMAIL_VERIFICATION_RESEND_INTERVAL"`
 }
 
 func NewConfig() (Config, error) {
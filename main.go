@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/lib/pq"
@@ -8,9 +9,20 @@ import (
 	"github.com/rubenv/sql-migrate"
 	log "github.com/sirupsen/logrus"
 	"golang-demo/api"
+	"golang-demo/api/apikey"
+	"golang-demo/api/broker"
+	"golang-demo/api/cdc"
+	"golang-demo/api/deadletter"
+	"golang-demo/api/envelope"
+	"golang-demo/api/outbox"
+	"golang-demo/api/password"
+	"golang-demo/api/resync"
+	"golang-demo/api/user"
 	"golang-demo/config"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -42,7 +54,9 @@ func main() {
 	log.Infoln("migrated ", n)
 
 	mqDsn := fmt.Sprintf("amqp://%s:%s@%s:5672/", cfg.MqPassword, cfg.MqUser, cfg.MqHost)
-	conn, err := amqp.Dial(mqDsn)
+	conn, err := broker.Dial(mqDsn, cfg, func(conn *amqp.Connection) error {
+		return user.DeclareTopology(conn, cfg)
+	})
 	if err != nil {
 		log.Fatalln("failed to connect mq", err)
 	}
@@ -54,6 +68,46 @@ func main() {
 		log.Panicln("failed to register status", err)
 	}
 
-	r := api.NewRouter(db, conn, h)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go conn.Run(ctx)
+	sealer, err := envelope.NewSealer(cfg)
+	if err != nil {
+		log.Fatalln("failed to create message sealer", err)
+	}
+	if publicKey := sealer.PublicKey(); publicKey != "" {
+		log.Infoln("messages are signed with ed25519 public key", publicKey)
+	}
+	mQ := user.NewMQ(conn, sealer, cfg)
+	go outbox.NewRelay(outbox.NewRepository(db), mQ, cfg).Run(ctx)
+	if cfg.CdcEnabled {
+		streamer := cdc.NewStreamer(db, mQ, cfg)
+		if err = streamer.Setup(); err != nil {
+			log.Fatalln("failed to set up cdc", err)
+		}
+		go streamer.Run(ctx)
+	}
+
+	userService, err := api.NewUserService(cfg, db, mQ)
+	if err != nil {
+		log.Fatalln("failed to create user service", err)
+	}
+	apiKeyService := apikey.NewService(apikey.NewRepository(db))
+	go user.NewConsumer(conn, userService, apiKeyService, cfg).Run(ctx)
+	go user.NewPurger(userService, cfg).Run(ctx)
+	go deadletter.NewCollector(conn, deadletter.NewRepository(db), cfg).Run(ctx)
+	passwordPolicy, err := password.NewPolicy(cfg)
+	if err != nil {
+		log.Fatalln("failed to create password policy", err)
+	}
+	go user.NewRPCServer(conn, mQ, userService, passwordPolicy, apiKeyService, cfg).Run(ctx)
+
+	resyncRunner := resync.NewRunner(resync.NewRepository(db), user.NewRepository(db), mQ, cfg)
+	go resyncRunner.Run(ctx)
+
+	r, err := api.NewRouter(cfg, db, userService, mQ, deadletter.NewPublisher(conn), resyncRunner, h)
+	if err != nil {
+		log.Fatalln("failed to create router", err)
+	}
 	http.ListenAndServe(":8080", r)
 }
@@ -0,0 +1,9 @@
+-- +migrate Up
+UPDATE outbox SET topic = 'user.created' WHERE topic = 'user_create' AND sent_at IS NULL;
+UPDATE outbox SET topic = 'user.updated' WHERE topic = 'user_update' AND sent_at IS NULL;
+UPDATE outbox SET topic = 'user.deleted' WHERE topic = 'user_delete' AND sent_at IS NULL;
+
+-- +migrate Down
+UPDATE outbox SET topic = 'user_create' WHERE topic = 'user.created' AND sent_at IS NULL;
+UPDATE outbox SET topic = 'user_update' WHERE topic = 'user.updated' AND sent_at IS NULL;
+UPDATE outbox SET topic = 'user_delete' WHERE topic = 'user.deleted' AND sent_at IS NULL;
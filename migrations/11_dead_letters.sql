@@ -0,0 +1,37 @@
+-- +migrate Up
+create table if not exists dead_letters
+(
+    id               uuid                     default gen_random_uuid() not null primary key,
+    queue            text                     not null,
+    exchange         text                     not null,
+    routing_key      text                     not null,
+    message_type     text                     not null,
+    message_id       text                     not null,
+    content_type     text                     not null,
+    headers          jsonb                    not null default '{}',
+    body             bytea                    not null,
+    reason           text                     not null,
+    death_count      integer                  not null default 1,
+    dead_lettered_at timestamp with time zone,
+    received_at      timestamp with time zone default now(),
+    status           text                     not null default 'pending',
+    resolved_at      timestamp with time zone
+);
+
+create index if not exists idx_dead_letters_status on dead_letters (status, received_at);
+
+create table if not exists dead_letter_audit
+(
+    id             uuid                     default gen_random_uuid() not null primary key,
+    dead_letter_id uuid                     not null references dead_letters (id) on delete cascade,
+    action         text                     not null,
+    actor_id       uuid                     not null,
+    error          text,
+    created_at     timestamp with time zone default now()
+);
+
+create index if not exists idx_dead_letter_audit_dead_letter_id on dead_letter_audit (dead_letter_id);
+
+-- +migrate Down
+drop table dead_letter_audit;
+drop table dead_letters;
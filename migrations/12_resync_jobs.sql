@@ -0,0 +1,23 @@
+-- +migrate Up
+create table if not exists resync_jobs
+(
+    id           uuid                     default gen_random_uuid() not null primary key,
+    status       text                     not null default 'running',
+    routing_key  text                     not null,
+    rate         integer                  not null,
+    total        bigint                   not null default 0,
+    published    bigint                   not null default 0,
+    last_id      uuid                     not null default '00000000-0000-0000-0000-000000000000',
+    error        text,
+    requested_by uuid                     not null,
+    lease_until  timestamp with time zone,
+    created_at   timestamp with time zone default now(),
+    updated_at   timestamp with time zone default now(),
+    finished_at  timestamp with time zone
+);
+
+-- only one job may run at a time
+create unique index if not exists idx_resync_jobs_running on resync_jobs (status) where status = 'running';
+
+-- +migrate Down
+drop table resync_jobs;
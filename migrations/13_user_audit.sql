@@ -0,0 +1,36 @@
+-- +migrate Up
+create table if not exists user_audit
+(
+    id         uuid                     default gen_random_uuid() not null primary key,
+    user_id    uuid                     not null,
+    seq        bigint                   not null,
+    action     text                     not null,
+    actor_type text                     not null,
+    actor_id   uuid,
+    request_id text                     not null default '',
+    ip         text                     not null default '',
+    diff       json                     not null,
+    prev_hash  text                     not null,
+    hash       text                     not null,
+    created_at timestamp with time zone not null,
+    unique (user_id, seq)
+);
+
+-- +migrate StatementBegin
+create or replace function user_audit_append_only() returns trigger as
+$$
+begin
+    raise exception 'user_audit is append-only';
+end;
+$$ language plpgsql;
+-- +migrate StatementEnd
+
+create trigger user_audit_append_only
+    before update or delete
+    on user_audit
+    for each row
+execute function user_audit_append_only();
+
+-- +migrate Down
+drop table user_audit;
+drop function user_audit_append_only();
@@ -0,0 +1,18 @@
+-- +migrate Up
+alter table users
+    add column if not exists deleted_at timestamp with time zone;
+
+-- nickname of deleted user may be taken by new user, restore fails then
+alter table users
+    drop constraint if exists idx_users_nickname;
+create unique index if not exists idx_users_nickname on users (nickname) where deleted_at is null;
+create index if not exists idx_users_deleted_at on users (deleted_at) where deleted_at is not null;
+
+-- +migrate Down
+delete from users where deleted_at is not null;
+drop index if exists idx_users_deleted_at;
+drop index if exists idx_users_nickname;
+alter table users
+    add constraint idx_users_nickname unique (nickname);
+alter table users
+    drop column deleted_at;
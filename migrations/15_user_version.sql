@@ -0,0 +1,8 @@
+-- +migrate Up
+-- version is increased by every change of user and is used for optimistic locking
+alter table users
+    add column if not exists version bigint not null default 1;
+
+-- +migrate Down
+alter table users
+    drop column version;
@@ -0,0 +1,26 @@
+-- +migrate Up
+-- aggregate is id of entity described by message, relay publishes messages of one aggregate in order
+alter table outbox
+    add column if not exists aggregate text;
+
+update outbox
+set aggregate = coalesce(case when payload like '{%' then payload::jsonb ->> 'subject' end, payload)
+where aggregate is null;
+
+alter table outbox
+    alter column aggregate set not null;
+
+-- now() is the same for every statement of transaction, clock_timestamp() keeps order of messages written together
+alter table outbox
+    alter column created_at set default clock_timestamp();
+
+create index if not exists idx_outbox_aggregate on outbox (aggregate, created_at) where sent_at is null;
+
+-- +migrate Down
+drop index if exists idx_outbox_aggregate;
+
+alter table outbox
+    alter column created_at set default now();
+
+alter table outbox
+    drop column aggregate;
@@ -0,0 +1,12 @@
+-- +migrate Up
+-- last verified entry of audit chain of every user, verification continues from it
+create table if not exists user_audit_checkpoints
+(
+    user_id     uuid                     not null primary key,
+    seq         bigint                   not null,
+    hash        text                     not null,
+    verified_at timestamp with time zone not null
+);
+
+-- +migrate Down
+drop table user_audit_checkpoints;
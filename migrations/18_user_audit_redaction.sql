@@ -0,0 +1,33 @@
+-- +migrate Up
+alter table user_audit
+    add column redacted_at timestamp with time zone;
+
+-- +migrate StatementBegin
+create or replace function user_audit_append_only() returns trigger as
+$$
+begin
+    -- purge of user erases diff and ip of its entries once, other fields keep the chain verifiable
+    if tg_op = 'UPDATE' and old.redacted_at is null and new.redacted_at is not null
+        and new.id = old.id and new.user_id = old.user_id and new.seq = old.seq and new.action = old.action
+        and new.actor_type = old.actor_type and new.actor_id is not distinct from old.actor_id
+        and new.request_id = old.request_id and new.prev_hash = old.prev_hash and new.hash = old.hash
+        and new.created_at = old.created_at then
+        return new;
+    end if;
+    raise exception 'user_audit is append-only';
+end;
+$$ language plpgsql;
+-- +migrate StatementEnd
+
+-- +migrate Down
+-- +migrate StatementBegin
+create or replace function user_audit_append_only() returns trigger as
+$$
+begin
+    raise exception 'user_audit is append-only';
+end;
+$$ language plpgsql;
+-- +migrate StatementEnd
+
+alter table user_audit
+    drop column redacted_at;
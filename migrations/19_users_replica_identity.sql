@@ -0,0 +1,8 @@
+-- +migrate Up
+-- updates and deletes of users carry previous row for CDC streaming
+alter table users
+    replica identity full;
+
+-- +migrate Down
+alter table users
+    replica identity default;
@@ -0,0 +1,8 @@
+-- +migrate Up
+-- deactivated user can't log in or refresh tokens, unlike deleted user it is kept until activated
+alter table users
+    add column if not exists deactivated_at timestamp with time zone;
+
+-- +migrate Down
+alter table users
+    drop column deactivated_at;
@@ -0,0 +1,7 @@
+-- +migrate Up
+alter table dead_letters
+    add column if not exists claimed_until timestamp with time zone;
+
+-- +migrate Down
+alter table dead_letters
+    drop column claimed_until;
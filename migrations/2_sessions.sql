@@ -0,0 +1,28 @@
+-- +migrate Up
+create table if not exists sessions
+(
+    id                uuid                     default gen_random_uuid() not null primary key,
+    user_id           uuid                     not null
+        references users on delete cascade,
+    user_agent        text,
+    ip                text,
+    created_at        timestamp with time zone default now(),
+    last_refreshed_at timestamp with time zone default now(),
+    expires_at        timestamp with time zone not null,
+    revoked_at        timestamp with time zone
+);
+
+create index if not exists idx_sessions_user_id on sessions (user_id);
+
+create table if not exists refresh_tokens
+(
+    token_hash text                     not null primary key,
+    session_id uuid                     not null
+        references sessions on delete cascade,
+    created_at timestamp with time zone default now(),
+    rotated_at timestamp with time zone
+);
+
+-- +migrate Down
+drop table refresh_tokens;
+drop table sessions;
@@ -0,0 +1,8 @@
+-- +migrate Up
+alter table users
+    add column if not exists role text not null default 'member'
+        constraint chk_users_role check (role in ('admin', 'support', 'member'));
+
+-- +migrate Down
+alter table users
+    drop column role;
@@ -0,0 +1,18 @@
+-- +migrate Up
+create table if not exists api_keys
+(
+    id           uuid                     default gen_random_uuid() not null primary key,
+    name         text                     not null,
+    prefix       text                     not null
+        constraint idx_api_keys_prefix unique,
+    key_hash     text                     not null,
+    scopes       text[]                   not null,
+    created_by   uuid,
+    created_at   timestamp with time zone default now(),
+    expires_at   timestamp with time zone,
+    last_used_at timestamp with time zone,
+    revoked_at   timestamp with time zone
+);
+
+-- +migrate Down
+drop table api_keys;
@@ -0,0 +1,13 @@
+-- +migrate Up
+create table if not exists password_reset_tokens
+(
+    token_hash text                     not null primary key,
+    user_id    uuid                     not null
+        references users on delete cascade,
+    created_at timestamp with time zone default now(),
+    expires_at timestamp with time zone not null,
+    used_at    timestamp with time zone
+);
+
+-- +migrate Down
+drop table password_reset_tokens;
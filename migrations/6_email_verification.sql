@@ -0,0 +1,21 @@
+-- +migrate Up
+alter table users
+    add column if not exists email_verified_at timestamp with time zone;
+
+create table if not exists email_verification_tokens
+(
+    token_hash text                     not null primary key,
+    user_id    uuid                     not null
+        references users on delete cascade,
+    email      text                     not null,
+    created_at timestamp with time zone default now(),
+    expires_at timestamp with time zone not null,
+    used_at    timestamp with time zone
+);
+
+create index if not exists idx_email_verification_tokens_user_id on email_verification_tokens (user_id);
+
+-- +migrate Down
+drop table email_verification_tokens;
+alter table users
+    drop column email_verified_at;
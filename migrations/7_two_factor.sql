@@ -0,0 +1,13 @@
+-- +migrate Up
+alter table users
+    add column if not exists totp_secret         text,
+    add column if not exists totp_enabled_at     timestamp with time zone,
+    add column if not exists totp_recovery_codes text[],
+    add column if not exists totp_last_step      bigint;
+
+-- +migrate Down
+alter table users
+    drop column totp_secret,
+    drop column totp_enabled_at,
+    drop column totp_recovery_codes,
+    drop column totp_last_step;
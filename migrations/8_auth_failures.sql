@@ -0,0 +1,12 @@
+-- +migrate Up
+create table if not exists auth_failures
+(
+    key             text                     not null primary key,
+    failures        integer                  not null default 0,
+    last_failure_at timestamp with time zone default now(),
+    throttled_until timestamp with time zone,
+    locked_until    timestamp with time zone
+);
+
+-- +migrate Down
+drop table auth_failures;
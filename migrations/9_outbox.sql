@@ -0,0 +1,17 @@
+-- +migrate Up
+create table if not exists outbox
+(
+    id              uuid                     default gen_random_uuid() not null primary key,
+    topic           text                     not null,
+    payload         text                     not null,
+    created_at      timestamp with time zone default now(),
+    attempts        integer                  not null default 0,
+    next_attempt_at timestamp with time zone default now(),
+    last_error      text,
+    sent_at         timestamp with time zone
+);
+
+create index if not exists idx_outbox_pending on outbox (next_attempt_at) where sent_at is null;
+
+-- +migrate Down
+drop table outbox;